@@ -0,0 +1,392 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"runtime/pprof"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	klog "github.com/square/keywhiz-fs/log"
+	"golang.org/x/sys/unix"
+)
+
+// maxCPUProfile bounds how long a CPU profile requested through the admin API may run.
+const maxCPUProfile = 5 * time.Minute
+
+// MountHealth describes the health of a filesystem in the admin API.
+type MountHealth struct {
+	Mountpoint string        `json:"mountpoint"`
+	Healthy    bool          `json:"healthy"` // Whether the last request to the server succeeded.
+	Client     *ClientHealth `json:"client,omitempty"`
+	Cache      CacheStats    `json:"cache"`
+}
+
+// ClearCache drops a secret from the cache, or every secret if name is empty.
+func (kwfs KeywhizFs) ClearCache(name string) {
+	if name == "" {
+		kwfs.Cache.Clear()
+	} else {
+		kwfs.Cache.Forget(name)
+	}
+}
+
+// Health describes the health of the filesystem mounted at mountpoint. A filesystem serving
+// secrets from another SecretBackend, without a client, is always healthy.
+func (kwfs KeywhizFs) Health(mountpoint string) MountHealth {
+	health := MountHealth{Mountpoint: mountpoint, Healthy: true, Cache: kwfs.Cache.Stats()}
+	if kwfs.Client != nil {
+		client := kwfs.Client.Health()
+		health.Client = &client
+		health.Healthy = client.Failures == 0
+	}
+	return health
+}
+
+// ReloadClient rebuilds the client from its certificate, key and CA files.
+func (kwfs KeywhizFs) ReloadClient() error {
+	if kwfs.Client == nil {
+		return errors.New("no client")
+	}
+	return kwfs.Client.Reload()
+}
+
+// writeProfile writes a named profile, e.g. heap or goroutine, in human-readable form.
+func writeProfile(w io.Writer, name string) error {
+	p := pprof.Lookup(name)
+	if p == nil {
+		return fmt.Errorf("unknown profile %q", name)
+	}
+	// Set "1" to enable human-readable debug output
+	return p.WriteTo(w, 1)
+}
+
+// AdminServer serves an HTTP API to control filesystems over a Unix domain socket. Connections
+// are only accepted from allowed users, as checked with SO_PEERCRED.
+type AdminServer struct {
+	*klog.Logger
+	filesystems func() map[string]*KeywhizFs // By mountpoint.
+	listener    net.Listener
+	server      *http.Server
+}
+
+// NewAdminServer listens on a Unix domain socket at path, replacing a stale socket. Connections
+// from users other than those in allowedUids are refused. The API controls the filesystems
+// returned by filesystems, by mountpoint.
+func NewAdminServer(path string, allowedUids []uint32, filesystems func() map[string]*KeywhizFs, logConfig klog.Config) (*AdminServer, error) {
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0660); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	allowed := make(map[uint32]bool, len(allowedUids))
+	for _, uid := range allowedUids {
+		allowed[uid] = true
+	}
+	a := &AdminServer{Logger: klog.New("kwfs_admin", logConfig), filesystems: filesystems}
+	a.listener = peerCredListener{listener.(*net.UnixListener), allowed, a.Logger}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", a.handleHealth)
+	mux.HandleFunc("/cache", a.handleCache)
+	mux.HandleFunc("/cache/clear", a.handleCacheClear)
+	mux.HandleFunc("/cache/refresh", a.handleCacheRefresh)
+	mux.HandleFunc("/client/reload", a.handleClientReload)
+	mux.HandleFunc("/debug", a.handleDebug)
+	mux.HandleFunc("/pprof/", a.handleProfile)
+	a.server = &http.Server{Handler: mux}
+	return a, nil
+}
+
+// Serve accepts connections until the server is closed.
+func (a *AdminServer) Serve() error {
+	err := a.server.Serve(a.listener)
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// Close stops serving, and removes the socket.
+func (a *AdminServer) Close() error {
+	return a.server.Close()
+}
+
+// peerCredListener accepts connections from allowed users only.
+type peerCredListener struct {
+	*net.UnixListener
+	allowed map[uint32]bool
+	logger  *klog.Logger
+}
+
+func (l peerCredListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.AcceptUnix()
+		if err != nil {
+			return nil, err
+		}
+		cred, err := peerCred(conn)
+		if err != nil {
+			l.logger.Warnf("Refusing admin connection without credentials: %v", err)
+			conn.Close()
+			continue
+		}
+		if !l.allowed[cred.Uid] {
+			l.logger.Warnf("Refusing admin connection from uid %d, pid %d", cred.Uid, cred.Pid)
+			conn.Close()
+			continue
+		}
+		return conn, nil
+	}
+}
+
+// peerCred returns the credentials of the process connected to a Unix domain socket.
+func peerCred(conn *net.UnixConn) (*unix.Ucred, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var cred *unix.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cred, credErr
+}
+
+// filesystem returns the filesystem mounted at the mountpoint given by the request's mount
+// parameter, which may be left out if there is only one.
+func (a *AdminServer) filesystem(r *http.Request) (*KeywhizFs, error) {
+	filesystems := a.filesystems()
+	mountpoint := r.FormValue("mount")
+	if mountpoint == "" {
+		if len(filesystems) != 1 {
+			return nil, errors.New("mount parameter required")
+		}
+		for _, kwfs := range filesystems {
+			return kwfs, nil
+		}
+	}
+	kwfs, ok := filesystems[strings.TrimSuffix(mountpoint, "/")]
+	if !ok || kwfs == nil {
+		return nil, fmt.Errorf("%s is not mounted", mountpoint)
+	}
+	return kwfs, nil
+}
+
+// allowMethod returns whether the request uses method, replying with an error if not.
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		writeAdminError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s required", method))
+		return false
+	}
+	return true
+}
+
+func writeAdminJSON(w http.ResponseWriter, status int, value interface{}) {
+	data, err := json.Marshal(value)
+	panicOnError(err)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+func writeAdminError(w http.ResponseWriter, status int, err error) {
+	writeAdminJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// handleHealth describes the health of every filesystem, failing if one is unhealthy.
+func (a *AdminServer) handleHealth(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, "GET") {
+		return
+	}
+	status := http.StatusOK
+	mounts := []MountHealth{}
+	for mountpoint, kwfs := range a.filesystems() {
+		if kwfs == nil {
+			continue
+		}
+		health := kwfs.Health(mountpoint)
+		if !health.Healthy {
+			status = http.StatusServiceUnavailable
+		}
+		mounts = append(mounts, health)
+	}
+	sort.Slice(mounts, func(i, j int) bool { return mounts[i].Mountpoint < mounts[j].Mountpoint })
+	writeAdminJSON(w, status, map[string]interface{}{"healthy": status == http.StatusOK, "mounts": mounts})
+}
+
+// handleCache dumps the state of a cache, without secret content.
+func (a *AdminServer) handleCache(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, "GET") {
+		return
+	}
+	kwfs, err := a.filesystem(r)
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, kwfs.Cache.Dump())
+}
+
+// handleCacheClear drops the secrets given by name parameters from a cache, or all of them.
+func (a *AdminServer) handleCacheClear(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, "POST") {
+		return
+	}
+	kwfs, err := a.filesystem(r)
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+	names := r.Form["name"]
+	for _, name := range names {
+		if err := ValidateSecretName(name); err != nil {
+			writeAdminError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	if len(names) == 0 {
+		kwfs.ClearCache("")
+	}
+	for _, name := range names {
+		kwfs.ClearCache(name)
+	}
+	a.Infof("Cache cleared by admin request: %v", names)
+	writeAdminJSON(w, http.StatusOK, map[string][]string{"cleared": names})
+}
+
+// handleCacheRefresh fetches the secrets given by name parameters from the server.
+func (a *AdminServer) handleCacheRefresh(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, "POST") {
+		return
+	}
+	kwfs, err := a.filesystem(r)
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+	names := r.Form["name"]
+	if len(names) == 0 {
+		writeAdminError(w, http.StatusBadRequest, errors.New("name parameter required"))
+		return
+	}
+	for _, name := range names {
+		if err := ValidateSecretName(name); err != nil {
+			writeAdminError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	status := http.StatusOK
+	results := make(map[string]string, len(names))
+	for _, name := range names {
+		if err := kwfs.Cache.Refresh(name); err != nil {
+			status = http.StatusBadGateway
+			results[name] = err.Error()
+		} else {
+			results[name] = "refreshed"
+		}
+	}
+	writeAdminJSON(w, status, results)
+}
+
+// handleClientReload rebuilds the client of a filesystem, e.g. once its certificate is renewed.
+func (a *AdminServer) handleClientReload(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, "POST") {
+		return
+	}
+	kwfs, err := a.filesystem(r)
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := kwfs.ReloadClient(); err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, map[string]bool{"reloaded": true})
+}
+
+// handleDebug shows whether debugging output is enabled, and toggles it given an enabled parameter.
+func (a *AdminServer) handleDebug(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "POST":
+		enabled, err := strconv.ParseBool(r.FormValue("enabled"))
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, errors.New("enabled parameter should be true or false"))
+			return
+		}
+		klog.SetDebug(enabled)
+		a.Infof("Debugging output enabled: %t", enabled)
+	default:
+		allowMethod(w, r, "POST")
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, map[string]bool{"debug": a.Debugging()})
+}
+
+// handleProfile writes a named profile, or a CPU profile of the given seconds.
+func (a *AdminServer) handleProfile(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, "GET") {
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/pprof/")
+	if name != "cpu" {
+		w.Header().Set("Content-Type", "text/plain")
+		if err := writeProfile(w, name); err != nil {
+			writeAdminError(w, http.StatusNotFound, err)
+		}
+		return
+	}
+
+	seconds, err := strconv.Atoi(r.FormValue("seconds"))
+	duration := time.Duration(seconds) * time.Second
+	if err != nil || duration <= 0 || duration > maxCPUProfile {
+		writeAdminError(w, http.StatusBadRequest, fmt.Errorf("seconds parameter should be within 1 and %d", int(maxCPUProfile.Seconds())))
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if err := pprof.StartCPUProfile(w); err != nil {
+		writeAdminError(w, http.StatusConflict, err)
+		return
+	}
+	select {
+	case <-time.After(duration):
+	case <-r.Context().Done():
+	}
+	pprof.StopCPUProfile()
+}
@@ -0,0 +1,170 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	klog "github.com/square/keywhiz-fs/log"
+	"github.com/stretchr/testify/assert"
+)
+
+// adminClient makes requests to the admin API over the socket at path.
+func adminClient(path string) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			Dial: func(_, _ string) (net.Conn, error) {
+				return net.Dial("unix", path)
+			},
+		},
+		Timeout: 5 * time.Second,
+	}
+}
+
+// startAdminServer serves the admin API for filesystems on a socket in a temporary directory,
+// returning its path and a function to stop serving.
+func startAdminServer(t *testing.T, allowedUids []uint32, filesystems map[string]*KeywhizFs) (string, func()) {
+	dir, err := ioutil.TempDir("", "kwfs-admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "admin.sock")
+	admin, err := NewAdminServer(path, allowedUids, func() map[string]*KeywhizFs { return filesystems }, logConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go admin.Serve()
+	return path, func() {
+		admin.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestAdminServer(t *testing.T) {
+	assert := assert.New(t)
+	defer klog.SetDebug(false)
+
+	backend := NewMapBackend(
+		Secret{Name: "foo", Content: content("hunter2")},
+		Secret{Name: "bar", Content: content("hunter3")})
+	timeouts := Timeouts{time.Hour, time.Second, 2 * time.Second, time.Hour}
+	kwfs, _, err := NewKeywhizFs(nil, backend, Ownership{Uid: 1000, Gid: 1000}, timeouts, nil, logConfig)
+	assert.NoError(err)
+	kwfs.Cache.Warmup()
+	_, ok := kwfs.Cache.Secret("foo")
+	assert.True(ok)
+
+	path, stop := startAdminServer(t, []uint32{uint32(os.Geteuid())}, map[string]*KeywhizFs{"/secrets": kwfs})
+	defer stop()
+	client := adminClient(path)
+
+	request := func(method, url string) (int, map[string]interface{}) {
+		req, err := http.NewRequest(method, "http://admin"+url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var body map[string]interface{}
+		assert.NoError(json.NewDecoder(resp.Body).Decode(&body), url)
+		return resp.StatusCode, body
+	}
+
+	status, body := request("GET", "/health")
+	assert.Equal(http.StatusOK, status)
+	assert.Equal(true, body["healthy"])
+
+	// The cache is dumped without content.
+	resp, err := client.Get("http://admin/cache")
+	if assert.NoError(err) {
+		data, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Contains(string(data), `"name":"foo"`)
+		assert.NotContains(string(data), "hunter")
+	}
+
+	backend.Put(Secret{Name: "foo", Content: content("hunter4")})
+	status, _ = request("POST", "/cache/refresh?mount=/secrets&name=foo")
+	assert.Equal(http.StatusOK, status)
+	secret, _ := kwfs.Cache.Secret("foo")
+	assert.EqualValues("hunter4", secret.Content)
+	status, _ = request("POST", "/cache/refresh?name=missing")
+	assert.Equal(http.StatusBadGateway, status)
+	status, _ = request("POST", "/cache/refresh")
+	assert.Equal(http.StatusBadRequest, status)
+
+	status, _ = request("POST", "/cache/clear?name=foo")
+	assert.Equal(http.StatusOK, status)
+	_, ok = kwfs.Cache.secretMap.Get("foo")
+	assert.False(ok)
+	_, ok = kwfs.Cache.secretMap.Get("bar")
+	assert.True(ok)
+	status, _ = request("POST", "/cache/clear")
+	assert.Equal(http.StatusOK, status)
+	assert.Equal(0, kwfs.Cache.Len())
+
+	status, body = request("POST", "/debug?enabled=true")
+	assert.Equal(http.StatusOK, status)
+	assert.Equal(true, body["debug"])
+	assert.True(kwfs.Debugging())
+	status, body = request("POST", "/debug?enabled=false")
+	assert.Equal(false, body["debug"])
+	assert.False(kwfs.Debugging())
+
+	// Without a client, there is nothing to reload.
+	status, _ = request("POST", "/client/reload")
+	assert.Equal(http.StatusInternalServerError, status)
+
+	status, _ = request("GET", "/cache?mount=/other")
+	assert.Equal(http.StatusBadRequest, status)
+	status, _ = request("GET", "/cache/clear")
+	assert.Equal(http.StatusMethodNotAllowed, status)
+	status, _ = request("GET", "/pprof/missing")
+	assert.Equal(http.StatusNotFound, status)
+	status, _ = request("GET", "/pprof/cpu?seconds=0")
+	assert.Equal(http.StatusBadRequest, status)
+
+	resp, err = client.Get("http://admin/pprof/goroutine")
+	if assert.NoError(err) {
+		data, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.True(strings.HasPrefix(string(data), "goroutine profile:"))
+	}
+}
+
+func TestAdminServerRefusesOtherUsers(t *testing.T) {
+	assert := assert.New(t)
+
+	path, stop := startAdminServer(t, []uint32{uint32(os.Geteuid()) + 1}, map[string]*KeywhizFs{})
+	defer stop()
+
+	info, err := os.Stat(path)
+	if assert.NoError(err) {
+		assert.EqualValues(0660, info.Mode().Perm())
+	}
+	_, err = adminClient(path).Get("http://admin/health")
+	assert.Error(err)
+}
@@ -0,0 +1,124 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// Aliases maps paths in the mount to secret names. Each alias is served as a symlink to the
+// secret, and paths may be nested in directories, e.g. "app/config/db_password".
+type Aliases map[string]string
+
+// NewAliases validates a mapping of paths to secret names. Paths are cleaned; they must be relative
+// and can't conflict with control files or with each other.
+func NewAliases(m map[string]string) (Aliases, error) {
+	aliases := make(Aliases, len(m))
+	for p, name := range m {
+		cleaned := path.Clean(p)
+		if strings.HasPrefix(cleaned, "/") || cleaned == "." || strings.HasPrefix(cleaned, "..") {
+			return nil, fmt.Errorf("alias %q should be a relative path inside the mount", p)
+		}
+		for _, part := range strings.Split(cleaned, "/") {
+			if strings.HasPrefix(part, ".") {
+				return nil, fmt.Errorf("alias %q should not contain names beginning with '.'", p)
+			}
+		}
+		if name == "" || strings.Contains(name, "/") {
+			return nil, fmt.Errorf("alias %q should refer to a secret name, got %q", p, name)
+		}
+		if _, ok := aliases[cleaned]; ok {
+			return nil, fmt.Errorf("alias %q is defined more than once", cleaned)
+		}
+		aliases[cleaned] = name
+	}
+	for p := range aliases {
+		if aliases.IsDir(p) {
+			return nil, fmt.Errorf("alias %q is also a directory of other aliases", p)
+		}
+	}
+	return aliases, nil
+}
+
+// Target returns the symlink target of an alias, relative to the alias' directory.
+func (a Aliases) Target(p string) (string, bool) {
+	name, ok := a[p]
+	if !ok {
+		return "", false
+	}
+	return strings.Repeat("../", strings.Count(p, "/")) + name, true
+}
+
+// IsDir indicates if p is a directory containing aliases.
+func (a Aliases) IsDir(p string) bool {
+	for alias := range a {
+		if strings.HasPrefix(alias, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Entries produces the directory entries for the aliases and alias directories found directly in
+// dir. The empty string is the base directory.
+func (a Aliases) Entries(dir string) []fuse.DirEntry {
+	prefix := ""
+	if dir != "" {
+		prefix = dir + "/"
+	}
+	modes := make(map[string]uint32)
+	for alias := range a {
+		if !strings.HasPrefix(alias, prefix) {
+			continue
+		}
+		rest := alias[len(prefix):]
+		if i := strings.Index(rest, "/"); i >= 0 {
+			modes[rest[:i]] = fuse.S_IFDIR
+		} else {
+			modes[rest] = fuse.S_IFLNK
+		}
+	}
+
+	if len(modes) == 0 {
+		return nil
+	}
+	entries := make([]fuse.DirEntry, 0, len(modes))
+	for name, mode := range modes {
+		entries = append(entries, fuse.DirEntry{Name: name, Mode: mode})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries
+}
+
+// Missing returns the aliases whose secret is not in secrets, sorted.
+func (a Aliases) Missing(secrets []Secret) []string {
+	names := make(map[string]bool, len(secrets))
+	for _, s := range secrets {
+		names[s.Name] = true
+	}
+	var missing []string
+	for p, name := range a {
+		if !names[name] {
+			missing = append(missing, p)
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
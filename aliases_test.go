@@ -0,0 +1,151 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAliases(t *testing.T) {
+	assert := assert.New(t)
+
+	aliases, err := NewAliases(map[string]string{
+		"db_password":      "Nobody_PgPass",
+		"app/./config/key": "hmac.key",
+		"app/missing":      "Missing_Secret",
+	})
+	assert.NoError(err)
+
+	target, ok := aliases.Target("db_password")
+	assert.True(ok)
+	assert.Equal("Nobody_PgPass", target)
+	target, ok = aliases.Target("app/config/key")
+	assert.True(ok)
+	assert.Equal("../../hmac.key", target)
+	_, ok = aliases.Target("app")
+	assert.False(ok)
+
+	assert.True(aliases.IsDir("app"))
+	assert.True(aliases.IsDir("app/config"))
+	assert.False(aliases.IsDir("app/config/key"))
+	assert.False(aliases.IsDir("ap"))
+
+	assert.Equal([]fuse.DirEntry{
+		{Name: "app", Mode: fuse.S_IFDIR},
+		{Name: "db_password", Mode: fuse.S_IFLNK},
+	}, aliases.Entries(""))
+	assert.Equal([]fuse.DirEntry{
+		{Name: "config", Mode: fuse.S_IFDIR},
+		{Name: "missing", Mode: fuse.S_IFLNK},
+	}, aliases.Entries("app"))
+	assert.Empty(aliases.Entries("db_password"))
+
+	assert.Equal([]string{"app/missing"}, aliases.Missing([]Secret{{Name: "Nobody_PgPass"}, {Name: "hmac.key"}}))
+
+	// A nil Aliases has no entries.
+	var none Aliases
+	assert.Empty(none.Entries(""))
+	assert.False(none.IsDir("app"))
+}
+
+func newAliasedFs(t *testing.T) *KeywhizFs {
+	backend := NewMapBackend(
+		Secret{Name: "Nobody_PgPass", Content: content("asddas"), Length: 6},
+		Secret{Name: "hmac.key", Content: content("hmac"), Length: 4},
+		Secret{Name: "db_password", Content: content("shadowed"), Length: 8})
+	timeouts := Timeouts{0, 100 * time.Millisecond, 200 * time.Millisecond, time.Hour}
+	kwfs, _, err := NewKeywhizFs(nil, backend, Ownership{Uid: 1000, Gid: 1000}, timeouts, nil, logConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := LoadConfig("fixtures/config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	kwfs.Aliases = config.Aliases
+	return kwfs
+}
+
+func TestFsAliases(t *testing.T) {
+	assert := assert.New(t)
+	context := &fuse.Context{}
+	kwfs := newAliasedFs(t)
+
+	entries, status := kwfs.OpenDir("", context)
+	assert.Equal(fuse.OK, status)
+	assert.Contains(entries, fuse.DirEntry{Name: "app", Mode: fuse.S_IFDIR})
+	assert.Contains(entries, fuse.DirEntry{Name: "db_password", Mode: fuse.S_IFLNK})
+	assert.NotContains(entries, fuse.DirEntry{Name: "db_password", Mode: fuse.S_IFREG}, "aliases should shadow secrets")
+
+	entries, status = kwfs.OpenDir("app", context)
+	assert.Equal(fuse.OK, status)
+	assert.Equal([]fuse.DirEntry{{Name: "config", Mode: fuse.S_IFDIR}, {Name: "missing", Mode: fuse.S_IFLNK}}, entries)
+
+	attr, status := kwfs.GetAttr("app/config", context)
+	assert.Equal(fuse.OK, status)
+	assert.EqualValues(fuse.S_IFDIR|0755, attr.Mode)
+	_, status = kwfs.Open("app/config", 0, context)
+	assert.Equal(fuseEISDIR, status)
+
+	attr, status = kwfs.GetAttr("app/config/hmac", context)
+	assert.Equal(fuse.OK, status)
+	assert.True(attr.IsSymlink())
+	target, status := kwfs.Readlink("app/config/hmac", context)
+	assert.Equal(fuse.OK, status)
+	assert.Equal("../../hmac.key", target)
+	assert.EqualValues(len(target), attr.Size)
+
+	target, status = kwfs.Readlink("app/missing", context)
+	assert.Equal(fuse.OK, status, "aliases to missing secrets are dangling links")
+	assert.Equal("../Missing_Secret", target)
+
+	_, status = kwfs.Readlink("Nobody_PgPass", context)
+	assert.Equal(fuse.ENOENT, status)
+
+	var info StatusInfo
+	assert.NoError(json.Unmarshal(kwfs.statusJSON(), &info))
+	assert.Equal([]string{"app/missing"}, info.MissingAliases)
+}
+
+func TestHarnessAliases(t *testing.T) {
+	assert := assert.New(t)
+
+	kwfs := newAliasedFs(t)
+	h := newFsHarness(t, NewMapBackend(
+		Secret{Name: "Nobody_PgPass", Content: content("asddas"), Length: 6},
+		Secret{Name: "hmac.key", Content: content("hmac"), Length: 4}))
+	defer h.Close()
+	h.fs.Aliases = kwfs.Aliases
+
+	data, err := h.Read("app/config/hmac")
+	assert.NoError(err)
+	assert.Equal([]byte("hmac"), data)
+	data, err = h.Read("db_password")
+	assert.NoError(err)
+	assert.Equal([]byte("asddas"), data)
+
+	info, err := os.Lstat(h.Path("db_password"))
+	assert.NoError(err)
+	assert.Equal(os.ModeSymlink, info.Mode()&os.ModeSymlink)
+
+	_, err = h.Read("app/missing")
+	assert.True(os.IsNotExist(err))
+}
@@ -15,8 +15,12 @@
 package main
 
 import (
+	"fmt"
+	"sort"
+	"sync"
 	"time"
 
+	"github.com/rcrowley/go-metrics"
 	"github.com/square/keywhiz-fs/log"
 )
 
@@ -41,14 +45,79 @@ type Timeouts struct {
 	DeletionDelay time.Duration
 }
 
+// StalePolicy bounds how long cached content is served when the backend can't confirm it.
+type StalePolicy struct {
+	// MaxStale is the age, since the backend last returned it, past which cached content is
+	// refused unless the backend confirms it. Zero is unlimited.
+	MaxStale time.Duration
+	// Revalidate is how long past Fresh cached content is returned without waiting for the
+	// backend, while it is refreshed in the background.
+	Revalidate time.Duration
+	// NotFound reports refused secrets as missing (ENOENT) rather than unreadable (EIO).
+	NotFound bool
+}
+
+// NegativeCachePolicy controls caching of lookups for secrets which don't exist.
+type NegativeCachePolicy struct {
+	// TTL is how long a name the backend reported missing is assumed missing, unless a listing
+	// introduces it. Zero disables caching misses.
+	TTL time.Duration
+	// Strict assumes names absent from the latest listing are missing, without asking the backend.
+	// A lookup finding the listing older than TTL, or than the Fresh timeout if TTL is zero,
+	// refreshes it first.
+	Strict bool
+}
+
+// SecretStaleness describes the age of cached content in `.json/status`.
+type SecretStaleness struct {
+	Name        string    `json:"name"`
+	ConfirmedAt time.Time `json:"confirmed_at"`
+	AgeSeconds  float64   `json:"age_seconds"`
+	Stale       bool      `json:"stale"`
+}
+
+// CacheEntry describes a cached secret, without its content, in the admin API's cache dump.
+type CacheEntry struct {
+	Name        string     `json:"name"`
+	Length      uint64     `json:"length"`
+	Resident    bool       `json:"resident"` // Whether content is held, rather than only metadata.
+	ConfirmedAt time.Time  `json:"confirmed_at"`
+	DeleteAt    *time.Time `json:"delete_at,omitempty"` // Set once the backend reported it deleted.
+	Stale       bool       `json:"stale"`
+}
+
+// CacheDump describes the state of a cache, without secret content.
+type CacheDump struct {
+	Stats   CacheStats   `json:"stats"`
+	Entries []CacheEntry `json:"entries"`
+	Missing []string     `json:"missing,omitempty"` // Cached misses.
+}
+
 // Cache contains necessary state to return secrets, using previously cached content or retrieving
 // from a server if necessary.
 type Cache struct {
 	*log.Logger
-	secretMap *SecretMap
-	backend   SecretBackend
-	timeouts  Timeouts
-	now       func() time.Time
+	secretMap    *SecretMap
+	history      *versionHistory
+	backend      SecretBackend
+	timeouts     Timeouts
+	now          func() time.Time
+	stale        StalePolicy
+	negative     NegativeCachePolicy
+	lock         sync.Mutex
+	revalidating map[string]bool
+	misses       map[string]time.Time // Expiry of cached misses, by name.
+	listed       map[string]bool      // Names in the latest listing, nil until one succeeds.
+	listedAt     time.Time
+	negativeHits metrics.Counter
+}
+
+// CacheStats describes the secret content held by a Cache.
+type CacheStats struct {
+	ResidentBytes   uint64 `json:"resident_bytes"`
+	ResidentEntries int    `json:"resident_entries"`
+	Evictions       uint64 `json:"evictions"`
+	NegativeHits    uint64 `json:"negative_hits"`
 }
 
 type secretResult struct {
@@ -59,7 +128,17 @@ type secretResult struct {
 // NewCache initializes a Cache.
 func NewCache(backend SecretBackend, timeouts Timeouts, logConfig log.Config, now func() time.Time) *Cache {
 	logger := log.New("kwfs_cache", logConfig)
-	return &Cache{logger, NewSecretMap(timeouts, now), backend, timeouts, now}
+	return &Cache{
+		Logger:       logger,
+		secretMap:    NewSecretMap(timeouts, now),
+		history:      newVersionHistory(),
+		backend:      backend,
+		timeouts:     timeouts,
+		now:          now,
+		revalidating: make(map[string]bool),
+		misses:       make(map[string]time.Time),
+		negativeHits: metrics.NewCounter(),
+	}
 }
 
 // Warmup reads the secret list from the backend to prime the cache.
@@ -71,6 +150,7 @@ func (c *Cache) Warmup() {
 		for _, backendSecret := range secrets {
 			c.secretMap.Put(backendSecret.Name, backendSecret, time.Time{})
 		}
+		c.setListed(secrets)
 	} else {
 		c.Warnf("Failed to warmup cache on startup")
 	}
@@ -81,7 +161,144 @@ func (c *Cache) Warmup() {
 // .clear_cache.
 func (c *Cache) Clear() {
 	c.Infof("Cache cleared")
-	c.secretMap = NewSecretMap(c.timeouts, c.now)
+	c.secretMap.Clear()
+	c.history.Clear()
+	c.lock.Lock()
+	c.misses = make(map[string]time.Time)
+	c.lock.Unlock()
+}
+
+// Forget drops a secret from the cache, along with a cached miss for it, so that it is fetched
+// again on next access. Unlike Clear, other secrets are kept.
+func (c *Cache) Forget(name string) {
+	c.Infof("Cache entry for '%s' cleared", name)
+	c.secretMap.Remove(name)
+	c.lock.Lock()
+	delete(c.misses, name)
+	c.lock.Unlock()
+}
+
+// Refresh fetches a secret from the backend right away, waiting up to the max wait. A secret the
+// backend reports deleted is scheduled for deletion.
+func (c *Cache) Refresh(name string) error {
+	c.lock.Lock()
+	delete(c.misses, name)
+	c.lock.Unlock()
+
+	backendDone := c.backendSecret(name)
+	select {
+	case s := <-backendDone:
+		s.secret.Release()
+		if _, ok := s.err.(SecretDeleted); ok {
+			c.secretMap.Delete(name)
+			c.recordMiss(name)
+		}
+		return s.err
+	case <-time.After(c.timeouts.MaxWait):
+		discard(backendDone)
+		return fmt.Errorf("backend timeout on secret fetch for '%s'", name)
+	}
+}
+
+// Dump describes the cached secrets, by name, and cached misses, without any secret content.
+func (c *Cache) Dump() CacheDump {
+	dump := CacheDump{Stats: c.Stats(), Entries: []CacheEntry{}}
+	for _, s := range c.secretMap.Entries() {
+		entry := CacheEntry{
+			Name:        s.Secret.Name,
+			Length:      s.Secret.Length,
+			Resident:    s.resident(),
+			ConfirmedAt: s.Time,
+		}
+		if entry.Resident {
+			entry.Stale = c.tooStale(s.Time)
+		}
+		if !s.ttl.IsZero() {
+			deleteAt := s.ttl
+			entry.DeleteAt = &deleteAt
+		}
+		dump.Entries = append(dump.Entries, entry)
+	}
+	sort.Slice(dump.Entries, func(i, j int) bool { return dump.Entries[i].Name < dump.Entries[j].Name })
+
+	now := c.secretMap.getNow()
+	c.lock.Lock()
+	for name, expiry := range c.misses {
+		if now.Before(expiry) {
+			dump.Missing = append(dump.Missing, name)
+		}
+	}
+	c.lock.Unlock()
+	sort.Strings(dump.Missing)
+	return dump
+}
+
+// SetLimits bounds the secret content held by the cache. Content of the least recently used
+// secrets is evicted past the limits, while their metadata is kept.
+func (c *Cache) SetLimits(limits CacheLimits) {
+	c.secretMap.SetLimits(limits)
+}
+
+// SetMetrics reports evictions from the cache and negative cache hits in registry.
+func (c *Cache) SetMetrics(registry metrics.Registry) {
+	c.secretMap.SetEvictionCounter(metrics.GetOrRegisterCounter("runtime.cache.evictions", registry))
+	negativeHits := metrics.GetOrRegisterCounter("runtime.cache.negative_hits", registry)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	negativeHits.Inc(c.negativeHits.Count())
+	c.negativeHits = negativeHits
+}
+
+// SetStalePolicy bounds how long cached content is served. It must be called before the cache is
+// used.
+func (c *Cache) SetStalePolicy(policy StalePolicy) {
+	c.stale = policy
+}
+
+// SetNegativeCache enables caching lookups for secrets which don't exist. It must be called before
+// the cache is used.
+func (c *Cache) SetNegativeCache(policy NegativeCachePolicy) {
+	c.negative = policy
+}
+
+// Stale reports whether cached content for a secret is older than the max-stale age, and so is
+// refused unless the backend confirms it.
+func (c *Cache) Stale(name string) bool {
+	cached, ok := c.secretMap.Get(name)
+	cached.Secret.Release()
+	return ok && len(cached.Secret.Content) > 0 && c.tooStale(cached.Time)
+}
+
+// Staleness describes the age of all cached content, by name.
+func (c *Cache) Staleness() []SecretStaleness {
+	now := c.secretMap.getNow()
+	var staleness []SecretStaleness
+	for _, s := range c.secretMap.Entries() {
+		if !s.resident() {
+			continue
+		}
+		staleness = append(staleness, SecretStaleness{
+			Name:        s.Secret.Name,
+			ConfirmedAt: s.Time,
+			AgeSeconds:  now.Sub(s.Time).Seconds(),
+			Stale:       c.tooStale(s.Time),
+		})
+	}
+	sort.Slice(staleness, func(i, j int) bool { return staleness[i].Name < staleness[j].Name })
+	return staleness
+}
+
+// tooStale reports whether content confirmed at the given time is past the max-stale age.
+func (c *Cache) tooStale(confirmed time.Time) bool {
+	return c.stale.MaxStale > 0 && c.secretMap.getNow().Sub(confirmed) > c.stale.MaxStale
+}
+
+// Stats returns statistics about the content held by the cache.
+func (c *Cache) Stats() CacheStats {
+	bytes, entries := c.secretMap.Resident()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return CacheStats{bytes, entries, c.secretMap.Evictions(), uint64(c.negativeHits.Count())}
 }
 
 // Secret retrieves a Secret by name from cache or a server.
@@ -94,9 +311,17 @@ func (c *Cache) Clear() {
 //			* If backend returns success: update cache, return.
 //			* If backend returns deleted: set delayed deletion, return data from cache.
 //  3. If timeout backend deadline hit return whatever we have.
+//
+// Entries within the stale-while-revalidate window are returned immediately and refreshed in the
+// background. Entries past the max-stale age are only returned if the backend confirms them.
+//
+// A secret with content holds a reference to it, and must be released by the caller.
 func (c *Cache) Secret(name string) (*Secret, bool) {
 	// Perform cache lookup first
 	cacheResult := c.cacheSecret(name)
+	if cacheResult == nil && c.knownMissing(name) {
+		return nil, false
+	}
 
 	var secret *Secret
 	var success bool
@@ -106,7 +331,14 @@ func (c *Cache) Secret(name string) (*Secret, bool) {
 		success = !cacheResult.deleted
 
 		// immediately return fresh cache result
-		if time.Since(cacheResult.Time) < c.timeouts.Fresh {
+		if c.secretMap.getNow().Sub(cacheResult.Time) < c.timeouts.Fresh {
+			return secret, success
+		}
+
+		if c.tooStale(cacheResult.Time) {
+			success = false
+		} else if success && c.secretMap.getNow().Sub(cacheResult.Time) < c.timeouts.Fresh+c.stale.Revalidate {
+			c.revalidate(name)
 			return secret, success
 		}
 	}
@@ -117,18 +349,161 @@ func (c *Cache) Secret(name string) (*Secret, bool) {
 	select {
 	case s := <-backendDone:
 		if s.err == nil {
+			secret.Release()
 			secret = s.secret
 			success = true
 		} else if _, ok := s.err.(SecretDeleted); ok {
 			c.secretMap.Delete(name)
+			c.recordMiss(name)
 		}
 	case <-backendDeadline:
 		c.Errorf("Backend timeout on secret fetch for '%s'", name)
+		discard(backendDone)
 	}
 
+	if !success && cacheResult != nil && !cacheResult.deleted && c.tooStale(cacheResult.Time) {
+		secret.Release()
+		c.Warnf("Refusing cached content of '%s', last confirmed at %s", name, cacheResult.Time.Format(time.RFC3339))
+		return nil, false
+	}
 	return secret, success
 }
 
+// revalidate refreshes a secret from the backend in the background, unless a refresh is already
+// in flight.
+func (c *Cache) revalidate(name string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.revalidating[name] {
+		return
+	}
+	c.revalidating[name] = true
+
+	backendDone := c.backendSecret(name)
+	go func() {
+		s := <-backendDone
+		s.secret.Release()
+		if _, ok := s.err.(SecretDeleted); ok {
+			c.secretMap.Delete(name)
+		}
+		c.lock.Lock()
+		delete(c.revalidating, name)
+		c.lock.Unlock()
+	}()
+}
+
+// SecretAttr retrieves a Secret by name for computing its attributes, without fetching content
+// which isn't cached.
+//
+// If the secret is only known from a listing, its metadata is returned as is, with Length and
+// CreatedAt as listed. Otherwise, it is retrieved like Secret, so the length of cached content
+// wins over the listed one and an open file's size matches the bytes read. The returned secret
+// has no content.
+func (c *Cache) SecretAttr(name string) (*Secret, bool) {
+	cached, ok := c.secretMap.Get(name)
+	cached.Secret.Release()
+	if ok && len(cached.Secret.Content) == 0 && !cached.deleted {
+		c.Debugf("Cache hit from listing: %v", name)
+		return &cached.Secret, true
+	}
+	secret, ok := c.Secret(name)
+	if secret == nil {
+		return nil, ok
+	}
+	metadata := secret.metadata()
+	secret.Release()
+	return &metadata, ok
+}
+
+// Cached retrieves a secret only if its content is cached, without contacting the backend or
+// counting as a use of the content. The secret must be released by the caller.
+func (c *Cache) Cached(name string) (*Secret, bool) {
+	cached, ok := c.secretMap.Peek(name)
+	if !ok || len(cached.Secret.Content) == 0 {
+		return nil, false
+	}
+	return &cached.Secret, true
+}
+
+// knownMissing reports whether a secret without a cache entry is known not to exist, from a
+// recent miss or, in strict mode, from its absence in the latest listing. In strict mode, a listing
+// past its age is refreshed first, waiting up to the backend deadline, so that secrets created
+// since are found.
+func (c *Cache) knownMissing(name string) bool {
+	if cached, ok := c.secretMap.Get(name); ok {
+		cached.Secret.Release()
+		return false
+	}
+
+	c.lock.Lock()
+	refresh := false
+	if c.negative.Strict && c.listed != nil && !c.listed[name] {
+		now := c.secretMap.getNow()
+		maxAge := c.negative.TTL
+		if maxAge <= 0 {
+			maxAge = c.timeouts.Fresh
+		}
+		if now.Sub(c.listedAt) > maxAge {
+			c.listedAt = now
+			refresh = true
+		}
+	}
+	c.lock.Unlock()
+	if refresh {
+		select {
+		case <-c.backendSecretList():
+		case <-time.After(c.timeouts.BackendDeadline):
+		}
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	missing := false
+	if expiry, ok := c.misses[name]; ok {
+		if c.secretMap.getNow().Before(expiry) {
+			missing = true
+		} else {
+			delete(c.misses, name)
+		}
+	}
+	if c.negative.Strict && c.listed != nil && !c.listed[name] {
+		missing = true
+	}
+	if missing {
+		c.negativeHits.Inc(1)
+		c.Debugf("Negative cache hit: %v", name)
+	}
+	return missing
+}
+
+// recordMiss caches that the backend reported a secret missing.
+func (c *Cache) recordMiss(name string) {
+	if c.negative.TTL <= 0 {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.misses[name] = c.secretMap.getNow().Add(c.negative.TTL)
+}
+
+// setListed records the names in a listing, forgetting cached misses for them.
+func (c *Cache) setListed(secrets []Secret) {
+	listed := make(map[string]bool, len(secrets))
+	for _, s := range secrets {
+		listed[s.Name] = true
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.listed = listed
+	c.listedAt = c.secretMap.getNow()
+	for name := range c.misses {
+		if listed[name] {
+			delete(c.misses, name)
+		}
+	}
+}
+
 // SecretList returns a listing of Secrets from cache or a server.
 //
 // Cache logic:
@@ -156,6 +531,7 @@ func (c *Cache) SecretList() []Secret {
 // only used by tests
 func (c *Cache) Add(s Secret) {
 	c.secretMap.Put(s.Name, s, time.Time{})
+	c.history.Record(s, c.secretMap.getNow())
 }
 
 // Len returns the number of values stored in the cache. This method is most useful for testing.
@@ -164,13 +540,14 @@ func (c *Cache) Len() int {
 	return c.secretMap.Len()
 }
 
-// cacheSecret retrieves a secret from the cache.
+// cacheSecret retrieves a secret from the cache. A secret with content must be released.
 func (c *Cache) cacheSecret(name string) *SecretTime {
 	secret, ok := c.secretMap.Get(name)
 	if ok && (len(secret.Secret.Content) > 0 || secret.deleted) {
 		c.Debugf("Cache hit: %v", name)
 		return &secret
 	}
+	secret.Secret.Release()
 	c.Debugf("Cache miss: %v", name)
 	return nil
 }
@@ -183,20 +560,32 @@ func (c *Cache) cacheSecretList() []Secret {
 // backendSecret retrieves a secret from the backend and updates the cache.
 //
 // Retrieval is concurrent, so a channel is returned to communicate a successful value.
-// The channel will not be fulfilled on error.
+// The channel will not be fulfilled on error. The receiver must release the secret, or pass the
+// channel to discard if it stops waiting.
 func (c *Cache) backendSecret(name string) chan secretResult {
 	secretc := make(chan secretResult, 1)
 	go func() {
 		defer close(secretc)
 		secret, err := c.backend.Secret(name)
-		secretc <- secretResult{secret, err}
+		// Update the cache first, so the attributes of a secret just opened reflect its content.
 		if err == nil {
 			c.secretMap.Put(name, *secret, time.Time{})
+			c.history.Record(*secret, c.secretMap.getNow())
 		}
+		secretc <- secretResult{secret, err}
 	}()
 	return secretc
 }
 
+// discard releases the secret fetched by backendSecret once it arrives, for a caller which stopped
+// waiting for it.
+func discard(backendDone chan secretResult) {
+	go func() {
+		s := <-backendDone
+		s.secret.Release()
+	}()
+}
+
 // backendSecretList retrieves a secret listing from the backend and updates the cache.
 //
 // Retrieval is concurrent, so a channel is returned to communicate successful values. The channel
@@ -214,9 +603,7 @@ func (c *Cache) backendSecretList() chan []Secret {
 		for _, backendSecret := range secrets {
 			// The cache might contain a secret with content, in which case we want to keep the cache's
 			// value (and not schedule it for delayed deletion).
-			if s, ok := c.secretMap.Get(backendSecret.Name); ok && len(s.Secret.Content) > 0 {
-				newMap.Put(backendSecret.Name, s.Secret, s.Time)
-			} else {
+			if !newMap.Keep(c.secretMap, backendSecret.Name) {
 				// We don't have content for this secret. This happens when the cache has never seen a given secret
 				// (at startup or when a new secret is added).
 				// can happen.
@@ -224,6 +611,7 @@ func (c *Cache) backendSecretList() chan []Secret {
 			}
 		}
 		c.secretMap.Replace(newMap)
+		c.setListed(secrets)
 
 		secretsc <- c.cacheSecretList()
 		close(secretsc)
@@ -16,9 +16,11 @@ package main
 
 import (
 	"errors"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/rcrowley/go-metrics"
 	"github.com/square/keywhiz-fs/log"
 	"github.com/stretchr/testify/assert"
 )
@@ -65,6 +67,43 @@ func (b ChannelBackend) SecretList() ([]Secret, bool) {
 	return secretList, true
 }
 
+// CountingBackend counts calls for the content of secrets.
+type CountingBackend struct {
+	SecretBackend
+	lock  sync.Mutex
+	calls map[string]int
+	lists int
+}
+
+func (b *CountingBackend) Secret(name string) (*Secret, error) {
+	b.lock.Lock()
+	if b.calls == nil {
+		b.calls = make(map[string]int)
+	}
+	b.calls[name]++
+	b.lock.Unlock()
+	return b.SecretBackend.Secret(name)
+}
+
+func (b *CountingBackend) Calls(name string) int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.calls[name]
+}
+
+func (b *CountingBackend) SecretList() ([]Secret, bool) {
+	b.lock.Lock()
+	b.lists++
+	b.lock.Unlock()
+	return b.SecretBackend.SecretList()
+}
+
+func (b *CountingBackend) Lists() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.lists
+}
+
 var timeouts = Timeouts{0, 10 * time.Millisecond, 20 * time.Millisecond, 1 * time.Hour}
 
 func TestCacheSecretUsesValuesFromClient(t *testing.T) {
@@ -96,12 +135,14 @@ func TestCachePassesThroughSecretNotFound(t *testing.T) {
 	cache.Add(*secretFixture)
 	secret, ok = cache.Secret(secretFixture.Name)
 	assert.True(ok)
+	secret.Release()
 	assert.Equal(secretFixture, secret)
 
 	// After a while, the secret should still be there since the backend is failing.
 	fake_clock = fake_clock.Add(2 * time.Hour)
 	secret, ok = cache.Secret(secretFixture.Name)
 	assert.True(ok)
+	secret.Release()
 	assert.Equal(secretFixture, secret)
 }
 
@@ -119,6 +160,7 @@ func TestCachePassesThroughSecretDeleted(t *testing.T) {
 	cache.Add(*secretFixture)
 	secret, ok = cache.Secret(secretFixture.Name)
 	assert.True(ok)
+	secret.Release()
 	assert.Equal(secretFixture, secret)
 
 	// After a while, secret should still be there since the backend is failing.
@@ -144,12 +186,14 @@ func TestCacheSecretWhenClientTimesOut(t *testing.T) {
 	cache.Add(*secretFixture)
 	secret, ok = cache.Secret(secretFixture.Name)
 	assert.True(ok)
+	secret.Release()
 	assert.Equal(secretFixture, secret)
 
 	// After a while, secret should still be there since the backend is timing out
 	fake_clock = fake_clock.Add(2 * time.Hour)
 	_, ok = cache.Secret(secretFixture.Name)
 	assert.True(ok)
+	secret.Release()
 	assert.Equal(secretFixture, secret)
 }
 
@@ -170,6 +214,7 @@ func TestCacheSecretUsesClientOverCache(t *testing.T) {
 	// Although fixture2 is in the cache, the client returns fixture1.
 	secret, ok := cache.Secret(fixture2.Name)
 	assert.True(ok)
+	secret.Release()
 	assert.Equal(fixture1, secret)
 
 	assert.Equal(1, cache.Len())
@@ -194,9 +239,11 @@ func TestCacheSecretAvoidsBackendWhenResultFresh(t *testing.T) {
 
 	secret, ok := cache.Secret(fixture2.Name)
 	assert.True(ok)
+	secret.Release()
 	assert.Equal(fixture2, secret)
 	secret, ok = cache.Secret(fixture2.Name)
 	assert.True(ok)
+	secret.Release()
 	assert.Equal(fixture2, secret)
 
 	// 1 Nanosecond fresh threshold is sure to make a server request
@@ -207,6 +254,7 @@ func TestCacheSecretAvoidsBackendWhenResultFresh(t *testing.T) {
 
 	secret, ok = cache.Secret(fixture2.Name)
 	assert.True(ok)
+	secret.Release()
 	assert.Equal(fixture1, secret) // fixture1 comes form the backend
 }
 
@@ -227,11 +275,13 @@ func TestCacheSecretUsesBackendWhenResultStale(t *testing.T) {
 	cache := NewCache(backend, timeouts, logConfig, nil)
 	secret, ok := cache.Secret(fixture1.Name)
 	assert.True(ok)
+	secret.Release()
 	assert.Equal(fixture1, secret)
 
 	time.Sleep(2 * time.Nanosecond)
 	secret, ok = cache.Secret(fixture1.Name)
 	assert.True(ok)
+	secret.Release()
 	assert.Equal(fixture2, secret)
 }
 
@@ -245,13 +295,13 @@ func TestCacheSecretListUsesValuesFromCacheIfClientFails(t *testing.T) {
 	cache.Add(*secretFixture)
 	list := cache.SecretList()
 	assert.Len(list, 1)
-	assert.Contains(list, *secretFixture)
+	assert.Contains(list, secretFixture.metadata())
 
 	// After a while, secret should still be there since the backend failed
 	fake_clock = fake_clock.Add(2 * time.Hour)
 	list = cache.SecretList()
 	assert.Len(list, 1)
-	assert.Contains(list, *secretFixture)
+	assert.Contains(list, secretFixture.metadata())
 }
 
 func TestCacheSecretListsDeleted(t *testing.T) {
@@ -264,7 +314,7 @@ func TestCacheSecretListsDeleted(t *testing.T) {
 	cache.Add(*secretFixture)
 	list := cache.SecretList()
 	assert.Len(list, 1)
-	assert.Contains(list, *secretFixture)
+	assert.Contains(list, secretFixture.metadata())
 
 	// After a while, secret should be deleted
 	fake_clock = fake_clock.Add(2 * time.Hour)
@@ -288,13 +338,13 @@ func TestCacheSecretListWhenClientTimesOut(t *testing.T) {
 	cache.Add(*secretFixture)
 	list = cache.SecretList()
 	assert.Len(list, 1)
-	assert.Contains(list, *secretFixture)
+	assert.Contains(list, secretFixture.metadata())
 
 	// After a while, secret should still be there since the backend failed
 	fake_clock = fake_clock.Add(2 * time.Hour)
 	list = cache.SecretList()
 	assert.Len(list, 1)
-	assert.Contains(list, *secretFixture)
+	assert.Contains(list, secretFixture.metadata())
 }
 
 func TestCacheSecretListUsesValuesFromClient(t *testing.T) {
@@ -309,7 +359,7 @@ func TestCacheSecretListUsesValuesFromClient(t *testing.T) {
 	cache := NewCache(backend, timeouts, logConfig, nil)
 	list := cache.SecretList()
 	assert.Len(list, 1)
-	assert.Contains(list, *secretFixture)
+	assert.Contains(list, secretFixture.metadata())
 
 	assert.Equal(1, cache.Len())
 }
@@ -332,8 +382,8 @@ func TestCacheSecretListUsesClientOverCache(t *testing.T) {
 	// fixture2 gets marked for deletion.
 	list := cache.SecretList()
 	assert.Len(list, 2)
-	assert.Contains(list, *fixture1)
-	assert.Contains(list, *fixture2)
+	assert.Contains(list, fixture1.metadata())
+	assert.Contains(list, fixture2.metadata())
 	assert.Equal(2, cache.Len())
 
 	// Advance clock, cache should now have only 1 element
@@ -372,7 +422,7 @@ func TestCacheSecretListDoesNotOverrideWithEmptyContent(t *testing.T) {
 
 	list := cache.SecretList()
 	assert.Len(list, 1)
-	assert.Contains(list, *secretFixture)
+	assert.Contains(list, secretFixture.metadata())
 	assert.Equal(1, cache.Len())
 }
 
@@ -414,6 +464,7 @@ func TestClientSecretListDoesNotFreshenCache(t *testing.T) {
 	cache.Add(*fixture2)
 	secret, ok := cache.Secret(fixture2.Name)
 	assert.True(ok)
+	secret.Release()
 	assert.Equal(fixture2, secret)
 
 	// now we go forward in time 25 milliseconds, and get a secretlist
@@ -426,9 +477,302 @@ func TestClientSecretListDoesNotFreshenCache(t *testing.T) {
 	time.Sleep(30 * time.Millisecond)
 	secret, ok = cache.Secret(fixture2.Name)
 	assert.True(ok)
+	secret.Release()
 	assert.Equal(fixture1, secret)
 }
 
+func TestCacheSecretAttrUsesListing(t *testing.T) {
+	assert := assert.New(t)
+
+	backend := &CountingBackend{SecretBackend: NewMapBackend(Secret{Name: "foo", Content: content("hunter2"), Length: 8})}
+	timeouts := Timeouts{0, time.Second, 2 * time.Second, time.Hour}
+	cache := NewCache(backend, timeouts, logConfig, nil)
+
+	// Unknown secrets are fetched, and described by their content.
+	secret, ok := cache.SecretAttr("foo")
+	assert.True(ok)
+	assert.Empty(secret.Content)
+	assert.EqualValues(7, secret.Length)
+	assert.Equal(1, backend.Calls("foo"))
+
+	// Listed secrets are served from the listing, with their listed length.
+	cache.Clear()
+	cache.Warmup()
+	secret, ok = cache.SecretAttr("foo")
+	assert.True(ok)
+	assert.Empty(secret.Content)
+	assert.EqualValues(8, secret.Length)
+	assert.Equal(1, backend.Calls("foo"))
+
+	// Once content is cached, it is used again.
+	cache.Add(Secret{Name: "foo", Content: content("hunter2"), Length: 8})
+	secret, ok = cache.SecretAttr("foo")
+	assert.True(ok)
+	assert.EqualValues(7, secret.Length)
+	assert.Equal(2, backend.Calls("foo"))
+
+	_, ok = cache.SecretAttr("bar")
+	assert.False(ok)
+}
+
+func TestCacheFreshnessFollowsClock(t *testing.T) {
+	assert := assert.New(t)
+
+	backend := &CountingBackend{SecretBackend: NewMapBackend(Secret{Name: "foo", Content: content("hunter2"), Length: 7})}
+	timeouts := Timeouts{time.Minute, time.Second, 2 * time.Second, time.Hour}
+	fake_clock := time.Now().Add(time.Hour)
+	cache := NewCache(backend, timeouts, logConfig, func() time.Time { return fake_clock })
+
+	secret, ok := cache.Secret("foo")
+	assert.True(ok)
+	secret.Release()
+	secret, ok = cache.Secret("foo")
+	assert.True(ok)
+	secret.Release()
+	assert.Equal(1, backend.Calls("foo"), "fresh entries should be served from the cache")
+
+	// The entry is no longer fresh on the cache's clock, whatever the real time.
+	fake_clock = fake_clock.Add(2 * time.Minute)
+	secret, ok = cache.Secret("foo")
+	assert.True(ok)
+	secret.Release()
+	assert.Equal(2, backend.Calls("foo"))
+}
+
+func TestCacheLimitsRefetchEvictedContent(t *testing.T) {
+	assert := assert.New(t)
+
+	backend := &CountingBackend{SecretBackend: NewMapBackend(
+		Secret{Name: "foo", Content: content("hunter2"), Length: 7},
+		Secret{Name: "bar", Content: content("hunter3"), Length: 7})}
+	timeouts := Timeouts{time.Hour, time.Second, 2 * time.Second, time.Hour}
+	cache := NewCache(backend, timeouts, logConfig, nil)
+	cache.SetLimits(CacheLimits{MaxBytes: 10})
+
+	cache.Secret("foo")
+	cache.Secret("bar")
+	assert.Equal(CacheStats{ResidentBytes: 7, ResidentEntries: 1, Evictions: 1}, cache.Stats())
+
+	// Attributes of the evicted secret come from its metadata, and reading it fetches it again.
+	secret, ok := cache.SecretAttr("foo")
+	assert.True(ok)
+	assert.EqualValues(7, secret.Length)
+	assert.Equal(1, backend.Calls("foo"))
+	secret, ok = cache.Secret("foo")
+	assert.True(ok)
+	assert.EqualValues("hunter2", secret.Content)
+	assert.Equal(2, backend.Calls("foo"))
+}
+
+func TestCacheRefusesContentPastMaxStale(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := time.Now()
+	timeouts := Timeouts{0, 10 * time.Millisecond, 20 * time.Millisecond, time.Hour}
+	cache := NewCache(FailingBackend{}, timeouts, logConfig, func() time.Time { return clock })
+	cache.SetStalePolicy(StalePolicy{MaxStale: time.Hour})
+	cache.Add(Secret{Name: "foo", Content: content("hunter2")})
+
+	// Within the max-stale age, cached content is served when the backend fails.
+	clock = clock.Add(30 * time.Minute)
+	secret, ok := cache.Secret("foo")
+	assert.True(ok)
+	assert.EqualValues("hunter2", secret.Content)
+	assert.False(cache.Stale("foo"))
+
+	// Past it, it is refused.
+	clock = clock.Add(time.Hour)
+	_, ok = cache.Secret("foo")
+	assert.False(ok)
+	assert.True(cache.Stale("foo"))
+	staleness := cache.Staleness()
+	if assert.Len(staleness, 1) {
+		assert.Equal("foo", staleness[0].Name)
+		assert.Equal(90*time.Minute.Seconds(), staleness[0].AgeSeconds)
+		assert.True(staleness[0].Stale)
+	}
+
+	// Until the backend confirms it.
+	cache.backend = NewMapBackend(Secret{Name: "foo", Content: content("hunter2")})
+	secret, ok = cache.Secret("foo")
+	assert.True(ok)
+	assert.EqualValues("hunter2", secret.Content)
+	assert.False(cache.Stale("foo"))
+}
+
+func TestCacheStaleWhileRevalidate(t *testing.T) {
+	assert := assert.New(t)
+
+	secretc := make(chan *Secret)
+	backend := &CountingBackend{SecretBackend: ChannelBackend{secretc: secretc}}
+	timeouts := Timeouts{0, time.Second, 2 * time.Second, time.Hour}
+	cache := NewCache(backend, timeouts, logConfig, nil)
+	cache.SetStalePolicy(StalePolicy{Revalidate: time.Hour})
+	cache.Add(Secret{Name: "foo", Content: content("hunter2")})
+
+	// Cached content is returned without waiting for the blocked backend, which is asked once.
+	for i := 0; i < 2; i++ {
+		secret, ok := cache.Secret("foo")
+		assert.True(ok)
+		assert.EqualValues("hunter2", secret.Content)
+	}
+	secretc <- &Secret{Name: "foo", Content: content("hunter3")}
+
+	for i := 0; i < 100; i++ {
+		if cached := cache.cacheSecret("foo"); string(cached.Secret.Content) == "hunter3" {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.EqualValues("hunter3", cache.cacheSecret("foo").Secret.Content)
+	assert.Equal(1, backend.Calls("foo"))
+}
+
+func TestCacheNegativeCache(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := time.Now()
+	mapBackend := NewMapBackend(Secret{Name: "foo", Content: content("hunter2")})
+	backend := &CountingBackend{SecretBackend: mapBackend}
+	timeouts := Timeouts{0, time.Second, 2 * time.Second, time.Hour}
+	cache := NewCache(backend, timeouts, logConfig, func() time.Time { return clock })
+	cache.SetNegativeCache(NegativeCachePolicy{TTL: time.Minute})
+
+	// Misses are remembered for the TTL.
+	for i := 0; i < 3; i++ {
+		_, ok := cache.Secret("bar")
+		assert.False(ok)
+	}
+	assert.Equal(1, backend.Calls("bar"))
+	assert.EqualValues(2, cache.Stats().NegativeHits)
+	clock = clock.Add(2 * time.Minute)
+	cache.Secret("bar")
+	assert.Equal(2, backend.Calls("bar"))
+
+	// A listing introducing the name forgets the miss.
+	mapBackend.Put(Secret{Name: "bar", Content: content("hunter3")})
+	_, ok := cache.Secret("bar")
+	assert.False(ok)
+	cache.SecretList()
+	secret, ok := cache.Secret("bar")
+	assert.True(ok)
+	assert.EqualValues("hunter3", secret.Content)
+}
+
+func TestCacheNegativeCacheStrict(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := time.Now()
+	mapBackend := NewMapBackend(Secret{Name: "foo", Content: content("hunter2")})
+	backend := &CountingBackend{SecretBackend: mapBackend}
+	timeouts := Timeouts{0, time.Second, 2 * time.Second, time.Hour}
+	cache := NewCache(backend, timeouts, logConfig, func() time.Time { return clock })
+	cache.SetNegativeCache(NegativeCachePolicy{TTL: time.Minute, Strict: true})
+
+	// Until a listing succeeds, the backend is asked.
+	cache.Secret("bar")
+	assert.Equal(1, backend.Calls("bar"))
+	cache.Clear()
+
+	cache.Warmup()
+	_, ok := cache.Secret("bar")
+	assert.False(ok)
+	assert.Equal(1, backend.Calls("bar"), "names absent from the listing should not reach the backend")
+	_, ok = cache.Secret("foo")
+	assert.True(ok)
+
+	// Once the listing is older than the TTL, such lookups refresh it first.
+	mapBackend.Put(Secret{Name: "bar", Content: content("hunter3")})
+	_, ok = cache.Secret("bar")
+	assert.False(ok)
+	clock = clock.Add(2 * time.Minute)
+	secret, ok := cache.Secret("bar")
+	assert.True(ok)
+	assert.EqualValues("hunter3", secret.Content)
+	assert.EqualValues(2, cache.Stats().NegativeHits)
+}
+
+func TestCacheNegativeCacheStrictWithoutTTL(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := time.Now()
+	mapBackend := NewMapBackend(Secret{Name: "foo", Content: content("hunter2")})
+	backend := &CountingBackend{SecretBackend: mapBackend}
+	timeouts := Timeouts{time.Minute, time.Second, 2 * time.Second, time.Hour}
+	cache := NewCache(backend, timeouts, logConfig, func() time.Time { return clock })
+	cache.SetNegativeCache(NegativeCachePolicy{Strict: true})
+	registry := metrics.NewRegistry()
+	cache.SetMetrics(registry)
+	cache.Warmup()
+
+	// A secret created after the first listing is found once the listing is older than Fresh.
+	mapBackend.Put(Secret{Name: "bar", Content: content("hunter3")})
+	_, ok := cache.Secret("bar")
+	assert.False(ok)
+	assert.Equal(1, backend.Lists())
+	clock = clock.Add(2 * time.Minute)
+	secret, ok := cache.Secret("bar")
+	assert.True(ok)
+	assert.EqualValues("hunter3", secret.Content)
+	assert.Equal(2, backend.Lists())
+
+	// Each negative hit is counted.
+	for i := 0; i < 2; i++ {
+		_, ok = cache.Secret("baz")
+		assert.False(ok)
+	}
+	assert.EqualValues(3, metrics.GetOrRegisterCounter("runtime.cache.negative_hits", registry).Count())
+	assert.EqualValues(3, cache.Stats().NegativeHits)
+}
+
+func TestCacheForgetRefreshDump(t *testing.T) {
+	assert := assert.New(t)
+
+	mapBackend := NewMapBackend(
+		Secret{Name: "foo", Content: content("hunter2")},
+		Secret{Name: "bar", Content: content("hunter3")})
+	timeouts := Timeouts{time.Hour, time.Second, 2 * time.Second, time.Hour}
+	cache := NewCache(mapBackend, timeouts, logConfig, nil)
+	cache.SetNegativeCache(NegativeCachePolicy{TTL: time.Minute})
+	cache.Warmup()
+	_, ok := cache.Secret("foo")
+	assert.True(ok)
+	_, ok = cache.Secret("missing")
+	assert.False(ok)
+
+	dump := cache.Dump()
+	if assert.Len(dump.Entries, 2) {
+		assert.Equal("bar", dump.Entries[0].Name)
+		assert.False(dump.Entries[0].Resident)
+		assert.Equal("foo", dump.Entries[1].Name)
+		assert.True(dump.Entries[1].Resident)
+		assert.EqualValues(7, dump.Entries[1].Length)
+	}
+	assert.Equal([]string{"missing"}, dump.Missing)
+	assert.EqualValues(7, dump.Stats.ResidentBytes)
+
+	// Refreshing fetches new content, even while fresh.
+	mapBackend.Put(Secret{Name: "foo", Content: content("hunter4")})
+	assert.NoError(cache.Refresh("foo"))
+	secret, ok := cache.Secret("foo")
+	assert.True(ok)
+	assert.EqualValues("hunter4", secret.Content)
+	mapBackend.Put(Secret{Name: "missing", Content: content("found")})
+	assert.NoError(cache.Refresh("missing"))
+	assert.Empty(cache.Dump().Missing)
+
+	mapBackend.Remove("bar")
+	assert.Equal(SecretDeleted{}, cache.Refresh("bar"))
+	assert.NotNil(cache.Dump().Entries[0].DeleteAt)
+
+	// Forgetting drops a secret, and only that one.
+	cache.Forget("foo")
+	_, ok = cache.secretMap.Get("foo")
+	assert.False(ok)
+	_, ok = cache.secretMap.Get("missing")
+	assert.True(ok)
+}
+
 // An interesting test to write might be a combination of data being returned and deleted.
 // E.g.
 // Get content A.
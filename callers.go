@@ -0,0 +1,101 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// Caller is the identity of the process making a FUSE call, as checked against file permissions.
+type Caller struct {
+	Uid    uint32
+	Groups []uint32 // The primary group and supplementary groups.
+}
+
+// callerOf returns the caller of a FUSE call. Supplementary groups are read from /proc, and left out
+// if they can't be, as when the process already exited.
+func callerOf(context *fuse.Context) Caller {
+	caller := Caller{Uid: context.Uid, Groups: []uint32{context.Gid}}
+	if context.Pid == 0 {
+		return caller
+	}
+	groups, err := processGroups(context.Pid)
+	if err != nil {
+		return caller
+	}
+	caller.Groups = append(caller.Groups, groups...)
+	return caller
+}
+
+// processGroups reads the supplementary groups of process pid from /proc/<pid>/status.
+func processGroups(pid uint32) ([]uint32, error) {
+	file, err := os.Open(filepath.Join(procDir, strconv.FormatUint(uint64(pid), 10), "status"))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "Groups:") {
+			continue
+		}
+		var groups []uint32
+		for _, field := range strings.Fields(line[len("Groups:"):]) {
+			gid, err := strconv.ParseUint(field, 10 /* base */, 32 /* bits */)
+			if err != nil {
+				return nil, err
+			}
+			groups = append(groups, uint32(gid))
+		}
+		return groups, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, errors.New("no groups in process status")
+}
+
+// CanRead returns whether the caller may read a file with attr, as the kernel would decide from
+// its mode and ownership. Root may read any file.
+func (c Caller) CanRead(attr *fuse.Attr) bool {
+	if c.Uid == 0 {
+		return true
+	}
+	switch {
+	case c.Uid == attr.Uid:
+		return attr.Mode&0400 != 0
+	case c.inGroup(attr.Gid):
+		return attr.Mode&0040 != 0
+	}
+	return attr.Mode&0004 != 0
+}
+
+func (c Caller) inGroup(gid uint32) bool {
+	for _, g := range c.Groups {
+		if g == gid {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,271 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeProcStatus sets up procDir with the status of process pid, returning a function restoring it.
+func fakeProcStatus(pid, status string) func() {
+	dir, err := ioutil.TempDir("", "keywhiz-fs-test")
+	panicOnError(err)
+	panicOnError(os.MkdirAll(filepath.Join(dir, pid), 0755))
+	panicOnError(ioutil.WriteFile(filepath.Join(dir, pid, "status"), []byte(status), 0644))
+	procDir = dir
+	return func() {
+		procDir = "/proc"
+		os.RemoveAll(dir)
+	}
+}
+
+func TestProcessGroups(t *testing.T) {
+	assert := assert.New(t)
+	defer fakeProcStatus("3", "Name:\tcat\nUid:\t1002\t1002\t1002\t1002\nGroups:\t2001 2002 \nNgid:\t0\n")()
+
+	groups, err := processGroups(3)
+	assert.NoError(err)
+	assert.Equal([]uint32{2001, 2002}, groups)
+
+	_, err = processGroups(4)
+	assert.Error(err)
+
+	caller := callerOf(&fuse.Context{Owner: fuse.Owner{Uid: 1002, Gid: 1002}, Pid: 3})
+	assert.Equal(Caller{Uid: 1002, Groups: []uint32{1002, 2001, 2002}}, caller)
+	caller = callerOf(&fuse.Context{Owner: fuse.Owner{Uid: 1002, Gid: 1002}, Pid: 4})
+	assert.Equal(Caller{Uid: 1002, Groups: []uint32{1002}}, caller)
+}
+
+func TestCallerCanRead(t *testing.T) {
+	assert := assert.New(t)
+
+	attr := func(mode uint32) *fuse.Attr {
+		return &fuse.Attr{Mode: fuse.S_IFREG | mode, Owner: fuse.Owner{Uid: 1001, Gid: 2001}}
+	}
+	owner := Caller{Uid: 1001, Groups: []uint32{1001}}
+	member := Caller{Uid: 1002, Groups: []uint32{1002, 2001}}
+	other := Caller{Uid: 1003, Groups: []uint32{1003}}
+	root := Caller{Uid: 0, Groups: []uint32{0}}
+
+	assert.True(owner.CanRead(attr(0400)))
+	assert.False(owner.CanRead(attr(0040)), "owner class applies even if groups may read")
+	assert.True(member.CanRead(attr(0440)))
+	assert.False(member.CanRead(attr(0404)), "group class applies even if others may read")
+	assert.False(other.CanRead(attr(0440)))
+	assert.True(other.CanRead(attr(0444)))
+	assert.True(root.CanRead(attr(0000)))
+}
+
+func TestFsFilterByCaller(t *testing.T) {
+	assert := assert.New(t)
+	defer fakeProcStatus("3", "Name:\tcat\nGroups:\t2001\n")()
+
+	// Secrets are either certificate bundles or structured, to check the files derived from them.
+	bundle := fixture("bundle.pem")
+	backend := NewMapBackend(
+		Secret{Name: "private", Content: content(bundle), Owner: "1001", Group: "2001", Mode: "0400"},
+		Secret{Name: "group", Content: content(`{"k": "b"}`), Owner: "1001", Group: "2001", Mode: "0440"},
+		Secret{Name: "world", Content: content(bundle), Owner: "1001", Group: "2001", Mode: "0444"},
+		Secret{Name: "default", Content: content(`{"k": "d"}`), Mode: "0440"})
+	kwfs, _, err := NewKeywhizFs(nil, backend, Ownership{Uid: 1000, Gid: 1000}, timeouts, nil, logConfig)
+	assert.NoError(err)
+	kwfs.Owners = OwnershipRules{NumericIDs: true}
+	kwfs.FilterByCaller = true
+	kwfs.Cache.Warmup()
+
+	all := []string{"default", "group", "private", "world"}
+	for _, name := range all {
+		secret, ok := kwfs.Cache.Secret(name)
+		assert.True(ok)
+		secret.Release()
+	}
+	derived := map[string][]string{
+		".versions": all,
+		".fields":   {"default", "group"},
+		".x509":     {"private", "world"},
+	}
+	cases := []struct {
+		context *fuse.Context
+		visible []string
+	}{
+		{&fuse.Context{Owner: fuse.Owner{Uid: 1001, Gid: 1001}}, []string{"group", "private", "world"}},
+		{&fuse.Context{Owner: fuse.Owner{Uid: 1002, Gid: 2001}}, []string{"group", "world"}},
+		{&fuse.Context{Owner: fuse.Owner{Uid: 1002, Gid: 1002}, Pid: 3}, []string{"group", "world"}},
+		{&fuse.Context{Owner: fuse.Owner{Uid: 1002, Gid: 1002}}, []string{"world"}},
+		{&fuse.Context{Owner: fuse.Owner{Uid: 1000, Gid: 1000}}, []string{"default", "world"}},
+		{&fuse.Context{Owner: fuse.Owner{Uid: 0, Gid: 0}}, all},
+	}
+	for _, c := range cases {
+		entries, status := kwfs.OpenDir("", c.context)
+		assert.Equal(fuse.OK, status)
+		var listed []string
+		for _, e := range entries {
+			if e.Name[0] != '.' {
+				listed = append(listed, e.Name)
+			}
+		}
+		sort.Strings(listed)
+		assert.Equal(c.visible, listed, "listing for %+v", c.context)
+
+		entries, status = kwfs.OpenDir(".json/secret", c.context)
+		assert.Equal(fuse.OK, status)
+		assert.Len(entries, len(c.visible), "listing of .json/secret for %+v", c.context)
+
+		var found []string
+		for _, name := range all {
+			if _, status := kwfs.GetAttr(name, c.context); status == fuse.OK {
+				found = append(found, name)
+			} else {
+				assert.Equal(fuse.ENOENT, status, "%s for %+v", name, c.context)
+			}
+		}
+		assert.Equal(c.visible, found, "lookups for %+v", c.context)
+
+		// Files derived from secrets are hidden along with them.
+		visible := make(map[string]bool)
+		for _, name := range c.visible {
+			visible[name] = true
+		}
+		for dir, names := range derived {
+			// Empty directories can't be opened.
+			entries, _ := kwfs.OpenDir(dir, c.context)
+			listed = nil
+			for _, e := range entries {
+				listed = append(listed, e.Name)
+			}
+			sort.Strings(listed)
+			var expected []string
+			for _, name := range names {
+				if visible[name] {
+					expected = append(expected, name)
+				}
+			}
+			assert.Equal(expected, listed, "listing of %s for %+v", dir, c.context)
+
+			for _, name := range names {
+				_, status := kwfs.GetAttr(dir+"/"+name, c.context)
+				_, dirStatus := kwfs.OpenDir(dir+"/"+name, c.context)
+				if visible[name] {
+					assert.Equal(fuse.OK, status, "%s/%s for %+v", dir, name, c.context)
+					assert.Equal(fuse.OK, dirStatus, "%s/%s for %+v", dir, name, c.context)
+				} else {
+					assert.Equal(fuse.ENOENT, status, "%s/%s for %+v", dir, name, c.context)
+					assert.Equal(fuse.ENOENT, dirStatus, "%s/%s for %+v", dir, name, c.context)
+				}
+			}
+		}
+		for _, name := range []string{".fields/group/k", ".fields/default/k", ".x509/private/key.pem", ".x509/world/cert.pem"} {
+			_, status := kwfs.GetAttr(name, c.context)
+			file, openStatus := kwfs.Open(name, 0, c.context)
+			if visible[strings.Split(name, "/")[1]] {
+				assert.Equal(fuse.OK, status, "%s for %+v", name, c.context)
+				assert.Equal(fuse.OK, openStatus, "%s for %+v", name, c.context)
+				file.Release()
+			} else {
+				assert.Equal(fuse.ENOENT, status, "%s for %+v", name, c.context)
+				assert.Equal(fuse.ENOENT, openStatus, "%s for %+v", name, c.context)
+			}
+		}
+	}
+
+	// Without filtering, every caller sees every secret.
+	kwfs.FilterByCaller = false
+	entries, _ := kwfs.OpenDir("", &fuse.Context{Owner: fuse.Owner{Uid: 1002, Gid: 1002}})
+	assert.Len(entries, len(all)+9)
+	_, status := kwfs.GetAttr("private", &fuse.Context{Owner: fuse.Owner{Uid: 1002, Gid: 1002}})
+	assert.Equal(fuse.OK, status)
+}
+
+func TestFsFilterByCallerAliasesAndRenderedFiles(t *testing.T) {
+	assert := assert.New(t)
+
+	backend := NewMapBackend(
+		Secret{Name: "app_private", Content: content("p"), Owner: "1001", Group: "2001", Mode: "0400"},
+		Secret{Name: "app_world", Content: content("w"), Owner: "1001", Group: "2001", Mode: "0444"})
+	kwfs, _, err := NewKeywhizFs(nil, backend, Ownership{Uid: 1000, Gid: 1000}, timeouts, nil, logConfig)
+	assert.NoError(err)
+	kwfs.Owners = OwnershipRules{NumericIDs: true}
+	kwfs.FilterByCaller = true
+	kwfs.Aliases, err = NewAliases(map[string]string{"links/private": "app_private", "links/world": "app_world"})
+	assert.NoError(err)
+	kwfs.Templates, err = NewTemplates([]TemplateConfig{
+		{Name: "private.conf", Template: `{{ secret "app_private" }}`},
+		{Name: "world.conf", Template: `{{ secret "app_world" }}`},
+	})
+	assert.NoError(err)
+	kwfs.EnvGroups, err = NewEnvGroups([]EnvGroupConfig{
+		{Name: "explicit", Secrets: []string{"app_private", "app_world"}},
+		{Name: "prefixed", Prefix: "app_"},
+	})
+	assert.NoError(err)
+	kwfs.Cache.Warmup()
+
+	read := func(name string, context *fuse.Context) (string, fuse.Status) {
+		file, status := kwfs.Open(name, 0, context)
+		if status != fuse.OK {
+			return "", status
+		}
+		defer file.Release()
+		buf := make([]byte, 100)
+		res, _ := file.Read(buf, 0)
+		data, _ := res.Bytes(buf)
+		return string(data), fuse.OK
+	}
+
+	// Aliases to a hidden secret are hidden, and templates and env files reading one fail as if it
+	// were missing.
+	other := &fuse.Context{Owner: fuse.Owner{Uid: 1002, Gid: 1002}}
+	_, status := kwfs.Readlink("links/private", other)
+	assert.Equal(fuse.ENOENT, status)
+	_, status = kwfs.GetAttr("links/private", other)
+	assert.Equal(fuse.ENOENT, status)
+	target, status := kwfs.Readlink("links/world", other)
+	assert.Equal(fuse.OK, status)
+	assert.Equal("../app_world", target)
+	entries, status := kwfs.OpenDir("links", other)
+	assert.Equal(fuse.OK, status)
+	assert.Equal([]fuse.DirEntry{{Name: "world", Mode: fuse.S_IFLNK}}, entries)
+
+	_, status = read("private.conf", other)
+	assert.Equal(fuse.EIO, status)
+	data, status := read("world.conf", other)
+	assert.Equal(fuse.OK, status)
+	assert.Equal("w", data)
+	_, status = read(".env/explicit", other)
+	assert.Equal(fuse.EIO, status)
+	data, status = read(".env/prefixed", other)
+	assert.Equal(fuse.OK, status)
+	assert.Equal("WORLD='w'\n", data)
+
+	// The owner of the secrets sees everything.
+	owner := &fuse.Context{Owner: fuse.Owner{Uid: 1001, Gid: 1001}}
+	target, status = kwfs.Readlink("links/private", owner)
+	assert.Equal(fuse.OK, status)
+	assert.Equal("../app_private", target)
+	data, status = read("private.conf", owner)
+	assert.Equal(fuse.OK, status)
+	assert.Equal("p", data)
+	data, status = read(".env/prefixed", owner)
+	assert.Equal(fuse.OK, status)
+	assert.Equal("PRIVATE='p'\nWORLD='w'\n", data)
+}
@@ -0,0 +1,272 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"sort"
+	"time"
+
+	"golang.org/x/crypto/pkcs12"
+)
+
+// Files exposed for each certificate bundle.
+const (
+	bundleCertFile      = "cert.pem"
+	bundleChainFile     = "chain.pem"
+	bundleFullchainFile = "fullchain.pem"
+	bundleKeyFile       = "key.pem"
+	bundleInfoFile      = "info.json"
+)
+
+// CertBundle is the TLS material found in a secret: a leaf certificate, the rest of its chain and
+// optionally a private key.
+type CertBundle struct {
+	Leaf  *x509.Certificate
+	Chain []*x509.Certificate
+	// Key is the PEM-encoded private key, if the bundle has one. It is zeroed on Release.
+	Key []byte
+}
+
+// CertInfo describes the leaf certificate of a bundle in `info.json`.
+type CertInfo struct {
+	Subject           string    `json:"subject"`
+	Issuer            string    `json:"issuer"`
+	SerialNumber      string    `json:"serial_number"`
+	DNSNames          []string  `json:"dns_names,omitempty"`
+	IPAddresses       []string  `json:"ip_addresses,omitempty"`
+	EmailAddresses    []string  `json:"email_addresses,omitempty"`
+	URIs              []string  `json:"uris,omitempty"`
+	NotBefore         time.Time `json:"not_before"`
+	NotAfter          time.Time `json:"not_after"`
+	SHA256Fingerprint string    `json:"sha256_fingerprint"`
+	Chain             []string  `json:"chain"`
+	HasKey            bool      `json:"has_key"`
+}
+
+// parseCertBundle parses PEM or PKCS#12 content. PKCS#12 archives must not be password protected
+// and use the legacy algorithms supported by golang.org/x/crypto/pkcs12. Bundles must be released
+// once read.
+func parseCertBundle(content []byte) (*CertBundle, bool) {
+	blocks := pemBlocks(content)
+	if len(blocks) == 0 {
+		var err error
+		if blocks, err = pkcs12.ToPEM(content, ""); err != nil {
+			return nil, false
+		}
+	}
+	// Decoded keys are copies of the content. Certificates are public, and parsed certificates
+	// share the memory of their blocks.
+	defer func() {
+		for _, block := range blocks {
+			if block.Type != "CERTIFICATE" {
+				zero(block.Bytes)
+			}
+		}
+	}()
+
+	var certs []*x509.Certificate
+	var key []byte
+	var signer crypto.Signer
+	for _, block := range blocks {
+		switch block.Type {
+		case "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, false
+			}
+			certs = append(certs, cert)
+		case "PRIVATE KEY", "RSA PRIVATE KEY", "EC PRIVATE KEY", "ENCRYPTED PRIVATE KEY":
+			if key != nil {
+				zero(key)
+				return nil, false
+			}
+			signer = parseKey(block)
+			if signer != nil {
+				// Normalize to PKCS#8; keys from PKCS#12 archives are not in the format their
+				// block type claims.
+				if der, err := x509.MarshalPKCS8PrivateKey(signer); err == nil {
+					defer zero(der)
+					block = &pem.Block{Type: "PRIVATE KEY", Bytes: der}
+				}
+			}
+			key = pem.EncodeToMemory(&pem.Block{Type: block.Type, Bytes: block.Bytes})
+		}
+	}
+	if len(certs) == 0 {
+		zero(key)
+		return nil, false
+	}
+
+	// The leaf matches the private key if there is one, and is the first certificate otherwise.
+	leaf := 0
+	if signer != nil {
+		for i, cert := range certs {
+			if sameKey(cert.PublicKey, signer.Public()) {
+				leaf = i
+				break
+			}
+		}
+	}
+	bundle := &CertBundle{Leaf: certs[leaf], Key: key}
+	bundle.Chain = orderChain(bundle.Leaf, append(append([]*x509.Certificate{}, certs[:leaf]...), certs[leaf+1:]...))
+	return bundle, true
+}
+
+// pemBlocks decodes every PEM block in data.
+func pemBlocks(data []byte) []*pem.Block {
+	var blocks []*pem.Block
+	for {
+		block, rest := pem.Decode(data)
+		if block == nil {
+			return blocks
+		}
+		blocks = append(blocks, block)
+		data = rest
+	}
+}
+
+// parseKey parses an unencrypted private key, whatever its encoding. It returns nil for keys it
+// can't parse, such as encrypted keys.
+func parseKey(block *pem.Block) crypto.Signer {
+	if key, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		if signer, ok := key.(crypto.Signer); ok {
+			return signer
+		}
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key
+	}
+	return nil
+}
+
+func sameKey(a, b crypto.PublicKey) bool {
+	if k, ok := a.(interface{ Equal(crypto.PublicKey) bool }); ok {
+		return k.Equal(b)
+	}
+	return false
+}
+
+// orderChain orders certificates by following issuers from the leaf. Certificates which aren't
+// part of that path keep their original order, at the end.
+func orderChain(leaf *x509.Certificate, certs []*x509.Certificate) []*x509.Certificate {
+	chain := make([]*x509.Certificate, 0, len(certs))
+	used := make([]bool, len(certs))
+	current := leaf
+	for {
+		next := -1
+		for i, cert := range certs {
+			if !used[i] && bytes.Equal(cert.RawSubject, current.RawIssuer) {
+				next = i
+				break
+			}
+		}
+		if next < 0 || bytes.Equal(current.RawSubject, current.RawIssuer) {
+			break
+		}
+		used[next] = true
+		chain = append(chain, certs[next])
+		current = certs[next]
+	}
+	for i, cert := range certs {
+		if !used[i] {
+			chain = append(chain, cert)
+		}
+	}
+	return chain
+}
+
+func encodeCerts(certs ...*x509.Certificate) []byte {
+	b := bytes.NewBuffer([]byte{})
+	for _, cert := range certs {
+		pem.Encode(b, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	}
+	return b.Bytes()
+}
+
+// Info describes the leaf certificate.
+func (b *CertBundle) Info() CertInfo {
+	leaf := b.Leaf
+	fingerprint := sha256.Sum256(leaf.Raw)
+	info := CertInfo{
+		Subject:           leaf.Subject.String(),
+		Issuer:            leaf.Issuer.String(),
+		SerialNumber:      leaf.SerialNumber.String(),
+		DNSNames:          leaf.DNSNames,
+		EmailAddresses:    leaf.EmailAddresses,
+		NotBefore:         leaf.NotBefore.UTC(),
+		NotAfter:          leaf.NotAfter.UTC(),
+		SHA256Fingerprint: hex.EncodeToString(fingerprint[:]),
+		Chain:             make([]string, 0, len(b.Chain)),
+		HasKey:            b.Key != nil,
+	}
+	for _, ip := range leaf.IPAddresses {
+		info.IPAddresses = append(info.IPAddresses, ip.String())
+	}
+	for _, uri := range leaf.URIs {
+		info.URIs = append(info.URIs, uri.String())
+	}
+	for _, cert := range b.Chain {
+		info.Chain = append(info.Chain, cert.Subject.String())
+	}
+	return info
+}
+
+// Files returns the content of each file exposed for the bundle. key.pem is only present if the
+// bundle has a private key. The nil bundle has no files.
+func (b *CertBundle) Files() map[string][]byte {
+	if b == nil {
+		return nil
+	}
+	info, err := json.MarshalIndent(b.Info(), "", "  ")
+	panicOnError(err)
+	files := map[string][]byte{
+		bundleCertFile:      encodeCerts(b.Leaf),
+		bundleChainFile:     encodeCerts(b.Chain...),
+		bundleFullchainFile: encodeCerts(append([]*x509.Certificate{b.Leaf}, b.Chain...)...),
+		bundleInfoFile:      append(info, '\n'),
+	}
+	if b.Key != nil {
+		files[bundleKeyFile] = b.Key
+	}
+	return files
+}
+
+// Release zeroes the private key of the bundle, which is shared with its files. The nil bundle is
+// empty.
+func (b *CertBundle) Release() {
+	if b != nil {
+		zero(b.Key)
+	}
+}
+
+// certFileNames returns the sorted names of files.
+func certFileNames(files map[string][]byte) []string {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,161 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/stretchr/testify/assert"
+)
+
+// subjects returns the common names of the certificates in PEM data.
+func subjects(data []byte) []string {
+	var names []string
+	for _, block := range pemBlocks(data) {
+		cert, err := x509.ParseCertificate(block.Bytes)
+		panicOnError(err)
+		names = append(names, cert.Subject.CommonName)
+	}
+	return names
+}
+
+func TestParseCertBundlePEM(t *testing.T) {
+	assert := assert.New(t)
+
+	// The fixture holds, in order: intermediate, leaf key, root, leaf.
+	bundle, ok := parseCertBundle(fixture("bundle.pem"))
+	if !assert.True(ok) {
+		return
+	}
+	files := bundle.Files()
+	assert.Equal([]string{"app.example.com"}, subjects(files["cert.pem"]))
+	assert.Equal([]string{"Test Intermediate CA", "Test Root CA"}, subjects(files["chain.pem"]))
+	assert.Equal([]string{"app.example.com", "Test Intermediate CA", "Test Root CA"}, subjects(files["fullchain.pem"]))
+
+	block, _ := pem.Decode(files["key.pem"])
+	if assert.NotNil(block) {
+		assert.Equal("PRIVATE KEY", block.Type)
+		_, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		assert.NoError(err)
+	}
+
+	var info CertInfo
+	assert.NoError(json.Unmarshal(files["info.json"], &info))
+	assert.Equal("CN=app.example.com", info.Subject)
+	assert.Equal("CN=Test Intermediate CA", info.Issuer)
+	assert.Equal([]string{"app.example.com", "www.example.com"}, info.DNSNames)
+	assert.Equal([]string{"127.0.0.1"}, info.IPAddresses)
+	assert.True(info.NotAfter.After(time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC)))
+	assert.True(info.HasKey)
+	assert.Len(info.SHA256Fingerprint, 64)
+}
+
+func TestParseCertBundlePKCS12(t *testing.T) {
+	assert := assert.New(t)
+
+	bundle, ok := parseCertBundle(fixture("bundle.p12"))
+	if !assert.True(ok) {
+		return
+	}
+	files := bundle.Files()
+	assert.Equal([]string{"app.example.com"}, subjects(files["cert.pem"]))
+	assert.Equal([]string{"Test Intermediate CA"}, subjects(files["chain.pem"]))
+	block, _ := pem.Decode(files["key.pem"])
+	if assert.NotNil(block) {
+		_, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		assert.NoError(err, "keys from PKCS#12 should be converted to PKCS#8")
+	}
+}
+
+func TestParseCertBundleRejectsOtherContent(t *testing.T) {
+	assert := assert.New(t)
+
+	leafOnly := fixture("bundle.pem")
+	for _, content := range [][]byte{
+		[]byte(""),
+		[]byte("hunter2"),
+		[]byte("-----BEGIN CERTIFICATE-----\nbm90IGEgY2VydA==\n-----END CERTIFICATE-----\n"),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: []byte("key only")}),
+	} {
+		_, ok := parseCertBundle(content)
+		assert.False(ok, "%q should not be a bundle", content)
+	}
+
+	// A certificate without a key is a bundle without key.pem.
+	block, _ := pem.Decode(leafOnly)
+	bundle, ok := parseCertBundle(pem.EncodeToMemory(block))
+	assert.True(ok)
+	assert.NotContains(bundle.Files(), "key.pem")
+	assert.Empty(bundle.Files()["chain.pem"])
+}
+
+func TestFsCertBundles(t *testing.T) {
+	assert := assert.New(t)
+	context := &fuse.Context{}
+
+	pemBundle := fixture("bundle.pem")
+	backend := NewMapBackend(
+		Secret{Name: "app.pem", Content: content(pemBundle), Length: uint64(len(pemBundle)), Mode: "0400"},
+		Secret{Name: "plain", Content: content("hunter2"), Length: 7})
+	timeouts := Timeouts{0, 100 * time.Millisecond, 200 * time.Millisecond, time.Hour}
+	kwfs, _, err := NewKeywhizFs(nil, backend, Ownership{Uid: 1000, Gid: 1000}, timeouts, nil, logConfig)
+	assert.NoError(err)
+
+	cases := []struct {
+		name string
+		mode uint32
+	}{
+		{".x509/app.pem", fuse.S_IFDIR | 0500},
+		{".x509/app.pem/cert.pem", fuse.S_IFREG | 0444},
+		{".x509/app.pem/chain.pem", fuse.S_IFREG | 0444},
+		{".x509/app.pem/fullchain.pem", fuse.S_IFREG | 0444},
+		{".x509/app.pem/info.json", fuse.S_IFREG | 0444},
+		{".x509/app.pem/key.pem", fuse.S_IFREG | 0400},
+	}
+	for _, c := range cases {
+		attr, status := kwfs.GetAttr(c.name, context)
+		if assert.Equal(fuse.OK, status, c.name) {
+			assert.EqualValues(c.mode, attr.Mode, c.name)
+			assert.EqualValues(1000, attr.Uid, c.name)
+		}
+	}
+
+	entries, status := kwfs.OpenDir(".x509/app.pem", context)
+	assert.Equal(fuse.OK, status)
+	assert.Len(entries, 5)
+
+	entries, status = kwfs.OpenDir(".x509", context)
+	assert.Equal(fuse.OK, status)
+	assert.Equal([]fuse.DirEntry{{Name: "app.pem", Mode: fuse.S_IFDIR}}, entries)
+
+	file, status := kwfs.Open(".x509/app.pem/cert.pem", 0, context)
+	assert.Equal(fuse.OK, status)
+	buf := make([]byte, 4096)
+	res, _ := file.Read(buf, 0)
+	data, _ := res.Bytes(buf)
+	assert.Equal([]string{"app.example.com"}, subjects(data))
+
+	for _, name := range []string{".x509/plain", ".x509/plain/cert.pem", ".x509/app.pem/other.pem", ".x509/app.pem/cert.pem/x", ".x509/missing"} {
+		_, status = kwfs.GetAttr(name, context)
+		assert.Equal(fuse.ENOENT, status, name)
+	}
+	_, status = kwfs.Open(".x509/app.pem", 0, context)
+	assert.Equal(fuseEISDIR, status)
+}
@@ -55,6 +55,8 @@ type Client struct {
 	params      httpClientParams
 	failCount   metrics.Counter
 	lastSuccess metrics.Gauge
+	reload      func() error
+	done        chan struct{}
 }
 
 // httpClientParams are values necessary for constructing a TLS client.
@@ -101,19 +103,68 @@ func NewClient(certFile, keyFile, caFile string, serverURL *url.URL, timeout tim
 
 	atomic.StorePointer(&httpClient, unsafe.Pointer(initial))
 
-	// Asynchronously updates client and updates atomic reference
+	// Rebuilds the client, e.g. once its certificate is renewed
+	reload := func() error {
+		client, err := params.buildClient()
+		if err != nil {
+			return err
+		}
+		atomic.StorePointer(&httpClient, unsafe.Pointer(client))
+		return nil
+	}
+
+	// Asynchronously updates client and updates atomic reference, until closed
+	done := make(chan struct{})
 	go func() {
-		for t := range time.Tick(clientRefresh) {
-			if client, err := params.buildClient(); err == nil {
-				logger.Infof("Updating http client at %v", t)
-				atomic.StorePointer(&httpClient, unsafe.Pointer(client))
-			} else {
-				logger.Errorf("Error refreshing http client: %v", err)
+		ticker := time.NewTicker(clientRefresh)
+		defer ticker.Stop()
+		for {
+			select {
+			case t := <-ticker.C:
+				if err := reload(); err == nil {
+					logger.Infof("Updating http client at %v", t)
+				} else {
+					logger.Errorf("Error refreshing http client: %v", err)
+				}
+			case <-done:
+				return
 			}
 		}
 	}()
 
-	return Client{logger, getClient, serverURL, params, failCount, lastSuccess}
+	return Client{logger, getClient, serverURL, params, failCount, lastSuccess, reload, done}
+}
+
+// Reload rebuilds the client from its certificate, key and CA files right away, rather than at
+// the next periodic refresh.
+func (c Client) Reload() error {
+	if err := c.reload(); err != nil {
+		c.Errorf("Error reloading http client: %v", err)
+		return err
+	}
+	c.Infof("Reloaded http client")
+	return nil
+}
+
+// ClientHealth describes how recent requests to the server went.
+type ClientHealth struct {
+	ServerURL   string    `json:"server_url"`
+	LastSuccess time.Time `json:"last_success"`
+	Failures    int64     `json:"failures"` // Failed requests since the last success.
+}
+
+// Health returns how recent requests to the server went.
+func (c Client) Health() ClientHealth {
+	health := ClientHealth{ServerURL: c.url.String(), Failures: c.failCount.Count()}
+	if last := c.lastSuccess.Value(); last > 0 {
+		health.LastSuccess = time.Unix(last, 0)
+	}
+	return health
+}
+
+// Close stops refreshing the client in the background. The client must not be used afterwards.
+func (c Client) Close() {
+	close(c.done)
 }
 
 // ServerStatus returns raw JSON from the server's _status endpoint
@@ -139,11 +190,12 @@ func (c Client) ServerStatus() (data []byte, err error) {
 
 // RawSecret returns raw JSON from requesting a secret.
 func (c Client) RawSecret(name string) (data []byte, err error) {
+	if err := ValidateSecretName(name); err != nil {
+		c.Errorf("Refusing to retrieve secret: %v", err)
+		return nil, err
+	}
 	now := time.Now()
-	// note: path.Join does not know how to properly escape for URLs!
-	t := *c.url
-	t.Path = path.Join(c.url.Path, "secret", name)
-	resp, err := c.http().Get(t.String())
+	resp, err := c.http().Get(secretURL(*c.url, name).String())
 	if err != nil {
 		c.Errorf("Error retrieving secret %v: %v", name, err)
 		c.failCountInc()
@@ -174,7 +226,8 @@ func (c Client) RawSecret(name string) (data []byte, err error) {
 	}
 }
 
-// Secret returns an unmarshalled Secret struct after requesting a secret.
+// Secret returns an unmarshalled Secret struct after requesting a secret. Its content is held in
+// a secureBuffer and must be released; the response and the decoded copy on the heap are zeroed.
 func (c Client) Secret(name string) (secret *Secret, err error) {
 	data, err := c.RawSecret(name)
 	if err != nil {
@@ -182,11 +235,17 @@ func (c Client) Secret(name string) (secret *Secret, err error) {
 	}
 
 	secret, err = ParseSecret(data)
+	zero(data)
 	if err != nil {
 		c.Errorf("Error decoding retrieved secret %v: %v", name, err)
 		return nil, err
 	}
 
+	if buf := newSecureBuffer(secret.Content); buf != nil {
+		zero(secret.Content)
+		secret.Content = buf.Bytes()
+		secret.buf = buf
+	}
 	return secret, nil
 }
 
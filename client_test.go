@@ -63,6 +63,9 @@ func TestClientCallsServer(t *testing.T) {
 	secret, err := client.Secret("foo")
 	assert.Nil(err)
 	assert.Equal("Nobody_PgPass", secret.Name)
+	assert.NotNil(secret.buf, "content should be held in a secure buffer")
+	assert.Equal([]byte(secret.Content), secret.buf.Bytes())
+	secret.Release()
 
 	data, err = client.RawSecret("foo")
 	assert.Nil(err)
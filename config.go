@@ -0,0 +1,63 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+)
+
+// Config contains the settings read from the file passed with --config.
+type Config struct {
+	// Aliases maps paths in the mount to secret names.
+	Aliases Aliases `json:"aliases"`
+	// Templates are files rendered from secrets.
+	Templates Templates `json:"templates"`
+	// EnvGroups are environment files rendered from groups of secrets.
+	EnvGroups EnvGroups `json:"env_groups"`
+	// ModeRules override the modes of secrets matching patterns.
+	ModeRules ModeRules `json:"mode_rules"`
+	// Ownership maps the owners and groups of secrets to local ones.
+	Ownership OwnershipRules `json:"ownership"`
+}
+
+// LoadConfig reads and validates a JSON configuration file.
+func LoadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseConfig(data)
+}
+
+// ParseConfig deserializes and validates raw JSON into a Config struct.
+func ParseConfig(data []byte) (*Config, error) {
+	var config Config
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("Fail to deserialize JSON Config: %v", err)
+	}
+	aliases, err := NewAliases(config.Aliases)
+	if err != nil {
+		return nil, err
+	}
+	config.Aliases = aliases
+	for name := range config.Templates {
+		if _, ok := aliases[name]; ok {
+			return nil, fmt.Errorf("%q is defined both as an alias and a template", name)
+		}
+	}
+	return &config, nil
+}
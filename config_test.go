@@ -0,0 +1,81 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	config, err := LoadConfig("fixtures/config.json")
+	assert.NoError(err)
+	assert.Equal(Aliases{
+		"db_password":     "Nobody_PgPass",
+		"app/config/hmac": "hmac.key",
+		"app/missing":     "Missing_Secret",
+	}, config.Aliases)
+	if assert.Contains(config.Templates, "pgpass") {
+		assert.Equal("0400", config.Templates["pgpass"].Mode)
+	}
+	if assert.Contains(config.EnvGroups, "app") {
+		assert.Equal(envFormatDotenv, config.EnvGroups["app"].Format)
+	}
+
+	_, err = LoadConfig("fixtures/non-existent.json")
+	assert.Error(err)
+}
+
+func TestParseConfigRejectsInvalidConfig(t *testing.T) {
+	cases := []string{
+		`not json`,
+		`{"aliases": {"/etc/passwd": "foo"}}`,
+		`{"aliases": {"../outside": "foo"}}`,
+		`{"aliases": {".json/foo": "foo"}}`,
+		`{"aliases": {"app/.hidden": "foo"}}`,
+		`{"aliases": {"foo": ""}}`,
+		`{"aliases": {"foo": "a/b"}}`,
+		`{"aliases": {"app": "foo", "app/bar": "bar"}}`,
+		`{"aliases": {"app/bar": "foo", "app//bar": "bar"}}`,
+		`{"templates": [{"name": "", "template": "x"}]}`,
+		`{"templates": [{"name": ".hidden", "template": "x"}]}`,
+		`{"templates": [{"name": "a/b", "template": "x"}]}`,
+		`{"templates": [{"name": "a", "template": "x"}, {"name": "a", "template": "y"}]}`,
+		`{"templates": [{"name": "a", "template": "{{ secret \"x\""}]}`,
+		`{"templates": [{"name": "a", "template": "{{ unknown }}"}]}`,
+		`{"templates": [{"name": "a", "template": "x", "mode": "0999"}]}`,
+		`{"aliases": {"a": "foo"}, "templates": [{"name": "a", "template": "x"}]}`,
+		`{"env_groups": [{"name": "", "prefix": "a"}]}`,
+		`{"env_groups": [{"name": "a/b", "prefix": "a"}]}`,
+		`{"env_groups": [{"name": "a"}]}`,
+		`{"env_groups": [{"name": "a", "prefix": "a"}, {"name": "a", "prefix": "b"}]}`,
+		`{"env_groups": [{"name": "a", "prefix": "a", "format": "ini"}]}`,
+		`{"mode_rules": [{"pattern": "", "mode": "0400"}]}`,
+		`{"mode_rules": [{"pattern": "[", "mode": "0400"}]}`,
+		`{"mode_rules": [{"pattern": "*.key", "mode": "4400"}]}`,
+		`{"mode_rules": [{"pattern": "*.key", "mode": "rw"}]}`,
+		`{"ownership": {"rules": [{"pattern": "[", "owner": "root"}]}}`,
+		`{"ownership": {"rules": [{"pattern": "*.key"}]}}`,
+		`{"ownership": {"users": {"admin": ""}}}`,
+		`{"ownership": {"fallback_uid": -1}}`,
+	}
+	for _, c := range cases {
+		_, err := ParseConfig([]byte(c))
+		assert.Error(t, err, c)
+	}
+}
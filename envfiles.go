@@ -0,0 +1,242 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/bits"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Formats of environment files.
+const (
+	envFormatDotenv  = "dotenv"
+	envFormatSystemd = "systemd"
+)
+
+// EnvGroupConfig defines an environment file rendering a group of secrets, served as
+// `.env/<name>`.
+type EnvGroupConfig struct {
+	Name string `json:"name"`
+	// Secrets lists member secrets by name. Members must exist for the file to be served.
+	Secrets []string `json:"secrets"`
+	// Prefix adds every secret whose name starts with it. The prefix is not part of the variable
+	// names of these secrets.
+	Prefix string `json:"prefix"`
+	// Format is either "dotenv" (the default) or "systemd".
+	Format string `json:"format"`
+}
+
+// EnvGroups maps file names to environment file definitions. In JSON, groups are given as a list
+// of EnvGroupConfig.
+type EnvGroups map[string]*EnvGroupConfig
+
+// NewEnvGroups validates environment file definitions.
+func NewEnvGroups(configs []EnvGroupConfig) (EnvGroups, error) {
+	groups := make(EnvGroups, len(configs))
+	for _, c := range configs {
+		c := c
+		if c.Name == "" || strings.Contains(c.Name, "/") || strings.HasPrefix(c.Name, ".") {
+			return nil, fmt.Errorf("env group name %q should be a file name not beginning with '.'", c.Name)
+		}
+		if _, ok := groups[c.Name]; ok {
+			return nil, fmt.Errorf("env group %q is defined more than once", c.Name)
+		}
+		if len(c.Secrets) == 0 && c.Prefix == "" {
+			return nil, fmt.Errorf("env group %q should have secrets or a prefix", c.Name)
+		}
+		switch c.Format {
+		case "":
+			c.Format = envFormatDotenv
+		case envFormatDotenv, envFormatSystemd:
+		default:
+			return nil, fmt.Errorf("env group %q has unknown format %q", c.Name, c.Format)
+		}
+		groups[c.Name] = &c
+	}
+	return groups, nil
+}
+
+// UnmarshalJSON parses a list of environment file definitions.
+func (g *EnvGroups) UnmarshalJSON(data []byte) error {
+	var configs []EnvGroupConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return err
+	}
+	groups, err := NewEnvGroups(configs)
+	if err != nil {
+		return err
+	}
+	*g = groups
+	return nil
+}
+
+// Members maps variable names to the names of the group's secrets, given the listed secrets.
+// Listed secrets are only used to find secrets matching the prefix.
+func (c *EnvGroupConfig) Members(listed []Secret) (map[string]string, error) {
+	members := make(map[string]string)
+	add := func(variable, name string) error {
+		if other, ok := members[variable]; ok && other != name {
+			return fmt.Errorf("secrets %q and %q both map to variable %s", other, name, variable)
+		}
+		members[variable] = name
+		return nil
+	}
+	for _, name := range c.Secrets {
+		if err := add(envVariable(name), name); err != nil {
+			return nil, err
+		}
+	}
+	if c.Prefix != "" {
+		for _, s := range listed {
+			if strings.HasPrefix(s.Name, c.Prefix) && len(s.Name) > len(c.Prefix) {
+				if err := add(envVariable(s.Name[len(c.Prefix):]), s.Name); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	if len(members) == 0 {
+		return nil, fmt.Errorf("env group %q has no secrets", c.Name)
+	}
+	return members, nil
+}
+
+// Render produces the environment file from the group's members. Rendering fails if any member
+// is missing, so that partial files are never served. The returned Secret describes the file, and
+// holds its content in a secureBuffer which must be released. Its mode is the intersection of the
+// members' modes, and its ownership that of the member with the most restrictive mode.
+func (c *EnvGroupConfig) Render(listed []Secret, lookup secretLookup) (*Secret, error) {
+	members, err := c.Members(listed)
+	if err != nil {
+		return nil, err
+	}
+	variables := make([]string, 0, len(members))
+	for variable := range members {
+		variables = append(variables, variable)
+	}
+	sort.Strings(variables)
+
+	file := &Secret{Name: c.Name}
+	mode := uint32(0777)
+	var strictest *Secret
+	var out secureBuilder
+	defer out.Reset()
+	for _, variable := range variables {
+		secret, ok := lookup(members[variable])
+		if !ok {
+			secret.Release()
+			return nil, fmt.Errorf("secret %q is not available", members[variable])
+		}
+		perm := secret.ModeValue() & 0777
+		mode &= perm
+		if strictest == nil || bits.OnesCount32(perm) < bits.OnesCount32(strictest.ModeValue()&0777) {
+			metadata := secret.metadata()
+			strictest = &metadata
+		}
+		if secret.CreatedAt.After(file.CreatedAt) {
+			file.CreatedAt = secret.CreatedAt
+		}
+		writeEnvLine(&out, variable, secret.Content, c.Format)
+		secret.Release()
+	}
+
+	file.buf = out.Buffer()
+	file.Content = file.buf.Bytes()
+	file.Length = uint64(len(file.Content))
+	file.Mode = fmt.Sprintf("%04o", mode)
+	file.Owner = strictest.Owner
+	file.Group = strictest.Group
+	if file.CreatedAt.IsZero() {
+		file.CreatedAt = time.Unix(0, 0)
+	}
+	return file, nil
+}
+
+// envVariable transforms a secret name into a variable name: upper case, with characters other
+// than letters, digits and underscores replaced by underscores. Names beginning with a digit are
+// prefixed with an underscore.
+func envVariable(name string) string {
+	variable := []byte(strings.ToUpper(name))
+	for i, c := range variable {
+		if !(c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_') {
+			variable[i] = '_'
+		}
+	}
+	if len(variable) == 0 || variable[0] >= '0' && variable[0] <= '9' {
+		return "_" + string(variable)
+	}
+	return string(variable)
+}
+
+// writeEnvLine writes a variable assignment. Values which aren't text, and multi-line values in
+// the systemd format, are base64-encoded under the variable name suffixed with _BASE64. Values are
+// written straight into out, so no other copy of them is made.
+func writeEnvLine(out *secureBuilder, variable string, value []byte, format string) {
+	binary := !utf8.Valid(value)
+	for _, c := range value {
+		if c < 0x20 && c != '\n' && c != '\t' || c == 0x7f {
+			binary = true
+		}
+	}
+	out.WriteString(variable)
+	if binary || format == envFormatSystemd && bytes.ContainsAny(value, "\n") {
+		out.WriteString("_BASE64=")
+		base64.StdEncoding.Encode(out.grow(base64.StdEncoding.EncodedLen(len(value))), value)
+		out.WriteByte('\n')
+		return
+	}
+
+	switch {
+	case format == envFormatSystemd:
+		// systemd only interprets backslash escapes of quotes and backslashes in double quotes.
+		out.WriteString(`="`)
+		writeEscaped(out, value, false)
+		out.WriteString("\"\n")
+	case !bytes.ContainsAny(value, "'\n"):
+		// Single-quoted values are taken literally by dotenv parsers.
+		out.WriteString("='")
+		out.Write(value)
+		out.WriteString("'\n")
+	default:
+		out.WriteString(`="`)
+		writeEscaped(out, value, true)
+		out.WriteString("\"\n")
+	}
+}
+
+// writeEscaped writes a value to be double-quoted, escaping backslashes and double quotes, and
+// newlines and tabs if controls is set.
+func writeEscaped(out *secureBuilder, value []byte, controls bool) {
+	for _, c := range value {
+		switch {
+		case c == '\\' || c == '"':
+			out.WriteByte('\\')
+			out.WriteByte(c)
+		case c == '\n' && controls:
+			out.WriteString(`\n`)
+		case c == '\t' && controls:
+			out.WriteString(`\t`)
+		default:
+			out.WriteByte(c)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnvVariable(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("DB_PASSWORD", envVariable("db-password"))
+	assert.Equal("HMAC_KEY", envVariable("hmac.key"))
+	assert.Equal("_1PASSWORD", envVariable("1password"))
+	assert.Equal("CAF__", envVariable("café"))
+}
+
+// envLine formats a single variable assignment.
+func envLine(variable string, value []byte, format string) string {
+	var out secureBuilder
+	writeEnvLine(&out, variable, value, format)
+	return string(out.Bytes())
+}
+
+func TestEnvLine(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("A='hunter2'\n", envLine("A", []byte("hunter2"), envFormatDotenv))
+	assert.Equal("A=\"it's\"\n", envLine("A", []byte("it's"), envFormatDotenv))
+	assert.Equal("A=\"a\\nb \\\"c\\\" \\\\\"\n", envLine("A", []byte("a\nb \"c\" \\"), envFormatDotenv))
+	assert.Equal("A=\"$HOME \\\"x\\\"\"\n", envLine("A", []byte("$HOME \"x\""), envFormatSystemd))
+	assert.Equal("A_BASE64=YQpi\n", envLine("A", []byte("a\nb"), envFormatSystemd))
+	assert.Equal("A_BASE64=AP8=\n", envLine("A", []byte{0, 0xff}, envFormatDotenv))
+
+	// Values render back to themselves through the dotenv parser used for .fields.
+	for _, value := range []string{"hunter2", "it's", "a\nb \"c\" \\", "tab\there"} {
+		fields, ok := parseFields([]byte(envLine("A", []byte(value), envFormatDotenv)))
+		if assert.True(ok, value) {
+			node, _ := fields.Lookup("A")
+			assert.Equal(value, string(node.value))
+		}
+	}
+}
+
+func TestEnvGroupRender(t *testing.T) {
+	assert := assert.New(t)
+
+	older := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	newer := older.Add(time.Hour)
+	backend := NewMapBackend(
+		Secret{Name: "app_db-password", Content: content("hunter2"), Mode: "0440", Owner: "app", Group: "app", CreatedAt: older},
+		Secret{Name: "app_api.key", Content: content("s3cr3t"), Mode: "0400", Owner: "root", Group: "wheel", CreatedAt: newer},
+		Secret{Name: "hmac.key", Content: content("k"), Mode: "0444"},
+		Secret{Name: "app-db-password", Content: content("other")})
+	listed, _ := backend.SecretList()
+	lookup := func(name string) (*Secret, bool) {
+		secret, err := backend.Secret(name)
+		return secret, err == nil
+	}
+
+	groups, err := NewEnvGroups([]EnvGroupConfig{
+		{Name: "app", Secrets: []string{"hmac.key"}, Prefix: "app_"},
+		{Name: "missing", Secrets: []string{"hmac.key", "missing"}},
+		{Name: "collision", Secrets: []string{"app_db-password", "app-db-password"}},
+		{Name: "empty", Prefix: "none_"},
+	})
+	assert.NoError(err)
+
+	secret, err := groups["app"].Render(listed, lookup)
+	assert.NoError(err)
+	assert.Equal("API_KEY='s3cr3t'\nDB_PASSWORD='hunter2'\nHMAC_KEY='k'\n", string(secret.Content))
+	assert.EqualValues(len(secret.Content), secret.Length)
+	assert.Equal("0400", secret.Mode, "mode should be the intersection of the members' modes")
+	assert.Equal("root", secret.Owner, "ownership should be that of the strictest member")
+	assert.Equal("wheel", secret.Group)
+	assert.Equal(newer, secret.CreatedAt)
+	secret.Release()
+
+	for _, name := range []string{"missing", "collision", "empty"} {
+		secret, err = groups[name].Render(listed, lookup)
+		assert.Error(err, name)
+		assert.Nil(secret, name)
+	}
+}
+
+func TestFsEnvFiles(t *testing.T) {
+	assert := assert.New(t)
+	context := &fuse.Context{}
+
+	backend := NewMapBackend(
+		Secret{Name: "Nobody_PgPass", Content: content("asddas"), Length: 6, Mode: "0440"},
+		Secret{Name: "app_token", Content: content("t0k3n"), Length: 5, Mode: "0400"})
+	timeouts := Timeouts{0, 100 * time.Millisecond, 200 * time.Millisecond, time.Hour}
+	kwfs, _, err := NewKeywhizFs(nil, backend, Ownership{Uid: 1000, Gid: 1000}, timeouts, nil, logConfig)
+	assert.NoError(err)
+	config, err := LoadConfig("fixtures/config.json")
+	assert.NoError(err)
+	kwfs.EnvGroups = config.EnvGroups
+
+	expected := "NOBODY_PGPASS='asddas'\nTOKEN='t0k3n'\n"
+	attr, status := kwfs.GetAttr(".env/app", context)
+	assert.Equal(fuse.OK, status)
+	assert.EqualValues(fuse.S_IFREG|0400, attr.Mode)
+	assert.EqualValues(len(expected), attr.Size)
+
+	file, status := kwfs.Open(".env/app", 0, context)
+	assert.Equal(fuse.OK, status)
+	buf := make([]byte, 100)
+	res, _ := file.Read(buf, 0)
+	data, _ := res.Bytes(buf)
+	assert.Equal(expected, string(data))
+
+	entries, status := kwfs.OpenDir(".env", context)
+	assert.Equal(fuse.OK, status)
+	assert.Equal([]fuse.DirEntry{{Name: "app", Mode: fuse.S_IFREG}}, entries)
+
+	// A group with a missing member fails closed.
+	backend.Remove("Nobody_PgPass")
+	kwfs.Cache.Clear()
+	_, status = kwfs.GetAttr(".env/app", context)
+	assert.Equal(fuse.EIO, status)
+	file, status = kwfs.Open(".env/app", 0, context)
+	assert.Nil(file)
+	assert.Equal(fuse.EIO, status)
+}
@@ -0,0 +1,116 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sort"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/rcrowley/go-metrics"
+)
+
+// Extended attributes exposing secret metadata.
+const (
+	xattrExpiry      = "user.keywhiz.expiry"
+	xattrDescription = "user.keywhiz.description"
+)
+
+// ExpiryPolicy controls how opens of secrets close to or past their expiry are handled.
+type ExpiryPolicy struct {
+	// Warning is how long before its expiry opening a secret logs a warning.
+	Warning time.Duration
+	// Refuse denies opening expired secrets.
+	Refuse bool
+}
+
+// SecretExpiry describes the expiry of a secret in `.json/status`.
+type SecretExpiry struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description,omitempty"`
+	Expiry      time.Time `json:"expiry"`
+	Expiring    bool      `json:"expiring"`
+	Expired     bool      `json:"expired"`
+}
+
+// Status describes the expiry of the secrets which have one, soonest first.
+func (p ExpiryPolicy) Status(secrets []Secret, now time.Time) []SecretExpiry {
+	var status []SecretExpiry
+	for _, s := range secrets {
+		expiry, ok := s.ExpiresAt()
+		if !ok {
+			continue
+		}
+		status = append(status, SecretExpiry{
+			Name:        s.Name,
+			Description: s.Description,
+			Expiry:      expiry,
+			Expiring:    now.Before(expiry) && expiry.Sub(now) <= p.Warning,
+			Expired:     !now.Before(expiry),
+		})
+	}
+	sort.SliceStable(status, func(i, j int) bool { return status[i].Expiry.Before(status[j].Expiry) })
+	return status
+}
+
+// checkExpiry logs opens of secrets close to or past their expiry. It returns false if the open
+// should be refused.
+func (kwfs KeywhizFs) checkExpiry(secret *Secret, context *fuse.Context) bool {
+	expiry, ok := secret.ExpiresAt()
+	if !ok {
+		return true
+	}
+	now := time.Now()
+	switch {
+	case !now.Before(expiry) && kwfs.Expiry.Refuse:
+		kwfs.Warnf("Refusing access to %s by uid %d, expired at %s", secret.Name, context.Uid, expiry.Format(time.RFC3339))
+		return false
+	case !now.Before(expiry):
+		kwfs.Warnf("Access to %s by uid %d, expired at %s", secret.Name, context.Uid, expiry.Format(time.RFC3339))
+	case expiry.Sub(now) <= kwfs.Expiry.Warning:
+		kwfs.Warnf("Access to %s by uid %d, expires at %s", secret.Name, context.Uid, expiry.Format(time.RFC3339))
+	}
+	return true
+}
+
+// reportExpiry updates the gauges counting cached secrets which are expiring or expired.
+func (kwfs KeywhizFs) reportExpiry() {
+	if kwfs.Metrics == nil {
+		return
+	}
+	var expiring, expired int64
+	for _, s := range kwfs.Expiry.Status(kwfs.Cache.cacheSecretList(), time.Now()) {
+		if s.Expiring {
+			expiring++
+		}
+		if s.Expired {
+			expired++
+		}
+	}
+	metrics.GetOrRegisterGauge("runtime.secrets.expiring", kwfs.Metrics.Registry).Update(expiring)
+	metrics.GetOrRegisterGauge("runtime.secrets.expired", kwfs.Metrics.Registry).Update(expired)
+}
+
+// secretXAttrs returns the extended attributes of a secret.
+func secretXAttrs(secret *Secret) map[string][]byte {
+	attrs := make(map[string][]byte)
+	if expiry, ok := secret.ExpiresAt(); ok {
+		attrs[xattrExpiry] = []byte(expiry.Format(time.RFC3339))
+	}
+	if secret.Description != "" {
+		attrs[xattrDescription] = []byte(secret.Description)
+	}
+	return attrs
+}
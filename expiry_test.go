@@ -0,0 +1,108 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/rcrowley/go-metrics"
+	"github.com/square/go-sq-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpiryPolicyStatus(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	policy := ExpiryPolicy{Warning: 24 * time.Hour}
+	status := policy.Status([]Secret{
+		{Name: "later", Expiry: now.Add(48 * time.Hour).Unix()},
+		{Name: "never"},
+		{Name: "soon", Expiry: now.Add(time.Hour).Unix(), Description: "rotating"},
+		{Name: "expired", Expiry: now.Add(-time.Hour).Unix()},
+	}, now)
+
+	assert.Equal([]SecretExpiry{
+		{Name: "expired", Expiry: now.Add(-time.Hour), Expired: true},
+		{Name: "soon", Description: "rotating", Expiry: now.Add(time.Hour), Expiring: true},
+		{Name: "later", Expiry: now.Add(48 * time.Hour)},
+	}, status)
+}
+
+func TestFsExpiry(t *testing.T) {
+	assert := assert.New(t)
+	context := &fuse.Context{Owner: fuse.Owner{Uid: 1000, Gid: 1000}}
+
+	now := time.Now()
+	backend := NewMapBackend(
+		Secret{Name: "expired", Content: content("old"), Length: 3, Expiry: now.Add(-time.Hour).Unix()},
+		Secret{Name: "soon", Content: content("new"), Length: 3, Expiry: now.Add(time.Hour).Unix(), Description: "API token"},
+		Secret{Name: "plain", Content: content("x"), Length: 1})
+	timeouts := Timeouts{0, 100 * time.Millisecond, 200 * time.Millisecond, time.Hour}
+	registry := metrics.NewRegistry()
+	kwfs, _, err := NewKeywhizFs(nil, backend, Ownership{Uid: 1000, Gid: 1000}, timeouts, &sqmetrics.SquareMetrics{Registry: registry}, logConfig)
+	assert.NoError(err)
+	kwfs.Expiry = ExpiryPolicy{Warning: 24 * time.Hour}
+	kwfs.Cache.Warmup()
+
+	for _, name := range []string{"expired", "soon", "plain"} {
+		_, status := kwfs.Open(name, 0, context)
+		assert.Equal(fuse.OK, status, name)
+	}
+
+	kwfs.Expiry.Refuse = true
+	_, status := kwfs.Open("expired", 0, context)
+	assert.Equal(fuse.EACCES, status)
+	_, status = kwfs.Open("soon", 0, context)
+	assert.Equal(fuse.OK, status)
+	_, status = kwfs.GetAttr("expired", context)
+	assert.Equal(fuse.OK, status, "expired secrets should still be listed")
+
+	attributes, status := kwfs.ListXAttr("soon", context)
+	assert.Equal(fuse.OK, status)
+	assert.Equal([]string{xattrDescription, xattrExpiry}, attributes)
+	data, status := kwfs.GetXAttr("soon", xattrExpiry, context)
+	assert.Equal(fuse.OK, status)
+	assert.Equal(time.Unix(now.Add(time.Hour).Unix(), 0).UTC().Format(time.RFC3339), string(data))
+	data, status = kwfs.GetXAttr("soon", xattrDescription, context)
+	assert.Equal(fuse.OK, status)
+	assert.Equal("API token", string(data))
+
+	attributes, status = kwfs.ListXAttr("plain", context)
+	assert.Equal(fuse.OK, status)
+	assert.Empty(attributes)
+	_, status = kwfs.GetXAttr("plain", xattrExpiry, context)
+	assert.Equal(fuse.ENOATTR, status)
+	_, status = kwfs.GetXAttr(".version", xattrExpiry, context)
+	assert.Equal(fuse.ENOATTR, status)
+	_, status = kwfs.ListXAttr("missing", context)
+	assert.Equal(fuse.ENOENT, status)
+
+	var info StatusInfo
+	assert.NoError(json.Unmarshal(kwfs.statusJSON(), &info))
+	if assert.Len(info.SecretExpiry, 2) {
+		assert.Equal("expired", info.SecretExpiry[0].Name)
+		assert.True(info.SecretExpiry[0].Expired)
+		assert.Equal("soon", info.SecretExpiry[1].Name)
+		assert.True(info.SecretExpiry[1].Expiring)
+	}
+
+	kwfs.reportExpiry()
+	assert.EqualValues(1, metrics.GetOrRegisterGauge("runtime.secrets.expiring", registry).Value())
+	assert.EqualValues(1, metrics.GetOrRegisterGauge("runtime.secrets.expired", registry).Value())
+}
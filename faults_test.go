@@ -0,0 +1,483 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// errInjected is returned by a FaultBackend when it injects a generic failure.
+var errInjected = errors.New("injected fault")
+
+// LatencyDistribution returns a latency to add to a backend call.
+type LatencyDistribution func(r *rand.Rand) time.Duration
+
+// UniformLatency returns latencies uniformly distributed between min and max.
+func UniformLatency(min, max time.Duration) LatencyDistribution {
+	return func(r *rand.Rand) time.Duration {
+		if max <= min {
+			return min
+		}
+		return min + time.Duration(r.Int63n(int64(max-min)))
+	}
+}
+
+// ExponentialLatency returns exponentially distributed latencies with the given mean, which
+// models a backend that is usually fast but has a long tail.
+func ExponentialLatency(mean time.Duration) LatencyDistribution {
+	return func(r *rand.Rand) time.Duration {
+		return time.Duration(r.ExpFloat64() * float64(mean))
+	}
+}
+
+// Faults configures the failures injected by a FaultBackend. Rates are probabilities between 0
+// and 1, and are evaluated independently for every call.
+type Faults struct {
+	// Latency is added to every call. No latency is added if nil.
+	Latency LatencyDistribution
+	// ErrorRate is the probability of a call failing with a generic error.
+	ErrorRate float64
+	// NotFoundRate is the probability of Secret reporting an existing secret as deleted.
+	NotFoundRate float64
+	// HangRate is the probability of a call blocking for Hang before being answered. Hang should
+	// exceed MaxWait to simulate a stuck server.
+	HangRate float64
+	Hang     time.Duration
+	// PartialListRate is the probability of SecretList dropping a random subset of secrets.
+	PartialListRate float64
+}
+
+// FaultBackend wraps a SecretBackend and injects latency and failures. It is used to test the
+// cache against a misbehaving server.
+type FaultBackend struct {
+	backend  SecretBackend
+	faults   Faults
+	lock     sync.Mutex
+	rand     *rand.Rand
+	sleep    func(time.Duration)
+	inflight sync.WaitGroup
+}
+
+// NewFaultBackend initializes a FaultBackend. The seed makes the injected faults reproducible.
+func NewFaultBackend(backend SecretBackend, faults Faults, seed int64) *FaultBackend {
+	return &FaultBackend{backend: backend, faults: faults, rand: rand.New(rand.NewSource(seed)), sleep: time.Sleep}
+}
+
+// Wait blocks until every call in flight has returned.
+func (b *FaultBackend) Wait() {
+	b.inflight.Wait()
+}
+
+// Secret retrieves a secret from the wrapped backend, possibly injecting a fault.
+func (b *FaultBackend) Secret(name string) (*Secret, error) {
+	b.inflight.Add(1)
+	defer b.inflight.Done()
+	delay, fail, notFound := b.roll()
+	b.sleep(delay)
+	switch {
+	case fail:
+		return nil, errInjected
+	case notFound:
+		return nil, SecretDeleted{}
+	}
+	return b.backend.Secret(name)
+}
+
+// SecretList retrieves a secret listing from the wrapped backend, possibly injecting a fault.
+func (b *FaultBackend) SecretList() ([]Secret, bool) {
+	b.inflight.Add(1)
+	defer b.inflight.Done()
+	delay, fail, _ := b.roll()
+	b.sleep(delay)
+	if fail {
+		return nil, false
+	}
+
+	secrets, ok := b.backend.SecretList()
+	if !ok || !b.chance(b.faults.PartialListRate) {
+		return secrets, ok
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	partial := make([]Secret, 0, len(secrets))
+	for _, s := range secrets {
+		if b.rand.Intn(2) == 0 {
+			partial = append(partial, s)
+		}
+	}
+	return partial, true
+}
+
+// roll decides the faults for a single call.
+func (b *FaultBackend) roll() (delay time.Duration, fail, notFound bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.faults.Latency != nil {
+		delay = b.faults.Latency(b.rand)
+	}
+	if b.rand.Float64() < b.faults.HangRate {
+		delay += b.faults.Hang
+	}
+	fail = b.rand.Float64() < b.faults.ErrorRate
+	notFound = b.rand.Float64() < b.faults.NotFoundRate
+	return
+}
+
+func (b *FaultBackend) chance(rate float64) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.rand.Float64() < rate
+}
+
+// MapBackend serves secrets from an in-memory map.
+type MapBackend struct {
+	lock    sync.Mutex
+	secrets map[string]Secret
+}
+
+func NewMapBackend(secrets ...Secret) *MapBackend {
+	b := &MapBackend{secrets: make(map[string]Secret)}
+	for _, s := range secrets {
+		b.Put(s)
+	}
+	return b
+}
+
+func (b *MapBackend) Put(s Secret) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.secrets[s.Name] = s
+}
+
+func (b *MapBackend) Remove(name string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	delete(b.secrets, name)
+}
+
+func (b *MapBackend) Secret(name string) (*Secret, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	s, ok := b.secrets[name]
+	if !ok {
+		return nil, SecretDeleted{}
+	}
+	return &s, nil
+}
+
+func (b *MapBackend) SecretList() ([]Secret, bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	secrets := make([]Secret, 0, len(b.secrets))
+	for _, s := range b.secrets {
+		s.Content = nil
+		secrets = append(secrets, s)
+	}
+	return secrets, true
+}
+
+func TestFaultBackendInjectsFaults(t *testing.T) {
+	assert := assert.New(t)
+
+	secretFixture, _ := ParseSecret(fixture("secret.json"))
+	name := secretFixture.Name
+
+	backend := NewFaultBackend(NewMapBackend(*secretFixture), Faults{ErrorRate: 1}, 1)
+	_, err := backend.Secret(name)
+	assert.Equal(errInjected, err)
+	_, ok := backend.SecretList()
+	assert.False(ok)
+
+	backend = NewFaultBackend(NewMapBackend(*secretFixture), Faults{NotFoundRate: 1}, 1)
+	_, err = backend.Secret(name)
+	assert.IsType(SecretDeleted{}, err)
+
+	backend = NewFaultBackend(NewMapBackend(*secretFixture), Faults{HangRate: 1, Hang: 30 * time.Millisecond}, 1)
+	start := time.Now()
+	secret, err := backend.Secret(name)
+	assert.NoError(err)
+	assert.Equal(secretFixture, secret)
+	assert.True(time.Since(start) >= 30*time.Millisecond)
+
+	backend = NewFaultBackend(NewMapBackend(*secretFixture), Faults{Latency: UniformLatency(10*time.Millisecond, 20*time.Millisecond)}, 1)
+	start = time.Now()
+	backend.SecretList()
+	assert.True(time.Since(start) >= 10*time.Millisecond)
+}
+
+func TestFaultBackendPartialList(t *testing.T) {
+	assert := assert.New(t)
+
+	var secrets []Secret
+	for i := 0; i < 50; i++ {
+		secrets = append(secrets, Secret{Name: fmt.Sprintf("secret-%d", i)})
+	}
+
+	backend := NewFaultBackend(NewMapBackend(secrets...), Faults{PartialListRate: 1}, 1)
+	list, ok := backend.SecretList()
+	assert.True(ok)
+	assert.True(len(list) < len(secrets), "expected a partial list")
+}
+
+// chaosClock is the clock of the cache in the chaos test, along with a sequence ordering the
+// calls made while its time stands still.
+type chaosClock struct {
+	lock sync.Mutex
+	time time.Time
+	seq  uint64
+}
+
+func (c *chaosClock) now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.time
+}
+
+func (c *chaosClock) advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.time = c.time.Add(d)
+}
+
+// tick returns the current time and the next sequence number.
+func (c *chaosClock) tick() (time.Time, uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.seq++
+	return c.time, c.seq
+}
+
+// chaosCall records when a call started and ended in the chaos test, in sequence order, and the
+// time of the clock when it ended.
+type chaosCall struct {
+	start uint64
+	end   uint64
+	time  time.Time
+}
+
+// chaosObservation records a single read made by a client goroutine in the chaos test.
+type chaosObservation struct {
+	chaosCall
+	name   string
+	served bool
+}
+
+// presenceEvent records a backend call which reported a secret present or absent.
+type presenceEvent struct {
+	chaosCall
+	present bool
+}
+
+// presenceBackend records when a backend reported each secret present, fetched or listed, and when
+// it reported it absent, not found or missing from a listing.
+type presenceBackend struct {
+	SecretBackend
+	clock  *chaosClock
+	names  []string
+	lock   sync.Mutex
+	events map[string][]presenceEvent
+}
+
+func (b *presenceBackend) Secret(name string) (*Secret, error) {
+	_, start := b.clock.tick()
+	secret, err := b.SecretBackend.Secret(name)
+	if _, deleted := err.(SecretDeleted); err == nil || deleted {
+		now, end := b.clock.tick()
+		b.record(name, presenceEvent{chaosCall{start, end, now}, err == nil})
+	}
+	return secret, err
+}
+
+func (b *presenceBackend) SecretList() ([]Secret, bool) {
+	_, start := b.clock.tick()
+	secrets, ok := b.SecretBackend.SecretList()
+	if ok {
+		now, end := b.clock.tick()
+		listed := make(map[string]bool)
+		for _, s := range secrets {
+			listed[s.Name] = true
+		}
+		for _, name := range b.names {
+			b.record(name, presenceEvent{chaosCall{start, end, now}, listed[name]})
+		}
+	}
+	return secrets, ok
+}
+
+func (b *presenceBackend) record(name string, e presenceEvent) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.events[name] = append(b.events[name], e)
+}
+
+// dropped returns when the backend first reported a secret absent since it last reported it
+// present before a call started, which is when the cache starts counting DeletionDelay.
+func (b *presenceBackend) dropped(name string, before uint64) (time.Time, bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	var since uint64
+	for _, e := range b.events[name] {
+		if e.present && e.end < before && e.start > since {
+			since = e.start
+		}
+	}
+	var dropped time.Time
+	for _, e := range b.events[name] {
+		if !e.present && e.end > since && (dropped.IsZero() || e.time.Before(dropped)) {
+			dropped = e.time
+		}
+	}
+	return dropped, !dropped.IsZero()
+}
+
+// TestCacheChaos hammers a cache backed by a FaultBackend from several goroutines, while the test
+// advances the cache's clock in steps, and checks invariants over everything that was observed:
+//   - a secret that was ever served with content never disappears before DeletionDelay has
+//     elapsed since the backend reported it absent, not found or missing from a listing,
+//   - Secret and SecretList return while backend calls hang, until the test ends the hangs.
+func TestCacheChaos(t *testing.T) {
+	assert := assert.New(t)
+
+	const (
+		numSecrets = 10
+		workers    = 8
+		steps      = 40
+		reads      = 5
+	)
+	timeouts := Timeouts{
+		Fresh:           0,
+		BackendDeadline: 5 * time.Millisecond,
+		MaxWait:         10 * time.Millisecond,
+		DeletionDelay:   time.Hour,
+	}
+	// Clients don't wait on hangs, which last until the end of the test.
+	faults := Faults{
+		ErrorRate:       0.2,
+		NotFoundRate:    0.2,
+		HangRate:        0.05,
+		Hang:            time.Hour,
+		PartialListRate: 0.3,
+	}
+
+	for seed := int64(1); seed <= 3; seed++ {
+		var secrets []Secret
+		var names []string
+		for i := 0; i < numSecrets; i++ {
+			name := fmt.Sprintf("chaos-%d", i)
+			secrets = append(secrets, Secret{Name: name, Content: content(name), Length: uint64(len(name))})
+			names = append(names, name)
+		}
+		clock := &chaosClock{time: time.Now()}
+		mapBackend := NewMapBackend(secrets...)
+		faultBackend := NewFaultBackend(mapBackend, faults, seed)
+		hangs := make(chan struct{})
+		faultBackend.sleep = func(d time.Duration) {
+			if d >= faults.Hang {
+				<-hangs
+			}
+		}
+		backend := &presenceBackend{
+			SecretBackend: faultBackend,
+			clock:         clock,
+			names:         names,
+			events:        make(map[string][]presenceEvent),
+		}
+		cache := NewCache(backend, timeouts, logConfig, clock.now)
+
+		var lock sync.Mutex
+		var observations []chaosObservation
+		observe := func(o chaosObservation) {
+			lock.Lock()
+			defer lock.Unlock()
+			observations = append(observations, o)
+		}
+
+		workersDone := make(chan struct{})
+		go func() {
+			defer close(workersDone)
+			for step := 0; step < steps; step++ {
+				clock.advance(timeouts.DeletionDelay / 8)
+				// Half of the secrets are deleted on the server early on, so that they disappear during the run.
+				if step == steps/8 {
+					for _, name := range names[:numSecrets/2] {
+						mapBackend.Remove(name)
+					}
+				}
+
+				var wg sync.WaitGroup
+				for w := 0; w < workers; w++ {
+					wg.Add(1)
+					go func(r *rand.Rand) {
+						defer wg.Done()
+						for i := 0; i < reads; i++ {
+							if r.Intn(5) == 0 {
+								cache.SecretList()
+								continue
+							}
+							name := fmt.Sprintf("chaos-%d", r.Intn(numSecrets))
+							_, start := clock.tick()
+							secret, ok := cache.Secret(name)
+							now, end := clock.tick()
+							observe(chaosObservation{chaosCall{start, end, now}, name, ok && len(secret.Content) > 0})
+							secret.Release()
+						}
+					}(rand.New(rand.NewSource(seed*1000 + int64(step*workers+w))))
+				}
+				wg.Wait()
+			}
+		}()
+		select {
+		case <-workersDone:
+		case <-time.After(30 * time.Second):
+			t.Fatalf("seed %d: a client is blocked on a hanging backend call", seed)
+		}
+		close(hangs)
+		faultBackend.Wait()
+
+		// Earliest completion of a successful read, per secret.
+		firstServed := make(map[string]uint64)
+		for _, o := range observations {
+			if first, ok := firstServed[o.name]; o.served && (!ok || o.end < first) {
+				firstServed[o.name] = o.end
+			}
+		}
+
+		disappeared := 0
+		for _, o := range observations {
+			served, ok := firstServed[o.name]
+			if o.served || !ok || o.start < served {
+				continue
+			}
+			disappeared++
+			dropped, ok := backend.dropped(o.name, o.start)
+			if !assert.True(ok, "seed %d: %s disappeared without being dropped by the backend", seed, o.name) {
+				continue
+			}
+			assert.False(o.time.Before(dropped.Add(timeouts.DeletionDelay)),
+				"seed %d: %s disappeared %v after it was dropped", seed, o.name, o.time.Sub(dropped))
+		}
+		assert.NotEmpty(firstServed, "seed %d: no secret was ever served", seed)
+		assert.NotZero(disappeared, "seed %d: no deleted secret ever disappeared", seed)
+	}
+}
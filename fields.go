@@ -0,0 +1,191 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// dotenvLine matches a variable assignment in a dotenv file, e.g. `export DB_PASSWORD="hunter2"`.
+var dotenvLine = regexp.MustCompile(`^(?:export\s+)?([A-Za-z_][A-Za-z0-9_]*)=(.*)$`)
+
+// fieldNode is a node in the tree of fields of a structured secret. Leaves hold a value, other
+// nodes hold children keyed by field name. Array elements are keyed by their index.
+type fieldNode struct {
+	value    []byte
+	children map[string]*fieldNode
+}
+
+// IsDir indicates if the node has children rather than a value.
+func (n *fieldNode) IsDir() bool {
+	return n.children != nil
+}
+
+// Lookup finds a node by its slash-separated path. The empty path is the node itself.
+func (n *fieldNode) Lookup(path string) (*fieldNode, bool) {
+	if path == "" {
+		return n, true
+	}
+	for _, key := range strings.Split(path, "/") {
+		child, ok := n.children[key]
+		if !ok {
+			return nil, false
+		}
+		n = child
+	}
+	return n, true
+}
+
+// Names returns the sorted names of the node's children.
+func (n *fieldNode) Names() []string {
+	names := make([]string, 0, len(n.children))
+	for name := range n.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Release zeroes the values of the node and its descendants. Values are copies of secret content
+// on the heap, so trees must be released once read. The nil node is empty.
+func (n *fieldNode) Release() {
+	n.releaseExcept(nil)
+}
+
+// releaseExcept zeroes the values of the node and its descendants, other than those of keep and
+// its descendants.
+func (n *fieldNode) releaseExcept(keep *fieldNode) {
+	if n == nil || n == keep {
+		return
+	}
+	zero(n.value)
+	for _, child := range n.children {
+		child.releaseExcept(keep)
+	}
+}
+
+// parseFields parses secret content as JSON, YAML or dotenv, in that order. Only documents whose
+// top level is an object or an array are considered structured.
+func parseFields(content []byte) (*fieldNode, bool) {
+	trimmed := bytes.TrimSpace(content)
+	if len(trimmed) == 0 {
+		return nil, false
+	}
+
+	if trimmed[0] == '{' || trimmed[0] == '[' {
+		decoder := json.NewDecoder(bytes.NewReader(trimmed))
+		decoder.UseNumber()
+		var v interface{}
+		if err := decoder.Decode(&v); err == nil && !decoder.More() {
+			return newFieldNode(v), true
+		}
+	}
+
+	var v interface{}
+	if err := yaml.Unmarshal(content, &v); err == nil {
+		switch v.(type) {
+		case map[interface{}]interface{}, []interface{}:
+			return newFieldNode(v), true
+		}
+	}
+
+	return parseDotenv(content)
+}
+
+// newFieldNode converts a decoded JSON or YAML value into a fieldNode. Keys which can't be used as
+// file names are skipped.
+func newFieldNode(v interface{}) *fieldNode {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		n := &fieldNode{children: make(map[string]*fieldNode, len(v))}
+		for key, child := range v {
+			n.addChild(key, child)
+		}
+		return n
+	case map[interface{}]interface{}:
+		n := &fieldNode{children: make(map[string]*fieldNode, len(v))}
+		for key, child := range v {
+			n.addChild(fmt.Sprint(key), child)
+		}
+		return n
+	case []interface{}:
+		n := &fieldNode{children: make(map[string]*fieldNode, len(v))}
+		for i, child := range v {
+			n.addChild(strconv.Itoa(i), child)
+		}
+		return n
+	case nil:
+		return &fieldNode{value: []byte{}}
+	case string:
+		return &fieldNode{value: []byte(v)}
+	default:
+		return &fieldNode{value: []byte(fmt.Sprint(v))}
+	}
+}
+
+func (n *fieldNode) addChild(key string, v interface{}) {
+	if key == "" || key == "." || key == ".." || strings.Contains(key, "/") {
+		return
+	}
+	n.children[key] = newFieldNode(v)
+}
+
+// parseDotenv parses KEY=value lines. Blank lines and comments are ignored, values may be quoted,
+// and any other line makes the content unstructured.
+func parseDotenv(content []byte) (*fieldNode, bool) {
+	n := &fieldNode{children: make(map[string]*fieldNode)}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		match := dotenvLine.FindStringSubmatch(line)
+		if match == nil {
+			return nil, false
+		}
+		n.children[match[1]] = &fieldNode{value: []byte(unquoteDotenv(match[2]))}
+	}
+	if scanner.Err() != nil || len(n.children) == 0 {
+		return nil, false
+	}
+	return n, true
+}
+
+// unquoteDotenv strips the quotes around a dotenv value. Double-quoted values support the usual
+// escape sequences.
+func unquoteDotenv(value string) string {
+	if len(value) >= 2 {
+		switch {
+		case value[0] == '"' && value[len(value)-1] == '"':
+			if unquoted, err := strconv.Unquote(value); err == nil {
+				return unquoted
+			}
+			return value[1 : len(value)-1]
+		case value[0] == '\'' && value[len(value)-1] == '\'':
+			return value[1 : len(value)-1]
+		}
+	}
+	return value
+}
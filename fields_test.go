@@ -0,0 +1,152 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseFields(t *testing.T) {
+	assert := assert.New(t)
+
+	cases := []struct {
+		format  string
+		content string
+		fields  map[string]string
+	}{
+		{
+			"json",
+			`{"user": "admin", "port": 5432, "ratio": 0.5, "tls": true, "none": null,
+			  "primary": {"password": "hunter2"}, "hosts": ["a", "b"], "bad/key": "x"}`,
+			map[string]string{"user": "admin", "port": "5432", "ratio": "0.5", "tls": "true", "none": "",
+				"primary/password": "hunter2", "hosts/0": "a", "hosts/1": "b"},
+		},
+		{
+			"yaml",
+			"user: admin\nport: 5432\nprimary:\n  password: hunter2\nhosts:\n  - a\n  - b\n",
+			map[string]string{"user": "admin", "port": "5432", "primary/password": "hunter2", "hosts/0": "a", "hosts/1": "b"},
+		},
+		{
+			"dotenv",
+			"# database\nexport DB_USER=admin\n\nDB_PASSWORD=\"hun\\\"ter2\"\nDB_HOST='db.example.com'\nEMPTY=\n",
+			map[string]string{"DB_USER": "admin", "DB_PASSWORD": "hun\"ter2", "DB_HOST": "db.example.com", "EMPTY": ""},
+		},
+	}
+
+	for _, c := range cases {
+		root, ok := parseFields([]byte(c.content))
+		if !assert.True(ok, c.format) {
+			continue
+		}
+		for path, value := range c.fields {
+			node, ok := root.Lookup(path)
+			if assert.True(ok, "%s: %s", c.format, path) {
+				assert.False(node.IsDir())
+				assert.Equal(value, string(node.value), "%s: %s", c.format, path)
+			}
+		}
+		_, ok = root.Lookup("missing")
+		assert.False(ok, c.format)
+	}
+
+	for _, content := range []string{"", "hunter2", "HMAC_KEY_12345678", "a sentence: with a colon, sort of\nand more", "\x00\xff\xfe", "42", "KEY=value\nnot an assignment"} {
+		_, ok := parseFields([]byte(content))
+		assert.False(ok, "%q should not be structured", content)
+	}
+}
+
+func TestFsFields(t *testing.T) {
+	assert := assert.New(t)
+	context := &fuse.Context{}
+
+	db := `{"primary": {"user": "admin", "password": "hunter2"}}`
+	backend := NewMapBackend(
+		Secret{Name: "db.json", Content: content(db), Length: uint64(len(db)), Mode: "0440"},
+		Secret{Name: "plain", Content: content("hunter2"), Length: 7})
+	timeouts := Timeouts{0, 100 * time.Millisecond, 200 * time.Millisecond, time.Hour}
+	kwfs, _, err := NewKeywhizFs(nil, backend, Ownership{Uid: 1000, Gid: 1000}, timeouts, nil, logConfig)
+	assert.NoError(err)
+
+	attr, status := kwfs.GetAttr(".fields/db.json/primary", context)
+	assert.Equal(fuse.OK, status)
+	assert.EqualValues(fuse.S_IFDIR|0550, attr.Mode)
+
+	attr, status = kwfs.GetAttr(".fields/db.json/primary/password", context)
+	assert.Equal(fuse.OK, status)
+	assert.EqualValues(fuse.S_IFREG|0440, attr.Mode)
+	assert.EqualValues(len("hunter2"), attr.Size)
+	assert.EqualValues(1000, attr.Uid)
+
+	read := func(name string) string {
+		file, status := kwfs.Open(name, 0, context)
+		if !assert.Equal(fuse.OK, status, name) {
+			return ""
+		}
+		var fattr fuse.Attr
+		file.GetAttr(&fattr)
+		buf := make([]byte, 100)
+		res, _ := file.Read(buf, 0)
+		data, _ := res.Bytes(buf)
+		assert.EqualValues(len(data), fattr.Size)
+		return string(data)
+	}
+	assert.Equal("hunter2", read(".fields/db.json/primary/password"))
+
+	entries, status := kwfs.OpenDir(".fields", context)
+	assert.Equal(fuse.OK, status)
+	assert.Contains(entries, fuse.DirEntry{Name: "db.json", Mode: fuse.S_IFDIR})
+	assert.NotContains(entries, fuse.DirEntry{Name: "plain", Mode: fuse.S_IFDIR})
+
+	entries, status = kwfs.OpenDir(".fields/db.json/primary", context)
+	assert.Equal(fuse.OK, status)
+	assert.Equal([]fuse.DirEntry{{Name: "password", Mode: fuse.S_IFREG}, {Name: "user", Mode: fuse.S_IFREG}}, entries)
+
+	// Fields follow the parent secret when it rotates.
+	rotated := `{"primary": {"user": "admin", "password": "correct horse"}}`
+	backend.Put(Secret{Name: "db.json", Content: content(rotated), Length: uint64(len(rotated)), Mode: "0440"})
+	assert.Equal("correct horse", read(".fields/db.json/primary/password"))
+
+	for _, name := range []string{".fields/plain", ".fields/plain/x", ".fields/missing", ".fields/db.json/primary/nope", ".fields/db.json/primary/password/x"} {
+		_, status = kwfs.GetAttr(name, context)
+		assert.Equal(fuse.ENOENT, status, name)
+		var file nodefs.File
+		file, status = kwfs.Open(name, 0, context)
+		assert.Nil(file)
+		assert.Equal(fuse.ENOENT, status, name)
+	}
+	_, status = kwfs.Open(".fields/db.json/primary", 0, context)
+	assert.Equal(fuseEISDIR, status)
+}
+
+func TestHarnessFields(t *testing.T) {
+	assert := assert.New(t)
+
+	yml := "primary:\n  password: hunter2\n"
+	h := newFsHarness(t, NewMapBackend(Secret{Name: "db.yaml", Content: content(yml), Length: uint64(len(yml))}))
+	defer h.Close()
+
+	data, err := h.Read(".fields/db.yaml/primary/password")
+	assert.NoError(err)
+	assert.Equal([]byte("hunter2"), data)
+
+	names, err := h.List(".fields/db.yaml")
+	assert.NoError(err)
+	assert.Equal([]string{"primary"}, names)
+}
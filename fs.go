@@ -17,17 +17,21 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"runtime"
 	"runtime/pprof"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/hanwen/go-fuse/fuse"
 	"github.com/hanwen/go-fuse/fuse/nodefs"
 	"github.com/hanwen/go-fuse/fuse/pathfs"
+	"github.com/rcrowley/go-metrics"
 	"github.com/square/go-sq-metrics"
 	"github.com/square/keywhiz-fs/log"
 	"golang.org/x/sys/unix"
@@ -36,6 +40,8 @@ import (
 const (
 	fsVersion  = "2.0"
 	fuseEISDIR = fuse.Status(unix.EISDIR)
+	// currentVersionLink is the name of the link to the current version in a version directory.
+	currentVersionLink = "current"
 )
 
 // Initialized via ldflags
@@ -47,13 +53,19 @@ var (
 
 // StatusInfo contains debug info accessible via `.json/status`.
 type StatusInfo struct {
-	BuildRevision  string           `json:"build_revision"`
-	BuildMachine   string           `json:"build_machine"`
-	BuildTime      time.Time        `json:"build_time"`
-	StartTime      time.Time        `json:"start_time"`
-	RuntimeVersion string           `json:"runtime_version"`
-	ServerURL      string           `json:"server_url"`
-	ClientParams   httpClientParams `json:"client_params"`
+	BuildRevision    string            `json:"build_revision"`
+	BuildMachine     string            `json:"build_machine"`
+	BuildTime        time.Time         `json:"build_time"`
+	StartTime        time.Time         `json:"start_time"`
+	RuntimeVersion   string            `json:"runtime_version"`
+	ServerURL        string            `json:"server_url"`
+	ClientParams     httpClientParams  `json:"client_params"`
+	MissingAliases   []string          `json:"missing_aliases,omitempty"`
+	SecretExpiry     []SecretExpiry    `json:"secret_expiry,omitempty"`
+	Cache            CacheStats        `json:"cache"`
+	SecretStaleness  []SecretStaleness `json:"secret_staleness,omitempty"`
+	UnresolvedUsers  []string          `json:"unresolved_users,omitempty"`
+	UnresolvedGroups []string          `json:"unresolved_groups,omitempty"`
 }
 
 // KeywhizFs is the central struct for dispatching filesystem operations.
@@ -66,6 +78,22 @@ type KeywhizFs struct {
 	StartTime time.Time
 	Ownership Ownership
 	Timeout   time.Duration
+	Aliases   Aliases
+	Templates Templates
+	EnvGroups EnvGroups
+	Expiry    ExpiryPolicy
+	Modes     ModePolicy
+	Owners    OwnershipRules
+	IDs       IDTranslation
+	// Identities resolves the owners and groups of secrets.
+	Identities *IdentityCache
+
+	// FilterByCaller hides secrets from callers who can't read them.
+	FilterByCaller bool
+
+	modeViolations   *sync.Map // Requested modes of secrets violating the mode policy, by name.
+	unresolvedUsers  *sync.Map // Owners of secrets which couldn't be resolved.
+	unresolvedGroups *sync.Map // Groups of secrets which couldn't be resolved.
 }
 
 // prettyContext pretty-prints a FUSE context for log output.
@@ -82,20 +110,56 @@ func (kwfs KeywhizFs) statusJSON() []byte {
 	seconds, err := strconv.ParseInt(buildTime, 10, 64)
 	panicOnError(err)
 
-	status, err := json.Marshal(
-		StatusInfo{
-			BuildRevision:  buildRevision,
-			BuildMachine:   buildMachine,
-			BuildTime:      time.Unix(seconds, 0),
-			StartTime:      kwfs.StartTime,
-			RuntimeVersion: runtime.Version(),
-			ServerURL:      kwfs.Client.url.String(),
-			ClientParams:   kwfs.Client.params,
-		})
+	info := StatusInfo{
+		BuildRevision:  buildRevision,
+		BuildMachine:   buildMachine,
+		BuildTime:      time.Unix(seconds, 0),
+		StartTime:      kwfs.StartTime,
+		RuntimeVersion: runtime.Version(),
+	}
+	if kwfs.Client != nil {
+		info.ServerURL = kwfs.Client.url.String()
+		info.ClientParams = kwfs.Client.params
+	}
+	if len(kwfs.Aliases) > 0 {
+		info.MissingAliases = kwfs.Aliases.Missing(kwfs.Cache.SecretList())
+	}
+	info.SecretExpiry = kwfs.Expiry.Status(kwfs.Cache.cacheSecretList(), time.Now())
+	info.Cache = kwfs.Cache.Stats()
+	info.SecretStaleness = kwfs.Cache.Staleness()
+	info.UnresolvedUsers = syncMapKeys(kwfs.unresolvedUsers)
+	info.UnresolvedGroups = syncMapKeys(kwfs.unresolvedGroups)
+
+	status, err := json.Marshal(info)
 	panicOnError(err)
 	return status
 }
 
+// rawSecretList passes through to the client, if the filesystem has one. A KeywhizFs serving
+// secrets from another SecretBackend has no client.
+func (kwfs KeywhizFs) rawSecretList() ([]byte, bool) {
+	if kwfs.Client == nil {
+		return nil, false
+	}
+	return kwfs.Client.RawSecretList()
+}
+
+// rawSecret passes through to the client, if the filesystem has one.
+func (kwfs KeywhizFs) rawSecret(name string) ([]byte, error) {
+	if kwfs.Client == nil {
+		return nil, SecretDeleted{}
+	}
+	return kwfs.Client.RawSecret(name)
+}
+
+// serverStatus passes through to the client, if the filesystem has one.
+func (kwfs KeywhizFs) serverStatus() ([]byte, error) {
+	if kwfs.Client == nil {
+		return nil, errors.New("no client")
+	}
+	return kwfs.Client.ServerStatus()
+}
+
 func (kwfs KeywhizFs) metricsJSON() []byte {
 	if kwfs.Metrics != nil {
 		metrics := kwfs.Metrics.SerializeMetrics()
@@ -108,25 +172,40 @@ func (kwfs KeywhizFs) metricsJSON() []byte {
 	return []byte{}
 }
 
+// reportCache updates the gauges describing the secret content held by the cache.
+func (kwfs KeywhizFs) reportCache() {
+	if kwfs.Metrics == nil {
+		return
+	}
+	stats := kwfs.Cache.Stats()
+	metrics.GetOrRegisterGauge("runtime.cache.resident_bytes", kwfs.Metrics.Registry).Update(int64(stats.ResidentBytes))
+	metrics.GetOrRegisterGauge("runtime.cache.resident_entries", kwfs.Metrics.Registry).Update(int64(stats.ResidentEntries))
+}
+
 func (kwfs KeywhizFs) profile(name string) []byte {
 	var b bytes.Buffer
-	// Set "1" to enable human-readable debug output
-	err := pprof.Lookup(name).WriteTo(&b, 1)
+	err := writeProfile(&b, name)
 	if err != nil {
 		kwfs.Warnf("Error writing profile: %v", err)
 	}
 	return b.Bytes()
 }
 
-// NewKeywhizFs readies a KeywhizFs struct and its parent filesystem objects.
-func NewKeywhizFs(client *Client, ownership Ownership, timeouts Timeouts, metrics *sqmetrics.SquareMetrics, logConfig log.Config) (kwfs *KeywhizFs, root nodefs.Node, err error) {
+// NewKeywhizFs readies a KeywhizFs struct and its parent filesystem objects. Secrets are served
+// from backend, which is usually the client itself. The client may be nil, in which case the
+// .json passthrough files are not available. Aliases and templates may be set on the returned
+// KeywhizFs before it is mounted.
+func NewKeywhizFs(client *Client, backend SecretBackend, ownership Ownership, timeouts Timeouts, metrics *sqmetrics.SquareMetrics, logConfig log.Config) (kwfs *KeywhizFs, root nodefs.Node, err error) {
 	logger := log.New("kwfs", logConfig)
-	cache := NewCache(client, timeouts, logConfig, nil)
+	cache := NewCache(backend, timeouts, logConfig, nil)
+	if metrics != nil {
+		cache.SetMetrics(metrics.Registry)
+	}
 
 	defaultfs := pathfs.NewDefaultFileSystem()            // Returns ENOSYS by default
 	readonlyfs := pathfs.NewReadonlyFileSystem(defaultfs) // R/W calls return EPERM
 
-	kwfs = &KeywhizFs{readonlyfs, logger, client, cache, metrics, time.Now(), ownership, 2 * timeouts.MaxWait}
+	kwfs = &KeywhizFs{readonlyfs, logger, client, cache, metrics, time.Now(), ownership, 2 * timeouts.MaxWait, nil, nil, nil, ExpiryPolicy{}, ModePolicy{}, OwnershipRules{}, IDTranslation{}, NewSystemIdentityCache(time.Minute), false, &sync.Map{}, &sync.Map{}, &sync.Map{}}
 	nfs := pathfs.NewPathNodeFs(kwfs, nil)
 	nfs.SetDebug(logConfig.Debug)
 	return kwfs, nfs.Root(), nil
@@ -161,7 +240,13 @@ func (kwfs KeywhizFs) GetAttr(name string, context *fuse.Context) (*fuse.Attr, f
 func (kwfs KeywhizFs) getAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
 	kwfs.Debugf("GetAttr called with '%v'", name)
 
+	versions := kwfs.Cache.VersionIndex()
+	if !kwfs.derivedVisible(name, context, versions) {
+		return nil, fuse.ENOENT
+	}
+
 	var attr *fuse.Attr
+	hideable := false // Whether attr is that of a secret hidden from callers who can't read it.
 	switch {
 	case name == "": // Base directory
 		attr = kwfs.directoryAttr(1, 0755) // Writability necessary for .clear_cache
@@ -184,20 +269,23 @@ func (kwfs KeywhizFs) getAttr(name string, context *fuse.Context) (*fuse.Attr, f
 	case name == ".json/secret":
 		attr = kwfs.directoryAttr(0, 0700)
 	case name == ".json/secrets":
-		data, ok := kwfs.Client.RawSecretList()
+		data, ok := kwfs.rawSecretList()
 		if ok {
 			size := uint64(len(data))
 			attr = kwfs.fileAttr(size, 0400)
 		}
 	case name == ".json/server_status":
-		data, err := kwfs.Client.ServerStatus()
+		data, err := kwfs.serverStatus()
 		if err == nil {
 			size := uint64(len(data))
 			attr = kwfs.fileAttr(size, 0444)
 		}
 	case strings.HasPrefix(name, ".json/secret/"):
 		sname := name[len(".json/secret/"):]
-		data, err := kwfs.Client.RawSecret(sname)
+		if ValidateSecretName(sname) != nil {
+			return nil, fuse.ENOENT
+		}
+		data, err := kwfs.secretJSON(sname)
 		if err == nil {
 			size := uint64(len(data))
 			attr = kwfs.fileAttr(size, 0400)
@@ -216,14 +304,68 @@ func (kwfs KeywhizFs) getAttr(name string, context *fuse.Context) (*fuse.Attr, f
 	case name == ".pprof/block":
 		size := uint64(len(kwfs.profile("block")))
 		attr = kwfs.fileAttr(size, 0444)
-	default:
-		secret, ok := kwfs.Cache.Secret(name)
+	case name == ".versions":
+		attr = kwfs.directoryAttr(0, 0755)
+	case strings.HasPrefix(name, ".versions/"):
+		attr = kwfs.versionAttr(name[len(".versions/"):], versions)
+	case name == ".fields":
+		attr = kwfs.directoryAttr(0, 0755)
+	case strings.HasPrefix(name, ".fields/"):
+		secret, node, ok := kwfs.field(name[len(".fields/"):])
+		defer node.Release()
 		if ok {
+			attr = kwfs.fieldAttr(secret, node)
+		}
+	case name == ".x509":
+		attr = kwfs.directoryAttr(0, 0755)
+	case strings.HasPrefix(name, ".x509/"):
+		sname, fname := splitSecretPath(name[len(".x509/"):])
+		secret, bundle, ok := kwfs.certBundle(sname)
+		defer bundle.Release()
+		if ok {
+			attr = kwfs.certAttr(secret, bundle.Files(), fname)
+		}
+	case name == ".env":
+		attr = kwfs.directoryAttr(0, 0755)
+	case strings.HasPrefix(name, ".env/"):
+		if kwfs.EnvGroups[name[len(".env/"):]] != nil {
+			secret, err := kwfs.renderEnvFile(name[len(".env/"):], context)
+			if err != nil {
+				return nil, fuse.EIO
+			}
+			attr = kwfs.secretAttr(secret)
+			secret.Release()
+		}
+	case kwfs.Aliases.IsDir(name):
+		attr = kwfs.directoryAttr(0, 0755)
+	case kwfs.Templates[name] != nil:
+		secret, err := kwfs.renderTemplate(name, context)
+		if err != nil {
+			return nil, fuse.EIO
+		}
+		attr = kwfs.secretAttr(secret)
+		secret.Release()
+	default:
+		if target, ok := kwfs.Aliases.Target(name); ok {
+			if !kwfs.aliasVisible(name, context) {
+				return nil, fuse.ENOENT
+			}
+			attr = kwfs.linkAttr(target)
+		} else if ValidateSecretName(name) != nil {
+			kwfs.Debugf("Not a secret name: '%v'", name)
+		} else if secret, ok := kwfs.Cache.SecretAttr(name); ok {
 			attr = kwfs.secretAttr(secret)
+			hideable = true
+		} else {
+			return nil, kwfs.missingSecret(name)
 		}
 	}
 
 	if attr != nil {
+		kwfs.translateAttr(attr, context)
+		if hideable && kwfs.FilterByCaller && context != nil && !callerOf(context).CanRead(attr) {
+			return nil, fuse.ENOENT
+		}
 		return attr, fuse.OK
 	}
 	return nil, fuse.ENOENT
@@ -256,9 +398,14 @@ func (kwfs KeywhizFs) Open(name string, flags uint32, context *fuse.Context) (no
 func (kwfs KeywhizFs) open(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
 	kwfs.Debugf("Open called with '%v'", name)
 
+	versions := kwfs.Cache.VersionIndex()
+	if !kwfs.derivedVisible(name, context, versions) {
+		return nil, fuse.ENOENT
+	}
+
 	var file nodefs.File
 	switch {
-	case name == "", name == ".json", name == ".json/secret", name == ".pprof":
+	case name == "", name == ".json", name == ".json/secret", name == ".pprof", name == ".versions", name == ".fields", name == ".x509", name == ".env":
 		return nil, fuseEISDIR
 	case name == ".version":
 		file = nodefs.NewDataFile([]byte(fsVersion))
@@ -271,20 +418,23 @@ func (kwfs KeywhizFs) open(name string, flags uint32, context *fuse.Context) (no
 	case name == ".running":
 		file = nodefs.NewDataFile(running())
 	case name == ".json/secrets":
-		data, ok := kwfs.Client.RawSecretList()
+		data, ok := kwfs.rawSecretList()
 		if ok {
 			file = nodefs.NewDataFile(data)
 		}
 	case name == ".json/server_status":
-		data, err := kwfs.Client.ServerStatus()
+		data, err := kwfs.serverStatus()
 		if err == nil {
 			file = nodefs.NewDataFile(data)
 		}
 	case strings.HasPrefix(name, ".json/secret/"):
 		sname := name[len(".json/secret/"):]
-		data, err := kwfs.Client.RawSecret(sname)
+		if ValidateSecretName(sname) != nil {
+			return nil, fuse.ENOENT
+		}
+		data, err := kwfs.secretJSON(sname)
 		if err == nil {
-			file = nodefs.NewDataFile(data)
+			file = newSecureFile(data)
 			kwfs.Debugf("Access to %s by uid %d, with gid %d", sname, context.Uid, context.Gid)
 		}
 	case name == ".pprof/heap":
@@ -295,12 +445,72 @@ func (kwfs KeywhizFs) open(name string, flags uint32, context *fuse.Context) (no
 		file = nodefs.NewDataFile(kwfs.profile("threadcreate"))
 	case name == ".pprof/block":
 		file = nodefs.NewDataFile(kwfs.profile("block"))
-	default:
-		secret, ok := kwfs.Cache.Secret(name)
+	case strings.HasPrefix(name, ".versions/"):
+		sname, id := splitSecretPath(name[len(".versions/"):])
+		if id == "" {
+			return nil, fuseEISDIR
+		}
+		secret, ok := versions.Version(sname, id)
+		defer secret.Release()
+		if ok {
+			file = newSecureFile(secret.Content)
+			kwfs.Debugf("Access to version %s of %s by uid %d, with gid %d", id, sname, context.Uid, context.Gid)
+		}
+	case strings.HasPrefix(name, ".fields/"):
+		_, node, ok := kwfs.field(name[len(".fields/"):])
+		defer node.Release()
+		if ok && node.IsDir() {
+			return nil, fuseEISDIR
+		}
 		if ok {
-			file = nodefs.NewDataFile(secret.Content)
+			file = newSecureFile(node.value)
+			kwfs.Debugf("Access to %s by uid %d, with gid %d", name, context.Uid, context.Gid)
+		}
+	case strings.HasPrefix(name, ".x509/"):
+		sname, fname := splitSecretPath(name[len(".x509/"):])
+		_, bundle, ok := kwfs.certBundle(sname)
+		defer bundle.Release()
+		if ok && fname == "" {
+			return nil, fuseEISDIR
+		}
+		if files := bundle.Files(); files[fname] != nil {
+			file = newSecureFile(files[fname])
 			kwfs.Debugf("Access to %s by uid %d, with gid %d", name, context.Uid, context.Gid)
 		}
+	case strings.HasPrefix(name, ".env/"):
+		if kwfs.EnvGroups[name[len(".env/"):]] != nil {
+			secret, err := kwfs.renderEnvFile(name[len(".env/"):], context)
+			defer secret.Release()
+			if err != nil {
+				return nil, fuse.EIO
+			}
+			file = newSecureFile(secret.Content)
+			kwfs.Debugf("Access to %s by uid %d, with gid %d", name, context.Uid, context.Gid)
+		}
+	case kwfs.Aliases.IsDir(name):
+		return nil, fuseEISDIR
+	case kwfs.Templates[name] != nil:
+		secret, err := kwfs.renderTemplate(name, context)
+		defer secret.Release()
+		if err != nil {
+			return nil, fuse.EIO
+		}
+		file = newSecureFile(secret.Content)
+		kwfs.Debugf("Access to %s by uid %d, with gid %d", name, context.Uid, context.Gid)
+	default:
+		if ValidateSecretName(name) != nil {
+			return nil, fuse.ENOENT
+		}
+		secret, ok := kwfs.Cache.Secret(name)
+		defer secret.Release()
+		if !ok {
+			return nil, kwfs.missingSecret(name)
+		}
+		if !kwfs.checkExpiry(secret, context) {
+			return nil, fuse.EACCES
+		}
+		file = newSecureFile(secret.Content)
+		kwfs.Debugf("Access to %s by uid %d, with gid %d", name, context.Uid, context.Gid)
 	}
 
 	if file != nil {
@@ -358,15 +568,24 @@ func (kwfs KeywhizFs) logGoroutines() {
 func (kwfs KeywhizFs) openDir(name string, context *fuse.Context) (stream []fuse.DirEntry, code fuse.Status) {
 	kwfs.Debugf("OpenDir called with '%v'", name)
 
+	versions := kwfs.Cache.VersionIndex()
+	if !kwfs.derivedVisible(name, context, versions) {
+		return nil, fuse.ENOENT
+	}
+
 	var entries []fuse.DirEntry
 	switch name {
 	case "": // Base directory
-		entries = kwfs.secretsDirListing(
+		entries = kwfs.secretsDirListing(context, append(append(kwfs.aliasEntries("", context), kwfs.templatesDirListing()...),
 			fuse.DirEntry{Name: ".clear_cache", Mode: fuse.S_IFREG},
+			fuse.DirEntry{Name: ".env", Mode: fuse.S_IFDIR},
+			fuse.DirEntry{Name: ".fields", Mode: fuse.S_IFDIR},
 			fuse.DirEntry{Name: ".json", Mode: fuse.S_IFDIR},
 			fuse.DirEntry{Name: ".pprof", Mode: fuse.S_IFDIR},
 			fuse.DirEntry{Name: ".running", Mode: fuse.S_IFREG},
-			fuse.DirEntry{Name: ".version", Mode: fuse.S_IFREG})
+			fuse.DirEntry{Name: ".version", Mode: fuse.S_IFREG},
+			fuse.DirEntry{Name: ".versions", Mode: fuse.S_IFDIR},
+			fuse.DirEntry{Name: ".x509", Mode: fuse.S_IFDIR})...)
 	case ".json":
 		entries = []fuse.DirEntry{
 			{Name: "metrics", Mode: fuse.S_IFREG},
@@ -376,7 +595,7 @@ func (kwfs KeywhizFs) openDir(name string, context *fuse.Context) (stream []fuse
 			{Name: "server_status", Mode: fuse.S_IFREG},
 		}
 	case ".json/secret":
-		entries = kwfs.secretsDirListing()
+		entries = kwfs.secretsDirListing(context)
 	case ".pprof":
 		entries = []fuse.DirEntry{
 			fuse.DirEntry{Name: "heap", Mode: fuse.S_IFREG},
@@ -384,6 +603,64 @@ func (kwfs KeywhizFs) openDir(name string, context *fuse.Context) (stream []fuse
 			fuse.DirEntry{Name: "threadcreate", Mode: fuse.S_IFREG},
 			fuse.DirEntry{Name: "block", Mode: fuse.S_IFREG},
 		}
+	case ".versions":
+		for _, sname := range versions.Names() {
+			if kwfs.secretVisible(sname, context, versions) {
+				entries = append(entries, fuse.DirEntry{Name: sname, Mode: fuse.S_IFDIR})
+			}
+		}
+	case ".fields":
+		visible := kwfs.callerFilter(context)
+		for _, s := range kwfs.Cache.SecretList() {
+			if !visible(&s) {
+				continue
+			}
+			// Only secrets already in the cache are listed, to avoid fetching every secret.
+			if secret, ok := kwfs.Cache.Cached(s.Name); ok {
+				root, ok := parseFields(secret.Content)
+				root.Release()
+				secret.Release()
+				if ok {
+					entries = append(entries, fuse.DirEntry{Name: s.Name, Mode: fuse.S_IFDIR})
+				}
+			}
+		}
+	case ".x509":
+		visible := kwfs.callerFilter(context)
+		for _, s := range kwfs.Cache.SecretList() {
+			if !visible(&s) {
+				continue
+			}
+			// Only secrets already in the cache are listed, to avoid fetching every secret.
+			if secret, ok := kwfs.Cache.Cached(s.Name); ok {
+				bundle, ok := parseCertBundle(secret.Content)
+				bundle.Release()
+				secret.Release()
+				if ok {
+					entries = append(entries, fuse.DirEntry{Name: s.Name, Mode: fuse.S_IFDIR})
+				}
+			}
+		}
+	case ".env":
+		for gname := range kwfs.EnvGroups {
+			entries = append(entries, fuse.DirEntry{Name: gname, Mode: fuse.S_IFREG})
+		}
+	default:
+		if strings.HasPrefix(name, ".versions/") {
+			entries = kwfs.versionsDirListing(name[len(".versions/"):], versions)
+		} else if strings.HasPrefix(name, ".fields/") {
+			entries = kwfs.fieldsDirListing(name[len(".fields/"):])
+		} else if strings.HasPrefix(name, ".x509/") {
+			_, bundle, ok := kwfs.certBundle(name[len(".x509/"):])
+			defer bundle.Release()
+			if ok {
+				for _, fname := range certFileNames(bundle.Files()) {
+					entries = append(entries, fuse.DirEntry{Name: fname, Mode: fuse.S_IFREG})
+				}
+			}
+		} else {
+			entries = kwfs.aliasEntries(name, context)
+		}
 	}
 
 	if len(entries) == 0 {
@@ -392,11 +669,148 @@ func (kwfs KeywhizFs) openDir(name string, context *fuse.Context) (stream []fuse
 	return entries, fuse.OK
 }
 
+// Readlink is a FUSE function called to resolve a symbolic link. Links are either aliases or the
+// `current` entries of version directories.
+func (kwfs KeywhizFs) Readlink(name string, context *fuse.Context) (string, fuse.Status) {
+	ret := make(chan struct {
+		Target string
+		Status fuse.Status
+	}, 1)
+	go func() {
+		defer close(ret)
+		target, status := kwfs.readlink(name, context)
+		ret <- struct {
+			Target string
+			Status fuse.Status
+		}{target, status}
+	}()
+	select {
+	case out := <-ret:
+		return out.Target, out.Status
+	case <-time.After(kwfs.Timeout):
+		kwfs.Errorf("Operation timed out: Readlink(\"%s\", %s)", name, prettyContext(context))
+		kwfs.logGoroutines()
+		return "", fuse.EIO
+	}
+}
+
+func (kwfs KeywhizFs) readlink(name string, context *fuse.Context) (string, fuse.Status) {
+	kwfs.Debugf("Readlink called with '%v'", name)
+
+	if target, ok := kwfs.Aliases.Target(name); ok {
+		if !kwfs.aliasVisible(name, context) {
+			return "", fuse.ENOENT
+		}
+		return target, fuse.OK
+	}
+	if strings.HasPrefix(name, ".versions/") {
+		sname, id := splitSecretPath(name[len(".versions/"):])
+		if id == currentVersionLink {
+			if current, ok := kwfs.Cache.CurrentVersion(sname); ok {
+				return current, fuse.OK
+			}
+		}
+	}
+	return "", fuse.ENOENT
+}
+
+// GetXAttr is a FUSE function returning an extended attribute. Secrets have attributes for their
+// expiry and description, when the server provides them.
+func (kwfs KeywhizFs) GetXAttr(name string, attribute string, context *fuse.Context) ([]byte, fuse.Status) {
+	ret := make(chan struct {
+		Data   []byte
+		Status fuse.Status
+	}, 1)
+	go func() {
+		defer close(ret)
+		data, status := kwfs.getXAttr(name, attribute, context)
+		ret <- struct {
+			Data   []byte
+			Status fuse.Status
+		}{data, status}
+	}()
+	select {
+	case out := <-ret:
+		return out.Data, out.Status
+	case <-time.After(kwfs.Timeout):
+		kwfs.Errorf("Operation timed out: GetXAttr(\"%s\", \"%s\", %s)", name, attribute, prettyContext(context))
+		kwfs.logGoroutines()
+		return nil, fuse.EIO
+	}
+}
+
+func (kwfs KeywhizFs) getXAttr(name string, attribute string, context *fuse.Context) ([]byte, fuse.Status) {
+	kwfs.Debugf("GetXAttr called with '%v', '%v'", name, attribute)
+
+	attrs, status := kwfs.xattrs(name, context)
+	if status != fuse.OK {
+		return nil, status
+	}
+	if data, ok := attrs[attribute]; ok {
+		return data, fuse.OK
+	}
+	return nil, fuse.ENOATTR
+}
+
+// ListXAttr is a FUSE function listing the extended attributes of a file.
+func (kwfs KeywhizFs) ListXAttr(name string, context *fuse.Context) ([]string, fuse.Status) {
+	ret := make(chan struct {
+		Attributes []string
+		Status     fuse.Status
+	}, 1)
+	go func() {
+		defer close(ret)
+		attributes, status := kwfs.listXAttr(name, context)
+		ret <- struct {
+			Attributes []string
+			Status     fuse.Status
+		}{attributes, status}
+	}()
+	select {
+	case out := <-ret:
+		return out.Attributes, out.Status
+	case <-time.After(kwfs.Timeout):
+		kwfs.Errorf("Operation timed out: ListXAttr(\"%s\", %s)", name, prettyContext(context))
+		kwfs.logGoroutines()
+		return nil, fuse.EIO
+	}
+}
+
+func (kwfs KeywhizFs) listXAttr(name string, context *fuse.Context) ([]string, fuse.Status) {
+	kwfs.Debugf("ListXAttr called with '%v'", name)
+
+	attrs, status := kwfs.xattrs(name, context)
+	if status != fuse.OK {
+		return nil, status
+	}
+	attributes := make([]string, 0, len(attrs))
+	for attribute := range attrs {
+		attributes = append(attributes, attribute)
+	}
+	sort.Strings(attributes)
+	return attributes, fuse.OK
+}
+
+// xattrs returns the extended attributes of a file. Only secrets have attributes; other files
+// have none.
+func (kwfs KeywhizFs) xattrs(name string, context *fuse.Context) (map[string][]byte, fuse.Status) {
+	attr, status := kwfs.getAttr(name, context)
+	if status != fuse.OK {
+		return nil, status
+	}
+	if attr.IsRegular() && !strings.HasPrefix(name, ".") && kwfs.Templates[name] == nil {
+		if secret, ok := kwfs.Cache.SecretAttr(name); ok {
+			return secretXAttrs(secret), fuse.OK
+		}
+	}
+	return nil, fuse.OK
+}
+
 // Unlink is a FUSE function called when an object is deleted.
 func (kwfs KeywhizFs) Unlink(name string, context *fuse.Context) fuse.Status {
 	kwfs.Debugf("Unlink called with '%v'", name)
 	if name == ".clear_cache" {
-		kwfs.Cache.Clear()
+		kwfs.ClearCache("")
 		return fuse.OK
 	}
 	return fuse.EACCES
@@ -409,43 +823,360 @@ func (kwfs KeywhizFs) StatFs(name string) *fuse.StatfsOut {
 	return &fuse.StatfsOut{}
 }
 
-// secretsDirListing produces directory entries containing all secret files. Extra entries passed
-// to this function are included.
-func (kwfs KeywhizFs) secretsDirListing(extraEntries ...fuse.DirEntry) []fuse.DirEntry {
+// templatesDirListing produces directory entries for the rendered templates.
+func (kwfs KeywhizFs) templatesDirListing() []fuse.DirEntry {
+	entries := make([]fuse.DirEntry, 0, len(kwfs.Templates))
+	for name := range kwfs.Templates {
+		entries = append(entries, fuse.DirEntry{Name: name, Mode: fuse.S_IFREG})
+	}
+	return entries
+}
+
+// renderTemplate renders a template with secrets from the cache, those hidden from the caller being
+// missing. The result must be released.
+func (kwfs KeywhizFs) renderTemplate(name string, context *fuse.Context) (*Secret, error) {
+	secret, err := kwfs.Templates[name].Render(kwfs.visibleLookup(context))
+	if err != nil {
+		kwfs.Errorf("Unable to render template %s: %v", name, err)
+	}
+	return secret, err
+}
+
+// renderEnvFile renders an environment file with secrets from the cache. The secret listing is
+// only retrieved for groups matching secrets by prefix. Secrets hidden from the caller are missing.
+// The result must be released.
+func (kwfs KeywhizFs) renderEnvFile(name string, context *fuse.Context) (*Secret, error) {
+	group := kwfs.EnvGroups[name]
+	var listed []Secret
+	if group.Prefix != "" {
+		visible := kwfs.callerFilter(context)
+		for _, s := range kwfs.Cache.SecretList() {
+			if visible(&s) {
+				listed = append(listed, s)
+			}
+		}
+	}
+	secret, err := group.Render(listed, kwfs.visibleLookup(context))
+	if err != nil {
+		kwfs.Errorf("Unable to render env file %s: %v", name, err)
+	}
+	return secret, err
+}
+
+// secretsDirListing produces directory entries containing all secret files, or those the caller
+// can read when filtering by caller. Extra entries passed to this function are included, and take
+// precedence over secrets with the same name.
+func (kwfs KeywhizFs) secretsDirListing(context *fuse.Context, extraEntries ...fuse.DirEntry) []fuse.DirEntry {
 	secrets := kwfs.Cache.SecretList()
+	extraNames := make(map[string]bool, len(extraEntries))
+	for _, e := range extraEntries {
+		extraNames[e.Name] = true
+	}
+	visible := kwfs.callerFilter(context)
 	entries := make([]fuse.DirEntry, 0, len(secrets)+len(extraEntries))
 	for _, s := range secrets {
+		if extraNames[s.Name] || !visible(&s) {
+			continue
+		}
 		entries = append(entries, fuse.DirEntry{Name: s.Name, Mode: fuse.S_IFREG})
 	}
 	entries = append(entries, extraEntries...)
 	return entries
 }
 
+// callerFilter returns a function reporting whether a secret is visible to the caller, which is
+// when the caller can read it if filtering by caller, and always otherwise.
+func (kwfs KeywhizFs) callerFilter(context *fuse.Context) func(*Secret) bool {
+	if !kwfs.FilterByCaller || context == nil {
+		return func(*Secret) bool { return true }
+	}
+	caller := callerOf(context)
+	return func(s *Secret) bool {
+		attr := kwfs.secretAttr(s)
+		kwfs.translateAttr(attr, context)
+		return caller.CanRead(attr)
+	}
+}
+
+// secretVisible reports whether a secret is visible to the caller, by name. Secrets only known
+// by their versions are checked against their most recent version in the index, if given.
+func (kwfs KeywhizFs) secretVisible(sname string, context *fuse.Context, versions *VersionIndex) bool {
+	if !kwfs.FilterByCaller || context == nil || sname == "" {
+		return true
+	}
+	visible := kwfs.callerFilter(context)
+	if secret, ok := kwfs.Cache.SecretAttr(sname); ok {
+		return visible(secret)
+	}
+	if versions != nil {
+		if known := versions.Versions(sname); len(known) > 0 {
+			return visible(&known[len(known)-1].Secret)
+		}
+	}
+	return true
+}
+
+// visibleLookup returns a secretLookup retrieving secrets from the cache, reporting those hidden
+// from the caller as missing.
+func (kwfs KeywhizFs) visibleLookup(context *fuse.Context) secretLookup {
+	visible := kwfs.callerFilter(context)
+	return func(name string) (*Secret, bool) {
+		secret, ok := kwfs.Cache.Secret(name)
+		if ok && !visible(secret) {
+			secret.Release()
+			return nil, false
+		}
+		return secret, ok
+	}
+}
+
+// aliasVisible reports whether an alias is visible to the caller: aliases are hidden along with
+// the secret they link to.
+func (kwfs KeywhizFs) aliasVisible(p string, context *fuse.Context) bool {
+	name, ok := kwfs.Aliases[p]
+	return !ok || kwfs.secretVisible(name, context, nil)
+}
+
+// aliasEntries produces the directory entries for aliases found directly in dir, leaving out those
+// hidden from the caller.
+func (kwfs KeywhizFs) aliasEntries(dir string, context *fuse.Context) []fuse.DirEntry {
+	prefix := ""
+	if dir != "" {
+		prefix = dir + "/"
+	}
+	var entries []fuse.DirEntry
+	for _, e := range kwfs.Aliases.Entries(dir) {
+		if e.Mode != fuse.S_IFLNK || kwfs.aliasVisible(prefix+e.Name, context) {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// derivedVisible reports whether a path under .versions, .fields or .x509 is visible to the
+// caller: the files derived from a secret are hidden along with it. Other paths are visible.
+func (kwfs KeywhizFs) derivedVisible(name string, context *fuse.Context, versions *VersionIndex) bool {
+	for _, dir := range []string{".versions/", ".fields/", ".x509/"} {
+		if strings.HasPrefix(name, dir) {
+			sname := strings.SplitN(name[len(dir):], "/", 2)[0]
+			return kwfs.secretVisible(sname, context, versions)
+		}
+	}
+	return true
+}
+
+// splitSecretPath splits a path relative to a directory of per-secret directories, such as
+// .versions, into a secret name and a file name. The file name is empty for the secret's directory
+// itself, and paths nested any deeper yield an empty secret name.
+func splitSecretPath(path string) (name, file string) {
+	parts := strings.Split(path, "/")
+	switch len(parts) {
+	case 1:
+		return parts[0], ""
+	case 2:
+		return parts[0], parts[1]
+	}
+	return "", ""
+}
+
+// versionAttr constructs a fuse.Attr for a path relative to .versions.
+func (kwfs KeywhizFs) versionAttr(path string, versions *VersionIndex) *fuse.Attr {
+	sname, id := splitSecretPath(path)
+	switch {
+	case sname == "":
+		return nil
+	case id == "":
+		if all := versions.Versions(sname); len(all) > 0 {
+			return kwfs.secretDirAttr(&all[len(all)-1].Secret)
+		}
+	case id == currentVersionLink:
+		if current, ok := versions.Current(sname); ok {
+			return kwfs.linkAttr(current)
+		}
+	default:
+		secret, ok := versions.Version(sname, id)
+		defer secret.Release()
+		if ok {
+			return kwfs.secretAttr(secret)
+		}
+	}
+	return nil
+}
+
+// versionsDirListing produces directory entries for the versions of a secret, along with the
+// `current` link.
+func (kwfs KeywhizFs) versionsDirListing(sname string, index *VersionIndex) []fuse.DirEntry {
+	if strings.Contains(sname, "/") {
+		return nil
+	}
+	// Resolving the current version first makes sure it is part of the listing.
+	_, hasCurrent := index.Current(sname)
+	versions := index.Versions(sname)
+	if len(versions) == 0 {
+		return nil
+	}
+	entries := make([]fuse.DirEntry, 0, len(versions)+1)
+	for _, v := range versions {
+		entries = append(entries, fuse.DirEntry{Name: v.ID, Mode: fuse.S_IFREG})
+	}
+	if hasCurrent {
+		entries = append(entries, fuse.DirEntry{Name: currentVersionLink, Mode: fuse.S_IFLNK})
+	}
+	return entries
+}
+
+// field finds a field of a structured secret by its path relative to .fields, e.g.
+// "db.json/primary/password". The empty field path is the secret's top level. The secret is
+// returned without its content, and the node must be released.
+func (kwfs KeywhizFs) field(path string) (*Secret, *fieldNode, bool) {
+	sname, fieldPath := path, ""
+	if i := strings.Index(path, "/"); i >= 0 {
+		sname, fieldPath = path[:i], path[i+1:]
+	}
+	secret, ok := kwfs.Cache.Secret(sname)
+	defer secret.Release()
+	if !ok {
+		return nil, nil, false
+	}
+	root, ok := parseFields(secret.Content)
+	if !ok {
+		return nil, nil, false
+	}
+	node, ok := root.Lookup(fieldPath)
+	if !ok {
+		root.Release()
+		return nil, nil, false
+	}
+	root.releaseExcept(node)
+	metadata := secret.metadata()
+	return &metadata, node, true
+}
+
+// fieldAttr constructs a fuse.Attr for a field of a secret. Fields get the mode and ownership of
+// the secret; directories get execute permission wherever the secret is readable.
+func (kwfs KeywhizFs) fieldAttr(secret *Secret, node *fieldNode) *fuse.Attr {
+	if node.IsDir() {
+		return kwfs.secretDirAttr(secret)
+	}
+	attr := kwfs.secretAttr(secret)
+	attr.Size = uint64(len(node.value))
+	return attr
+}
+
+// fieldsDirListing produces directory entries for a path relative to .fields.
+func (kwfs KeywhizFs) fieldsDirListing(path string) []fuse.DirEntry {
+	_, node, ok := kwfs.field(path)
+	defer node.Release()
+	if !ok || !node.IsDir() {
+		return nil
+	}
+	entries := make([]fuse.DirEntry, 0, len(node.children))
+	for _, name := range node.Names() {
+		mode := uint32(fuse.S_IFREG)
+		if node.children[name].IsDir() {
+			mode = fuse.S_IFDIR
+		}
+		entries = append(entries, fuse.DirEntry{Name: name, Mode: mode})
+	}
+	return entries
+}
+
+// certBundle returns the certificate bundle held by a secret, along with the secret without its
+// content. The secret is fetched and parsed once, so callers should pass the result along rather
+// than call certBundle again. The bundle must be released.
+func (kwfs KeywhizFs) certBundle(sname string) (*Secret, *CertBundle, bool) {
+	if sname == "" || strings.Contains(sname, "/") {
+		return nil, nil, false
+	}
+	secret, ok := kwfs.Cache.Secret(sname)
+	defer secret.Release()
+	if !ok {
+		return nil, nil, false
+	}
+	bundle, ok := parseCertBundle(secret.Content)
+	if !ok {
+		return nil, nil, false
+	}
+	metadata := secret.metadata()
+	return &metadata, bundle, true
+}
+
+// certAttr constructs a fuse.Attr for a file of a certificate bundle, or its directory when fname
+// is empty. Files have the ownership of the secret, and only the private key keeps the secret's
+// mode; certificates are public.
+func (kwfs KeywhizFs) certAttr(secret *Secret, files map[string][]byte, fname string) *fuse.Attr {
+	if fname == "" {
+		return kwfs.secretDirAttr(secret)
+	}
+	attr := kwfs.secretAttr(secret)
+	switch {
+	case files[fname] == nil:
+		return nil
+	case fname != bundleKeyFile:
+		attr.Mode = fuse.S_IFREG | 0444
+	}
+	attr.Size = uint64(len(files[fname]))
+	return attr
+}
+
+// secretDirAttr constructs a fuse.Attr for a directory derived from a secret. It has the ownership
+// of the secret, and execute permission wherever the secret is readable.
+func (kwfs KeywhizFs) secretDirAttr(s *Secret) *fuse.Attr {
+	attr := kwfs.secretAttr(s)
+	perm := attr.Mode &^ fuse.S_IFREG
+	attr.Mode = fuse.S_IFDIR | perm | (perm&0444)>>2
+	attr.Size = 4096
+	attr.Nlink = 2
+	return attr
+}
+
 // secretAttr constructs a fuse.Attr based on a given Secret.
 func (kwfs KeywhizFs) secretAttr(s *Secret) *fuse.Attr {
 	created := uint64(s.CreatedAt.Unix())
+	size := s.Length
+	if len(s.Content) > 0 {
+		// Content, when known, is what reads return.
+		size = uint64(len(s.Content))
+	}
 	attr := &fuse.Attr{
-		Size: s.Length,
+		Size: size,
 		// The resolution for nsec time (uint32) is too small.
 		Atime: created,
 		Mtime: created,
 		Ctime: created,
-		Mode:  s.ModeValue(),
+		Mode:  kwfs.secretMode(s) | unix.S_IFREG,
 		Nlink: 1,
 	}
 
-	attr.Uid = kwfs.Ownership.Uid
-	attr.Gid = kwfs.Ownership.Gid
+	attr.Uid, attr.Gid = kwfs.secretOwnership(s)
+	return attr
+}
 
-	if s.Owner != "" {
-		attr.Uid = lookupUid(s.Owner)
-	}
-	if s.Group != "" {
-		attr.Gid = lookupGid(s.Group)
+// translateAttr translates the ownership of attr for the caller.
+func (kwfs KeywhizFs) translateAttr(attr *fuse.Attr, context *fuse.Context) {
+	var pid uint32
+	if context != nil {
+		pid = context.Pid
 	}
+	kwfs.IDs.Translate(attr, pid)
+}
+
+// linkAttr constructs a symlink fuse.Attr pointing to target.
+func (kwfs KeywhizFs) linkAttr(target string) *fuse.Attr {
+	attr := kwfs.fileAttr(uint64(len(target)), 0777)
+	attr.Mode = fuse.S_IFLNK | 0777
 	return attr
 }
 
+// missingSecret returns the status for a secret the cache didn't return. If its cached content was
+// refused as stale, that is an I/O error unless the cache's stale policy reports it missing.
+func (kwfs KeywhizFs) missingSecret(name string) fuse.Status {
+	if kwfs.Cache.Stale(name) && !kwfs.Cache.stale.NotFound {
+		return fuse.EIO
+	}
+	return fuse.ENOENT
+}
+
 // fileAttr constructs a generic file fuse.Attr with the given parameters.
 func (kwfs KeywhizFs) fileAttr(size uint64, mode uint32) *fuse.Attr {
 	created := uint64(kwfs.StartTime.Unix())
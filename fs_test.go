@@ -17,6 +17,8 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
@@ -43,11 +45,11 @@ type FsTestSuite struct {
 }
 
 func (suite *FsTestSuite) SetupTest() {
-	timeouts := Timeouts{0, 10 * time.Millisecond, 20 * time.Millisecond, 1 * time.Hour}
+	timeouts := Timeouts{0, time.Second, 2 * time.Second, 1 * time.Hour}
 	metricsHandle := setupMetrics(metricsURL, metricsPrefix, *mountpoint)
 	client := NewClient(clientFile, clientFile, testCaFile, suite.url, timeouts.MaxWait, logConfig, metricsHandle)
 	ownership := Ownership{Uid: _SomeUID, Gid: _SomeUID}
-	kwfs, _, _ := NewKeywhizFs(&client, ownership, timeouts, metricsHandle, logConfig)
+	kwfs, _, _ := NewKeywhizFs(&client, &client, ownership, timeouts, metricsHandle, logConfig)
 	suite.fs = kwfs
 }
 
@@ -109,8 +111,8 @@ func (suite *FsTestSuite) TestFileAttrs() {
 	}{
 		{"hmac.key", hmacSecret.Content, 0440 | fuse.S_IFREG},
 		{"Nobody_PgPass", nobodySecret.Content, 0400 | fuse.S_IFREG},
-		{".json/secret/hmac.key", hmacSecretData, 0400 | fuse.S_IFREG},
-		{".json/secret/Nobody_PgPass", nobodySecretData, 0400 | fuse.S_IFREG},
+		{".json/secret/hmac.key", withModes(hmacSecretData, "0440", "0440"), 0400 | fuse.S_IFREG},
+		{".json/secret/Nobody_PgPass", withModes(nobodySecretData, "0400", "0400"), 0400 | fuse.S_IFREG},
 		{".json/secrets", secretListData, 0400 | fuse.S_IFREG},
 	}
 
@@ -206,14 +208,16 @@ func (suite *FsTestSuite) TestOpen() {
 	}{
 		{"hmac.key", hmacSecret.Content},
 		{"Nobody_PgPass", nobodySecret.Content},
-		{".json/secret/hmac.key", hmacSecretData},
-		{".json/secret/Nobody_PgPass", nobodySecretData},
+		{".json/secret/hmac.key", withModes(hmacSecretData, "0440", "0440")},
+		{".json/secret/Nobody_PgPass", withModes(nobodySecretData, "0400", "0400")},
 		{".json/secrets", secretListData},
 	}
 
 	for _, c := range cases {
 		file, status := suite.fs.Open(c.filename, 0, fuseContext)
-		assert.Equal(fuse.OK, status, "Expected %v open status to be fuse.OK", c.filename)
+		if status != fuse.OK || file == nil {
+			suite.T().Fatalf("Expected %v open status to be fuse.OK, got %v", c.filename, status)
+		}
 		assert.Equal(c.content, read(file), "Expected %v file content to match", c.filename)
 	}
 }
@@ -237,6 +241,52 @@ func (suite *FsTestSuite) TestOpenBadFiles() {
 	}
 }
 
+// Directories of the derived views: .versions, .fields, .x509 and .env.
+var derivedDirs = []string{".versions", ".fields", ".x509", ".env"}
+
+func (suite *FsTestSuite) TestDerivedDirs() {
+	assert := suite.assert
+
+	for _, dir := range derivedDirs {
+		attr, status := suite.fs.GetAttr(dir, nil)
+		assert.Equal(fuse.OK, status, "Expected %v attr status to be fuse.OK", dir)
+		assert.EqualValues(0755|fuse.S_IFDIR, attr.Mode, "Expected %v mode %#o, was %#o", dir, 0755|fuse.S_IFDIR, attr.Mode)
+		assert.EqualValues(4096, attr.Size, "Expected %v size 4096, was %d", dir, attr.Size)
+
+		_, status = suite.fs.Open(dir, 0, fuseContext)
+		assert.Equal(fuseEISDIR, status, "Expected %v open status to match", dir)
+	}
+
+	entries, status := suite.fs.OpenDir("", fuseContext)
+	assert.Equal(fuse.OK, status)
+	listed := make(map[string]bool)
+	for _, entry := range entries {
+		listed[entry.Name] = entry.Mode&fuse.S_IFDIR == fuse.S_IFDIR
+	}
+	for _, dir := range derivedDirs {
+		assert.True(listed[dir], "Expected %v to be listed as a directory", dir)
+	}
+}
+
+func (suite *FsTestSuite) TestOpenBadDerivedFiles() {
+	assert := suite.assert
+
+	cases := []struct {
+		filename string
+		status   fuse.Status
+	}{
+		{".fields/hmac.key", fuse.ENOENT},
+		{".x509/hmac.key/cert.pem", fuse.ENOENT},
+		{".env/non-existent", fuse.ENOENT},
+		{".versions/non-existent/0be68f903f8b7d86", fuse.ENOENT},
+	}
+
+	for _, c := range cases {
+		_, status := suite.fs.Open(c.filename, 0, fuseContext)
+		assert.Equal(c.status, status, "Expected %v open status to match", c.filename)
+	}
+}
+
 func (suite *FsTestSuite) TestOpenDir() {
 	assert := suite.assert
 
@@ -275,6 +325,11 @@ func (suite *FsTestSuite) TestOpenDir() {
 		},
 	}
 
+	// The root also lists the derived views, checked by TestDerivedDirs.
+	for _, dir := range derivedDirs {
+		cases[0].contents[dir] = false
+	}
+
 	for _, c := range cases {
 		fsEntries, status := suite.fs.OpenDir(c.directory, fuseContext)
 		assert.Equal(fuse.OK, status)
@@ -339,3 +394,65 @@ func (suite *FsTestSuite) TestString() {
 	assert := suite.assert
 	assert.Equal(suite.fs.String(), "keywhiz-fs")
 }
+
+func TestFsAttrsFromListing(t *testing.T) {
+	assert := assert.New(t)
+
+	// The listed length is stale: the content is one byte longer.
+	backend := &CountingBackend{SecretBackend: NewMapBackend(Secret{Name: "foo", Content: content("hunter2"), Length: 6})}
+	timeouts := Timeouts{0, time.Second, 2 * time.Second, time.Hour}
+	kwfs, _, err := NewKeywhizFs(nil, backend, Ownership{Uid: 1000, Gid: 1000}, timeouts, nil, logConfig)
+	assert.NoError(err)
+	kwfs.Cache.Warmup()
+
+	attr, status := kwfs.GetAttr("foo", &fuse.Context{})
+	assert.Equal(fuse.OK, status)
+	assert.EqualValues(6, attr.Size)
+	assert.Equal(0, backend.Calls("foo"), "attributes should not fetch content")
+
+	file, status := kwfs.Open("foo", 0, &fuse.Context{})
+	assert.Equal(fuse.OK, status)
+	assert.NotZero(backend.Calls("foo"))
+	var fileAttr fuse.Attr
+	assert.Equal(fuse.OK, file.GetAttr(&fileAttr))
+	assert.EqualValues(7, fileAttr.Size, "the size of open files should match their content")
+	attr, _ = kwfs.GetAttr("foo", &fuse.Context{})
+	assert.EqualValues(7, attr.Size)
+}
+
+func TestFsStaleSecrets(t *testing.T) {
+	assert := assert.New(t)
+
+	timeouts := Timeouts{0, time.Second, 2 * time.Second, time.Hour}
+	kwfs, _, err := NewKeywhizFs(nil, FailingBackend{}, Ownership{Uid: 1000, Gid: 1000}, timeouts, nil, logConfig)
+	assert.NoError(err)
+	kwfs.Cache.SetStalePolicy(StalePolicy{MaxStale: time.Nanosecond})
+	kwfs.Cache.Add(Secret{Name: "foo", Content: content("hunter2")})
+	time.Sleep(time.Millisecond)
+
+	_, status := kwfs.GetAttr("foo", &fuse.Context{})
+	assert.Equal(fuse.EIO, status)
+	_, status = kwfs.Open("foo", 0, &fuse.Context{})
+	assert.Equal(fuse.EIO, status)
+	_, status = kwfs.GetAttr("bar", &fuse.Context{})
+	assert.Equal(fuse.ENOENT, status)
+
+	kwfs.Cache.stale.NotFound = true
+	_, status = kwfs.Open("foo", 0, &fuse.Context{})
+	assert.Equal(fuse.ENOENT, status)
+
+	var info StatusInfo
+	assert.NoError(json.Unmarshal(kwfs.statusJSON(), &info))
+	if assert.Len(info.SecretStaleness, 1) {
+		assert.Equal("foo", info.SecretStaleness[0].Name)
+		assert.True(info.SecretStaleness[0].Stale)
+	}
+}
+
+// withModes returns the JSON of a secret as served under .json/secret, with the mode it is served
+// with and the one set on the server.
+func withModes(data []byte, effective, requested string) []byte {
+	body := bytes.TrimSpace(data)
+	body = bytes.TrimSpace(body[:len(body)-1])
+	return append(body, `,"effectiveMode":"`+effective+`","requestedMode":"`+requested+`"}`...)
+}
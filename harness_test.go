@@ -0,0 +1,194 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/stretchr/testify/assert"
+)
+
+// fsHarness mounts a KeywhizFs in-process on a temporary directory, serving secrets from an
+// arbitrary SecretBackend. Tests must call Close, which always tears down the mount.
+type fsHarness struct {
+	t        *testing.T
+	dir      string
+	fs       *KeywhizFs
+	server   *fuse.Server
+	maxProcs int
+}
+
+// newFsHarness mounts a KeywhizFs backed by backend. The test is skipped if FUSE isn't usable in
+// this environment.
+func newFsHarness(t *testing.T, backend SecretBackend) *fsHarness {
+	if f, err := os.OpenFile("/dev/fuse", os.O_RDWR, 0); err != nil {
+		t.Skipf("FUSE is not available: %v", err)
+	} else {
+		f.Close()
+	}
+	if _, err := exec.LookPath("fusermount"); err != nil {
+		t.Skipf("FUSE is not available: %v", err)
+	}
+
+	dir, err := ioutil.TempDir("", "kwfs-harness")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	timeouts := Timeouts{0, 100 * time.Millisecond, 200 * time.Millisecond, 1 * time.Hour}
+	ownership := Ownership{Uid: uint32(os.Getuid()), Gid: uint32(os.Getgid())}
+	kwfs, root, err := NewKeywhizFs(nil, backend, ownership, timeouts, nil, logConfig)
+	if err != nil {
+		os.Remove(dir)
+		t.Fatal(err)
+	}
+
+	// Requests from this process are served by this process. With a single P, a goroutine blocked
+	// in the kernel on a FUSE request can starve the goroutines that would answer it.
+	maxProcs := runtime.GOMAXPROCS(0)
+	if maxProcs < 2 {
+		runtime.GOMAXPROCS(2)
+	}
+
+	conn := nodefs.NewFileSystemConnector(root, &nodefs.Options{})
+	server, err := fuse.NewServer(conn.RawFS(), dir, &fuse.MountOptions{Name: kwfs.String()})
+	if err != nil {
+		runtime.GOMAXPROCS(maxProcs)
+		os.Remove(dir)
+		t.Skipf("Unable to mount FUSE filesystem: %v", err)
+	}
+	go server.Serve()
+	h := &fsHarness{t, dir, kwfs, server, maxProcs}
+	if err := server.WaitMount(); err != nil {
+		h.Close()
+		t.Fatal(err)
+	}
+
+	if err := h.disablePoll(); err != nil {
+		h.Close()
+		t.Fatal(err)
+	}
+	return h
+}
+
+// disablePoll makes the kernel learn that the filesystem doesn't support poll. Otherwise, opening
+// a file on the mount from this process registers it with the Go runtime's epoll instance, and
+// the resulting FUSE poll request deadlocks against the runtime.
+func (h *fsHarness) disablePoll() error {
+	fd, err := syscall.Open(h.Path(".version"), syscall.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(epfd)
+
+	// The filesystem answers ENOSYS, after which the kernel stops forwarding poll requests. The
+	// error returned here doesn't matter. syscall.EpollCtl is a raw syscall, which keeps its P
+	// while blocked on the FUSE request and can deadlock a stop-the-world, so Syscall6 is used.
+	event := syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(fd)}
+	syscall.Syscall6(syscall.SYS_EPOLL_CTL, uintptr(epfd), syscall.EPOLL_CTL_ADD, uintptr(fd), uintptr(unsafe.Pointer(&event)), 0, 0)
+	return nil
+}
+
+// Close unmounts the filesystem and removes the mountpoint.
+func (h *fsHarness) Close() {
+	var err error
+	for i := 0; i < 10; i++ {
+		// Unmounting fails while the kernel still holds references, e.g. just after a read.
+		if err = h.server.Unmount(); err == nil {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if err != nil {
+		h.t.Errorf("Unable to unmount %s: %v", h.dir, err)
+		exec.Command("fusermount", "-u", "-z", h.dir).Run()
+	}
+	os.Remove(h.dir)
+	runtime.GOMAXPROCS(h.maxProcs)
+}
+
+// Path returns the absolute path of name in the mount.
+func (h *fsHarness) Path(name string) string {
+	return filepath.Join(h.dir, name)
+}
+
+// Read returns the content of a file in the mount.
+func (h *fsHarness) Read(name string) ([]byte, error) {
+	return ioutil.ReadFile(h.Path(name))
+}
+
+// Stat returns information about a file in the mount.
+func (h *fsHarness) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(h.Path(name))
+}
+
+// List returns the sorted names of the entries of a directory in the mount.
+func (h *fsHarness) List(name string) ([]string, error) {
+	infos, err := ioutil.ReadDir(h.Path(name))
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(infos))
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func TestHarnessServesSecrets(t *testing.T) {
+	assert := assert.New(t)
+
+	secret, _ := ParseSecret(fixture("secretNormalOwner.json"))
+	h := newFsHarness(t, NewMapBackend(*secret))
+	defer h.Close()
+
+	names, err := h.List("")
+	assert.NoError(err)
+	assert.Equal([]string{".clear_cache", ".env", ".fields", ".json", ".pprof", ".running", ".version", ".versions", ".x509", secret.Name}, names)
+
+	info, err := h.Stat(secret.Name)
+	assert.NoError(err)
+	assert.EqualValues(len(secret.Content), info.Size())
+	assert.Equal(os.FileMode(0440), info.Mode())
+
+	data, err := h.Read(secret.Name)
+	assert.NoError(err)
+	assert.EqualValues(secret.Content, data)
+
+	_, err = h.Stat("non-existent")
+	assert.True(os.IsNotExist(err))
+
+	// Without a client, the server passthrough files don't exist.
+	_, err = h.Stat(".json/secrets")
+	assert.True(os.IsNotExist(err))
+}
@@ -0,0 +1,179 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"os/user"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// identityFileCheckInterval is how often the identity cache checks whether the local user and
+// group databases changed.
+const identityFileCheckInterval = time.Second
+
+// identity is a cached user or group lookup, successful or not.
+type identity struct {
+	id      uint32
+	err     error
+	expires time.Time
+}
+
+// identityKey identifies a cached lookup of a user or group.
+type identityKey struct {
+	group bool
+	name  string
+}
+
+// fileVersion identifies a version of a file, to notice when it changes.
+type fileVersion struct {
+	modTime time.Time
+	size    int64
+}
+
+// IdentityCache resolves user and group names to ids through the system's name service (NSS), so
+// that users and groups from LDAP or SSSD resolve as well as local ones. Lookups, including
+// failed ones, are cached for a TTL, and all of them are forgotten when one of the local user and
+// group databases changes.
+type IdentityCache struct {
+	files       []string
+	lookupUser  func(string) (string, error)
+	lookupGroup func(string) (string, error)
+
+	lock     sync.Mutex
+	ttl      time.Duration
+	cached   map[identityKey]identity
+	versions map[string]fileVersion
+	checked  time.Time
+	failures uint64
+}
+
+// NewIdentityCache initializes an IdentityCache keeping lookups for ttl, or until one of files
+// changes. A zero ttl disables caching.
+func NewIdentityCache(ttl time.Duration, files ...string) *IdentityCache {
+	return &IdentityCache{
+		files: files,
+		lookupUser: func(name string) (string, error) {
+			u, err := user.Lookup(name)
+			if err != nil {
+				return "", err
+			}
+			return u.Uid, nil
+		},
+		lookupGroup: func(name string) (string, error) {
+			g, err := user.LookupGroup(name)
+			if err != nil {
+				return "", err
+			}
+			return g.Gid, nil
+		},
+		ttl:      ttl,
+		cached:   make(map[identityKey]identity),
+		versions: make(map[string]fileVersion),
+	}
+}
+
+// NewSystemIdentityCache initializes an IdentityCache for the local users and groups, keeping
+// lookups for ttl or until /etc/passwd or /etc/group change.
+func NewSystemIdentityCache(ttl time.Duration) *IdentityCache {
+	return NewIdentityCache(ttl, "/etc/passwd", "/etc/group")
+}
+
+// SetTTL changes how long lookups are kept, forgetting those already cached.
+func (c *IdentityCache) SetTTL(ttl time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.ttl = ttl
+	c.clear()
+}
+
+// User resolves a username to a numeric id.
+func (c *IdentityCache) User(name string) (uint32, error) {
+	return c.lookup(identityKey{false, name}, c.lookupUser)
+}
+
+// Group resolves a groupname to a numeric id.
+func (c *IdentityCache) Group(name string) (uint32, error) {
+	return c.lookup(identityKey{true, name}, c.lookupGroup)
+}
+
+// Failures returns the number of lookups which failed, not counting those answered from the cache.
+func (c *IdentityCache) Failures() uint64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.failures
+}
+
+func (c *IdentityCache) lookup(key identityKey, resolve func(string) (string, error)) (uint32, error) {
+	now := time.Now()
+	c.lock.Lock()
+	c.checkFiles(now)
+	cached, ok := c.cached[key]
+	c.lock.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.id, cached.err
+	}
+
+	// Name service lookups may be slow, so they are made without holding the lock.
+	var result identity
+	id, err := resolve(key.name)
+	if err == nil {
+		var parsed uint64
+		parsed, err = strconv.ParseUint(id, 10 /* base */, 32 /* bits */)
+		result.id = uint32(parsed)
+	}
+	result.err = err
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	result.expires = now.Add(c.ttl)
+	if err != nil {
+		c.failures++
+	}
+	if c.ttl > 0 {
+		c.cached[key] = result
+	}
+	return result.id, result.err
+}
+
+// checkFiles forgets cached lookups if one of the watched files changed since last checked. The
+// lock must be held.
+func (c *IdentityCache) checkFiles(now time.Time) {
+	if now.Sub(c.checked) < identityFileCheckInterval {
+		return
+	}
+	c.checked = now
+	changed := false
+	for _, file := range c.files {
+		var version fileVersion
+		if info, err := os.Stat(file); err == nil {
+			version = fileVersion{info.ModTime(), info.Size()}
+		}
+		if previous, ok := c.versions[file]; ok && previous != version {
+			changed = true
+		}
+		c.versions[file] = version
+	}
+	if changed {
+		c.clear()
+	}
+}
+
+// clear forgets all cached lookups. The lock must be held.
+func (c *IdentityCache) clear() {
+	c.cached = make(map[identityKey]identity)
+}
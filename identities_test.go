@@ -0,0 +1,107 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// countingIdentityCache returns an IdentityCache resolving names from ids, and the number of
+// lookups made by name.
+func countingIdentityCache(ttl time.Duration, ids map[string]string, files ...string) (*IdentityCache, map[string]int) {
+	lookups := make(map[string]int)
+	lookup := func(name string) (string, error) {
+		lookups[name]++
+		if id, ok := ids[name]; ok {
+			return id, nil
+		}
+		return "", errors.New("unknown")
+	}
+	c := NewIdentityCache(ttl, files...)
+	c.lookupUser = lookup
+	c.lookupGroup = lookup
+	return c, lookups
+}
+
+func TestIdentityCacheLookups(t *testing.T) {
+	assert := assert.New(t)
+
+	c, lookups := countingIdentityCache(time.Hour, map[string]string{"app": "1234", "invalid": "x"})
+	for i := 0; i < 3; i++ {
+		uid, err := c.User("app")
+		assert.NoError(err)
+		assert.EqualValues(1234, uid)
+		gid, err := c.Group("app")
+		assert.NoError(err)
+		assert.EqualValues(1234, gid)
+		_, err = c.User("missing")
+		assert.Error(err)
+		_, err = c.Group("invalid")
+		assert.Error(err)
+	}
+	// Users and groups are cached separately, successful or not.
+	assert.Equal(map[string]int{"app": 2, "missing": 1, "invalid": 1}, lookups)
+	assert.EqualValues(2, c.Failures())
+
+	c.SetTTL(0)
+	c.User("app")
+	c.User("app")
+	assert.Equal(4, lookups["app"])
+}
+
+func TestIdentityCacheExpires(t *testing.T) {
+	assert := assert.New(t)
+
+	c, lookups := countingIdentityCache(10*time.Millisecond, map[string]string{"app": "1234"})
+	c.User("app")
+	c.User("missing")
+	time.Sleep(20 * time.Millisecond)
+	c.User("app")
+	c.User("missing")
+	assert.Equal(map[string]int{"app": 2, "missing": 2}, lookups)
+}
+
+func TestIdentityCacheRefreshesOnFileChange(t *testing.T) {
+	assert := assert.New(t)
+
+	file, err := ioutil.TempFile("", "keywhiz-fs-test")
+	panicOnError(err)
+	defer os.Remove(file.Name())
+
+	ids := map[string]string{"app": "1234"}
+	c, lookups := countingIdentityCache(time.Hour, ids, file.Name())
+	c.User("app")
+	c.User("new")
+
+	// Changes are noticed once the files are checked again.
+	ids["app"] = "1235"
+	ids["new"] = "1236"
+	file.WriteString("app:x:1235:\nnew:x:1236:\n")
+	file.Sync()
+	c.checked = time.Time{}
+
+	uid, _ := c.User("app")
+	assert.EqualValues(1235, uid)
+	uid, err = c.User("new")
+	assert.NoError(err)
+	assert.EqualValues(1236, uid)
+	assert.Equal(map[string]int{"app": 2, "new": 2}, lookups)
+}
@@ -0,0 +1,337 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package fakeserver implements an in-process fake Keywhiz server for tests. Secrets are managed
+// through the Server methods, and every request made to the server is recorded. There is no admin
+// API over HTTP: tests run the server in their own process, and keywhiz-fs only needs the Keywhiz
+// API, so an unauthenticated admin endpoint would only add surface.
+package fakeserver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Secret is a secret stored in the fake server.
+type Secret struct {
+	// ID is assigned by the server when the secret is added.
+	ID        int64
+	Name      string
+	Content   []byte
+	Mode      string
+	Owner     string
+	Group     string
+	CreatedAt time.Time
+	Versioned bool
+}
+
+// secretJSON is the wire format used by Keywhiz for a secret.
+type secretJSON struct {
+	ID           int64  `json:"id"`
+	Name         string `json:"name"`
+	Secret       string `json:"secret"`
+	SecretLength int    `json:"secretLength"`
+	CreationDate string `json:"creationDate"`
+	IsVersioned  bool   `json:"isVersioned"`
+	Mode         string `json:"mode,omitempty"`
+	Owner        string `json:"owner,omitempty"`
+	Group        string `json:"group,omitempty"`
+}
+
+// Request is a request received by the server.
+type Request struct {
+	Method     string
+	Path       string
+	ClientName string
+	Status     int
+	Time       time.Time
+}
+
+// Config contains the TLS material used by a Server.
+type Config struct {
+	// CertFile and KeyFile hold the server's PEM-encoded certificate and key. They may be the
+	// same file.
+	CertFile string
+	KeyFile  string
+	// ClientCAFile holds the CAs trusted to sign client certificates. Client certificates are
+	// required and verified when set.
+	ClientCAFile string
+}
+
+// Server is a fake Keywhiz server listening on a random local port.
+type Server struct {
+	// URL is the base URL of the server, e.g. https://127.0.0.1:41234/
+	URL string
+
+	server   *httptest.Server
+	lock     sync.Mutex
+	secrets  map[string]Secret
+	requests []Request
+	latency  time.Duration
+	status   int
+	failing  map[string][]int
+	nextID   int64
+}
+
+// New starts a Server with the given TLS configuration.
+func New(config Config) (*Server, error) {
+	cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if config.ClientCAFile != "" {
+		data, err := ioutil.ReadFile(config.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, errors.New("no certificates found in client CA file")
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	s := &Server{secrets: make(map[string]Secret), failing: make(map[string][]int)}
+	s.server = httptest.NewUnstartedServer(http.HandlerFunc(s.serveHTTP))
+	s.server.TLS = tlsConfig
+	s.server.StartTLS()
+	s.URL = s.server.URL + "/"
+	return s, nil
+}
+
+// Close shuts down the server.
+func (s *Server) Close() {
+	s.server.Close()
+}
+
+// Addr returns the host:port the server is listening on.
+func (s *Server) Addr() string {
+	return s.server.Listener.Addr().String()
+}
+
+// Port returns the port the server is listening on.
+func (s *Server) Port() string {
+	_, port, _ := net.SplitHostPort(s.Addr())
+	return port
+}
+
+// Add stores a secret with a new id, replacing any secret with the same name.
+func (s *Server) Add(secret Secret) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.nextID++
+	secret.ID = s.nextID
+	if secret.CreatedAt.IsZero() {
+		secret.CreatedAt = time.Now()
+	}
+	s.secrets[secret.Name] = secret
+}
+
+// Update replaces the content of an existing secret, keeping its other attributes.
+func (s *Server) Update(name string, content []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	secret, ok := s.secrets[name]
+	if !ok {
+		return fmt.Errorf("no secret named %s", name)
+	}
+	secret.Content = content
+	s.secrets[name] = secret
+	return nil
+}
+
+// Rotate replaces the content of an existing secret the way Keywhiz operators usually do: the
+// secret is deleted right away, and recreated with a new id and creation date when recreate is
+// called. The secret is missing from listings and lookups until then.
+func (s *Server) Rotate(name string, content []byte) (recreate func(), err error) {
+	s.lock.Lock()
+	secret, ok := s.secrets[name]
+	delete(s.secrets, name)
+	s.lock.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("no secret named %s", name)
+	}
+
+	secret.Content = content
+	secret.CreatedAt = time.Time{}
+	return func() { s.Add(secret) }, nil
+}
+
+// Delete removes a secret.
+func (s *Server) Delete(name string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.secrets, name)
+}
+
+// SetLatency delays every response by d.
+func (s *Server) SetLatency(d time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.latency = d
+}
+
+// SetOutage makes every request fail with the given HTTP status. A status of 0 ends the outage.
+func (s *Server) SetOutage(status int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.status = status
+}
+
+// FailNext makes the next n requests to path fail with the given HTTP status.
+func (s *Server) FailNext(path string, status, n int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for i := 0; i < n; i++ {
+		s.failing[path] = append(s.failing[path], status)
+	}
+}
+
+// Requests returns every request received so far.
+func (s *Server) Requests() []Request {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]Request(nil), s.requests...)
+}
+
+// Answered returns whether a request for path was answered with status.
+func (s *Server) Answered(path string, status int) bool {
+	for _, r := range s.Requests() {
+		if r.Path == path && r.Status == status {
+			return true
+		}
+	}
+	return false
+}
+
+// RequestCount returns the number of requests received for path.
+func (s *Server) RequestCount(path string) int {
+	count := 0
+	for _, r := range s.Requests() {
+		if r.Path == path {
+			count++
+		}
+	}
+	return count
+}
+
+// ResetRequests clears the recorded requests.
+func (s *Server) ResetRequests() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.requests = nil
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	latency := s.latency
+	s.lock.Unlock()
+	time.Sleep(latency)
+
+	status, body := s.respond(r)
+
+	s.lock.Lock()
+	request := Request{Method: r.Method, Path: r.URL.Path, Status: status, Time: time.Now()}
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		request.ClientName = r.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	s.requests = append(s.requests, request)
+	s.lock.Unlock()
+
+	if status != http.StatusOK {
+		w.WriteHeader(status)
+		fmt.Fprintf(w, "<html><body>HTTP ERROR %d</body></html>\n", status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// respond computes the response to a request.
+func (s *Server) respond(r *http.Request) (int, []byte) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.status != 0 {
+		return s.status, nil
+	}
+	if failing := s.failing[r.URL.Path]; len(failing) > 0 {
+		s.failing[r.URL.Path] = failing[1:]
+		return failing[0], nil
+	}
+	if r.Method != "GET" {
+		return http.StatusMethodNotAllowed, nil
+	}
+
+	switch {
+	case r.URL.Path == "/_status":
+		return http.StatusOK, []byte(`{"status":"ok"}`)
+	case r.URL.Path == "/secrets":
+		names := make([]string, 0, len(s.secrets))
+		for name := range s.secrets {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		list := make([]secretJSON, 0, len(names))
+		for _, name := range names {
+			secret := toJSON(s.secrets[name])
+			secret.Secret = ""
+			list = append(list, secret)
+		}
+		return marshal(list)
+	case strings.HasPrefix(r.URL.Path, "/secret/"):
+		secret, ok := s.secrets[strings.TrimPrefix(r.URL.Path, "/secret/")]
+		if !ok {
+			return http.StatusNotFound, nil
+		}
+		return marshal(toJSON(secret))
+	}
+	return http.StatusNotFound, nil
+}
+
+func toJSON(secret Secret) secretJSON {
+	return secretJSON{
+		ID:           secret.ID,
+		Name:         secret.Name,
+		Secret:       base64.StdEncoding.EncodeToString(secret.Content),
+		SecretLength: len(secret.Content),
+		CreationDate: secret.CreatedAt.UTC().Format("2006-01-02T15:04:05.000Z"),
+		IsVersioned:  secret.Versioned,
+		Mode:         secret.Mode,
+		Owner:        secret.Owner,
+		Group:        secret.Group,
+	}
+}
+
+func marshal(v interface{}) (int, []byte) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return http.StatusInternalServerError, nil
+	}
+	return http.StatusOK, data
+}
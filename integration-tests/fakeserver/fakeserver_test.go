@@ -0,0 +1,157 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fakeserver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	serverFile   = "../../fixtures/localhost.crt"
+	clientFile   = "../../fixtures/client.pem"
+	clientCAFile = "../../fixtures/cacert.crt"
+)
+
+func newTestServer(t *testing.T) *Server {
+	server, err := New(Config{CertFile: serverFile, KeyFile: serverFile, ClientCAFile: clientCAFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+func newTestClient(t *testing.T, withCert bool) *http.Client {
+	ca, err := ioutil.ReadFile(serverFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(ca)
+	config := &tls.Config{RootCAs: pool}
+	if withCert {
+		cert, err := tls.LoadX509KeyPair(clientFile, clientFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: config}, Timeout: 5 * time.Second}
+}
+
+func get(t *testing.T, client *http.Client, url string) (int, []byte) {
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, body
+}
+
+func TestServerServesSecrets(t *testing.T) {
+	assert := assert.New(t)
+	server := newTestServer(t)
+	defer server.Close()
+	client := newTestClient(t, true)
+
+	server.Add(Secret{Name: "foo", Content: []byte("bar"), Mode: "0400"})
+	server.Add(Secret{Name: "with space", Content: []byte("baz")})
+
+	status, body := get(t, client, server.URL+"secrets")
+	assert.Equal(200, status)
+	var list []secretJSON
+	assert.NoError(json.Unmarshal(body, &list))
+	assert.Len(list, 2)
+	assert.Equal("foo", list[0].Name)
+	assert.Empty(list[0].Secret, "listings should not contain content")
+	assert.Equal(3, list[0].SecretLength)
+
+	status, body = get(t, client, server.URL+"secret/foo")
+	assert.Equal(200, status)
+	var secret secretJSON
+	assert.NoError(json.Unmarshal(body, &secret))
+	assert.Equal("YmFy", secret.Secret)
+	assert.Equal("0400", secret.Mode)
+
+	status, _ = get(t, client, server.URL+"secret/with%20space")
+	assert.Equal(200, status)
+
+	// Rotation deletes the secret, leaving a gap in the listing, and recreates it with a new id.
+	recreate, err := server.Rotate("foo", []byte("new"))
+	assert.NoError(err)
+	_, body = get(t, client, server.URL+"secrets")
+	assert.NoError(json.Unmarshal(body, &list))
+	assert.Len(list, 1, "a rotated secret should be missing from listings until recreated")
+	recreate()
+	id := secret.ID
+	_, body = get(t, client, server.URL+"secret/foo")
+	assert.NoError(json.Unmarshal(body, &secret))
+	assert.Equal("bmV3", secret.Secret)
+	assert.NotEqual(id, secret.ID)
+
+	server.Delete("foo")
+	status, _ = get(t, client, server.URL+"secret/foo")
+	assert.Equal(404, status)
+	assert.Error(server.Update("foo", []byte("x")))
+
+	assert.Equal(3, server.RequestCount("/secret/foo"))
+	for _, r := range server.Requests() {
+		assert.Equal("client", r.ClientName)
+	}
+}
+
+func TestServerRequiresClientCertificate(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Close()
+
+	_, err := newTestClient(t, false).Get(server.URL + "secrets")
+	assert.Error(t, err)
+}
+
+func TestServerInjectsFaults(t *testing.T) {
+	assert := assert.New(t)
+	server := newTestServer(t)
+	defer server.Close()
+	client := newTestClient(t, true)
+	server.Add(Secret{Name: "foo", Content: []byte("bar")})
+
+	server.FailNext("/secret/foo", 500, 2)
+	status, _ := get(t, client, server.URL+"secret/foo")
+	assert.Equal(500, status)
+	assert.True(server.Answered("/secret/foo", 500))
+	assert.False(server.Answered("/secret/foo", 200))
+	status, _ = get(t, client, server.URL+"secret/foo")
+	assert.Equal(500, status)
+	status, _ = get(t, client, server.URL+"secret/foo")
+	assert.Equal(200, status)
+
+	server.SetOutage(503)
+	status, _ = get(t, client, server.URL+"secrets")
+	assert.Equal(503, status)
+	server.SetOutage(0)
+
+	server.SetLatency(50 * time.Millisecond)
+	start := time.Now()
+	get(t, client, server.URL+"secrets")
+	assert.True(time.Since(start) >= 50*time.Millisecond)
+}
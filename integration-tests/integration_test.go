@@ -1,102 +1,248 @@
-package main
+package integration
 
 import (
 	"io/ioutil"
-	"log"
+	"net/http"
 	"os"
 	"os/exec"
 	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
 	"testing"
 	"time"
 
+	"github.com/square/keywhiz-fs/integration-tests/fakeserver"
 	"github.com/stretchr/testify/assert"
 )
 
-var server *exec.Cmd
-var kwfs *exec.Cmd
+const (
+	serverFile   = "../fixtures/localhost.crt"
+	clientFile   = "../fixtures/client.pem"
+	clientCAFile = "../fixtures/cacert.crt"
 
-func TestIntegrationTest(t *testing.T) {
-	defer cleanup()
+	// How long to wait for keywhiz-fs to notice a change on the server.
+	eventuallyTimeout = 10 * time.Second
+)
 
-	assert := assert.New(t)
+// mount is a running keywhiz-fs process serving secrets from a fake server.
+type mount struct {
+	t      *testing.T
+	server *fakeserver.Server
+	dir    string
+	cmd    *exec.Cmd
+}
 
-	// start fake-server
-	server = exec.Command("./fake-server")
-	err := server.Start()
+// startMount starts a fake server and mounts keywhiz-fs against it. Extra flags are passed to
+// keywhiz-fs.
+func startMount(t *testing.T, secrets []fakeserver.Secret, flags ...string) *mount {
+	server, err := fakeserver.New(fakeserver.Config{CertFile: serverFile, KeyFile: serverFile, ClientCAFile: clientCAFile})
 	if err != nil {
 		t.Fatal(err)
 	}
+	for _, s := range secrets {
+		server.Add(s)
+	}
 
-	user, err := user.Current()
+	dir, err := ioutil.TempDir("", "kwfs-integration")
 	if err != nil {
+		server.Close()
 		t.Fatal(err)
 	}
 
-	// start keywhiz-fs
-	os.MkdirAll("./mount", 0755)
-	kwfs = exec.Command("../keywhiz-fs", "--cert", "kwfs.crt", "--key",
-		"kwfs.key", "--ca", "keywhiz.crt", "--debug", "--disable-mlock",
-		"--asuser", user.Username, "--group", lookupGroup(user.Gid),
-		"--cache-timeout", "1s", "https://localhost:8080/", "./mount")
-	kwfs.Stdout = os.Stdout
-	kwfs.Stderr = os.Stderr
-	err = kwfs.Start()
+	current, err := user.Current()
 	if err != nil {
-		t.Log(err)
-		t.Fail()
-		return
+		t.Fatal(err)
 	}
 
-	// check that ls returns the right data
-	time.Sleep(1 * time.Second)
-	files, err := ioutil.ReadDir("mount")
-	if err != nil {
-		t.Log(err)
-		t.Fail()
-		return
+	args := []string{"--cert", clientFile, "--key", clientFile, "--ca", serverFile,
+		"--debug", "--disable-mlock", "--asuser", current.Username, "--group", lookupGroup(current.Gid),
+		"--cache-timeout", "1s"}
+	args = append(args, flags...)
+	args = append(args, server.URL, dir)
+
+	cmd := exec.Command("../keywhiz-fs", args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		server.Close()
+		os.Remove(dir)
+		t.Fatal(err)
 	}
-	fileNames := make([]string, len(files))
-	for i, v := range files {
-		fileNames[i] = v.Name()
+
+	m := &mount{t, server, dir, cmd}
+	if !m.eventually(func() bool { return m.exists(".running") }) {
+		m.stop()
+		t.Fatal("keywhiz-fs did not mount")
 	}
-	// fileNames should contain: .clear_cache .json .running .version test_secret
-	assert.Contains(fileNames, "test_secret")
+	return m
+}
 
-	// check that cat returns the right data
-	content, err := ioutil.ReadFile("mount/test_secret")
-	if err != nil {
-		t.Log(err)
-		t.Fail()
-		return
+// stop terminates keywhiz-fs and the fake server, and removes the mountpoint.
+func (m *mount) stop() {
+	m.cmd.Process.Signal(os.Interrupt)
+	done := make(chan error, 1)
+	go func() { done <- m.cmd.Wait() }()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		m.cmd.Process.Kill()
+		exec.Command("fusermount", "-u", m.dir).Run()
 	}
-	assert.Equal([]byte("hello_1"), content)
+	m.server.Close()
+	os.Remove(m.dir)
+}
+
+func (m *mount) path(name string) string {
+	return filepath.Join(m.dir, name)
+}
 
-	// sleep 1
-	time.Sleep(1 * time.Second)
+func (m *mount) read(name string) ([]byte, error) {
+	return ioutil.ReadFile(m.path(name))
+}
 
-	// check that cat returns new data
-	content, err = ioutil.ReadFile("mount/test_secret")
-	if err != nil {
-		t.Log(err)
-		t.Fail()
-		return
+func (m *mount) exists(name string) bool {
+	_, err := os.Stat(m.path(name))
+	return err == nil
+}
+
+// answered reads name until the server answers a request for path with status, or
+// eventuallyTimeout elapses.
+func (m *mount) answered(name, path string, status int) bool {
+	return m.eventually(func() bool {
+		m.read(name)
+		return m.server.Answered(path, status)
+	})
+}
+
+// eventually polls condition until it holds or eventuallyTimeout elapses.
+func (m *mount) eventually(condition func() bool) bool {
+	deadline := time.Now().Add(eventuallyTimeout)
+	for time.Now().Before(deadline) {
+		if condition() {
+			return true
+		}
+		time.Sleep(100 * time.Millisecond)
 	}
-	assert.Equal([]byte("hello_2"), content)
+	return condition()
 }
 
-func cleanup() {
-	// terminate fake-server and kwfs
-	err := server.Process.Kill()
+func TestListAndRead(t *testing.T) {
+	assert := assert.New(t)
+	m := startMount(t, []fakeserver.Secret{{Name: "test_secret", Content: []byte("hello")}})
+	defer m.stop()
+
+	files, err := ioutil.ReadDir(m.dir)
 	if err != nil {
-		log.Fatal(err)
+		t.Fatal(err)
 	}
-	err = kwfs.Process.Kill()
-	if err != nil {
-		log.Fatal(err)
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name())
 	}
-	// kwfs should unmount on exit, but it doesn't?
-	err = exec.Command("fusermount", "-u", "mount").Run()
+	assert.Contains(names, "test_secret")
+
+	content, err := m.read("test_secret")
+	assert.NoError(err)
+	assert.Equal([]byte("hello"), content)
+	assert.NotZero(m.server.RequestCount("/secret/test_secret"))
+}
+
+func TestRotation(t *testing.T) {
+	assert := assert.New(t)
+	m := startMount(t, []fakeserver.Secret{{Name: "test_secret", Content: []byte("hello_1")}})
+	defer m.stop()
+
+	content, err := m.read("test_secret")
+	assert.NoError(err)
+	assert.Equal([]byte("hello_1"), content)
+
+	// The secret is missing from the server while it is recreated, and still served meanwhile.
+	recreate, err := m.server.Rotate("test_secret", []byte("hello_2"))
+	assert.NoError(err)
+	assert.True(m.answered("test_secret", "/secret/test_secret", http.StatusNotFound),
+		"keywhiz-fs should look up the secret while it is missing")
+	content, err = m.read("test_secret")
+	assert.NoError(err, "rotated secret should be served while it is recreated")
+	assert.Equal([]byte("hello_1"), content)
+
+	recreate()
+	assert.True(m.eventually(func() bool {
+		content, err := m.read("test_secret")
+		return err == nil && string(content) == "hello_2"
+	}), "rotated content should be served once the cache is no longer fresh")
+}
+
+func TestDeletionGrace(t *testing.T) {
+	assert := assert.New(t)
+	m := startMount(t, []fakeserver.Secret{{Name: "test_secret", Content: []byte("hello")}},
+		"--deletion-delay", "3s")
+	defer m.stop()
+
+	_, err := m.read("test_secret")
+	assert.NoError(err)
+
+	m.server.Delete("test_secret")
+	deleted := time.Now()
+
+	assert.True(m.answered("test_secret", "/secret/test_secret", http.StatusNotFound),
+		"keywhiz-fs should learn about the deletion once the cache is no longer fresh")
+	content, err := m.read("test_secret")
+	assert.NoError(err, "deleted secret should still be served during the grace period")
+	assert.Equal([]byte("hello"), content)
+
+	assert.True(m.eventually(func() bool { return !m.exists("test_secret") }),
+		"deleted secret should disappear after the grace period")
+	assert.True(time.Since(deleted) >= 3*time.Second, "deleted secret disappeared too early")
+}
+
+func TestOwnership(t *testing.T) {
+	assert := assert.New(t)
+	current, err := user.Current()
 	if err != nil {
-		log.Fatal(err)
+		t.Fatal(err)
 	}
+	group := lookupGroup(current.Gid)
+
+	m := startMount(t, []fakeserver.Secret{
+		{Name: "owned", Content: []byte("hello"), Mode: "0440", Owner: current.Username, Group: group},
+		{Name: "default", Content: []byte("hello")},
+	})
+	defer m.stop()
+
+	uid, _ := strconv.ParseUint(current.Uid, 10, 32)
+	gid, _ := strconv.ParseUint(current.Gid, 10, 32)
+	for _, name := range []string{"owned", "default"} {
+		info, err := os.Stat(m.path(name))
+		if !assert.NoError(err) {
+			continue
+		}
+		stat := info.Sys().(*syscall.Stat_t)
+		assert.EqualValues(uid, stat.Uid, "%s uid", name)
+		assert.EqualValues(gid, stat.Gid, "%s gid", name)
+		assert.EqualValues(0440, info.Mode().Perm(), "%s mode", name)
+	}
+}
+
+func TestServerOutage(t *testing.T) {
+	assert := assert.New(t)
+	m := startMount(t, []fakeserver.Secret{{Name: "test_secret", Content: []byte("hello")}})
+	defer m.stop()
+
+	_, err := m.read("test_secret")
+	assert.NoError(err)
+
+	m.server.SetOutage(http.StatusServiceUnavailable)
+	m.server.Add(fakeserver.Secret{Name: "new_secret", Content: []byte("new")})
+	assert.True(m.answered("test_secret", "/secret/test_secret", http.StatusServiceUnavailable),
+		"keywhiz-fs should reach the server once the cache is no longer fresh")
+
+	content, err := m.read("test_secret")
+	assert.NoError(err, "cached secrets should survive a server outage")
+	assert.Equal([]byte("hello"), content)
+	assert.False(m.exists("new_secret"))
+
+	m.server.SetOutage(0)
+	assert.True(m.eventually(func() bool { return m.exists("new_secret") }),
+		"new secrets should appear once the server recovers")
 }
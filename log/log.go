@@ -19,6 +19,7 @@ import (
 	"log"
 	"log/syslog"
 	"os"
+	"sync/atomic"
 	"time"
 )
 
@@ -30,6 +31,16 @@ const (
 	workQueueMaxBacklog = 25
 )
 
+// Values of debugOverride.
+const (
+	debugConfigured int32 = iota
+	debugEnabled
+	debugDisabled
+)
+
+// debugOverride enables or disables debugging output of all loggers, regardless of their config.
+var debugOverride int32
+
 // Logger maintains state of log emitters for different severity levels.
 type Logger struct {
 	syslog   *syslog.Writer
@@ -138,16 +149,37 @@ func (l Logger) Infof(format string, v ...interface{}) {
 	l.nonBlockingEnqueue(worker)
 }
 
+// SetDebug enables or disables debugging output of all loggers, overriding their config.
+func SetDebug(enabled bool) {
+	if enabled {
+		atomic.StoreInt32(&debugOverride, debugEnabled)
+	} else {
+		atomic.StoreInt32(&debugOverride, debugDisabled)
+	}
+}
+
+// Debugging returns whether debugging output is enabled, by SetDebug or else by config.
+func (l Logger) Debugging() bool {
+	switch atomic.LoadInt32(&debugOverride) {
+	case debugEnabled:
+		return true
+	case debugDisabled:
+		return false
+	}
+	return l.debug
+}
+
 // Debugf emits messages at DEBUG level with a printf style interface if debugging was enabled.
 func (l Logger) Debugf(format string, v ...interface{}) {
+	if !l.Debugging() {
+		return
+	}
 	worker := func() {
-		if l.debug {
-			msg := fmt.Sprintf(format, v...)
-			if l.syslog != nil {
-				l.syslog.Debug(msg)
-			} else {
-				l.debugLog.Println(msg)
-			}
+		msg := fmt.Sprintf(format, v...)
+		if l.syslog != nil {
+			l.syslog.Debug(msg)
+		} else {
+			l.debugLog.Println(msg)
 		}
 	}
 	l.nonBlockingEnqueue(worker)
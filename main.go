@@ -15,10 +15,14 @@
 package main
 
 import (
+	"encoding/hex"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"time"
 
@@ -26,8 +30,6 @@ import (
 
 	"net/http"
 
-	"github.com/hanwen/go-fuse/fuse"
-	"github.com/hanwen/go-fuse/fuse/nodefs"
 	"github.com/rcrowley/go-metrics"
 	"github.com/square/go-sq-metrics"
 	klog "github.com/square/keywhiz-fs/log"
@@ -38,19 +40,42 @@ var (
 	app = kingpin.New("keywhiz-fs", "A FUSE based file-system client for Keywhiz.")
 
 	certFile      = app.Flag("cert", "PEM-encoded certificate file").PlaceHolder("FILE").Default("").String()
-	keyFile       = app.Flag("key", "PEM-encoded private key file").PlaceHolder("FILE").Required().String()
-	caFile        = app.Flag("ca", "PEM-encoded CA certificates file").PlaceHolder("FILE").Required().String()
+	keyFile       = app.Flag("key", "PEM-encoded private key file").PlaceHolder("FILE").String()
+	caFile        = app.Flag("ca", "PEM-encoded CA certificates file").PlaceHolder("FILE").String()
 	asuser        = app.Flag("asuser", "Default user to own files").Default("keywhiz").String()
 	asgroup       = app.Flag("group", "Default group to own files").Default("keywhiz").String()
 	debug         = app.Flag("debug", "Enable debugging output").Default("false").Bool()
 	timeout       = app.Flag("timeout", "Timeout for communication with server").Default("20s").Duration()
 	cacheTimeout  = app.Flag("cache-timeout", "Timeout for cache eviction. Useful for testing.").Default("1h").Duration()
+	deletionDelay = app.Flag("deletion-delay", "How long to keep serving a secret after the server reports it deleted.").Default("1h").Duration()
 	metricsURL    = app.Flag("metrics-url", "Collect metrics and POST them periodically to the given URL (via HTTP/JSON).").PlaceHolder("URL").String()
 	metricsPrefix = app.Flag("metrics-prefix", "Override the default metrics prefix used for reporting metrics.").PlaceHolder("PREFIX").String()
 	syslog        = app.Flag("syslog", "Send logs to syslog instead of stderr.").Default("false").Bool()
 	disableMlock  = app.Flag("disable-mlock", "Do not call mlockall on process memory.").Default("false").Bool()
-	serverURL     = app.Arg("url", "server url").Required().URL()
-	mountpoint    = app.Arg("mountpoint", "mountpoint").Required().String()
+	traceFile     = app.Flag("trace", "Record backend calls to a trace file for replay. Secret content is redacted.").PlaceHolder("FILE").String()
+	traceKeyFile  = app.Flag("trace-key", "Encrypt secret content in the trace with the hex-encoded AES key in this file instead of redacting it.").PlaceHolder("FILE").String()
+	expiryWarning = app.Flag("expiry-warning", "Log a warning when a secret is opened within this long of its expiry.").Default("168h").Duration()
+	refuseExpired = app.Flag("refuse-expired", "Refuse to open expired secrets.").Default("false").Bool()
+	cacheMaxBytes = app.Flag("cache-max-bytes", "Evict the content of least recently used secrets past this total size, e.g. 64MB. Zero is unlimited.").Default("0").Bytes()
+	cacheMaxCount = app.Flag("cache-max-entries", "Evict the content of least recently used secrets past this many secrets. Zero is unlimited.").Default("0").Int()
+	maxStale      = app.Flag("max-stale", "Refuse cached secrets last fetched longer ago than this, unless the server confirms them. Zero is unlimited.").Default("0").Duration()
+	staleReval    = app.Flag("stale-while-revalidate", "Serve cached secrets up to this long past --cache-timeout immediately, refreshing them in the background.").Default("0").Duration()
+	staleError    = app.Flag("stale-error", "Error for secrets refused by --max-stale: eio or enoent.").Default("eio").Enum("eio", "enoent")
+	negativeTTL   = app.Flag("negative-cache-ttl", "Remember secrets the server reported missing for this long, unless listed again. Zero disables.").Default("0").Duration()
+	strictList    = app.Flag("strict-listing", "Treat secrets absent from the latest listing as missing, without asking the server.").Default("false").Bool()
+	modeMask      = app.Flag("mode-mask", "Permission bits allowed in secret modes set on the server, in octal.").Default("0777").String()
+	modeMax       = app.Flag("mode-max", "Most permissive mode of any secret, in octal, e.g. 0440.").Default("0777").String()
+	identityTTL   = app.Flag("identity-cache-ttl", "How long to cache user and group lookups, unless /etc/passwd or /etc/group change. Zero disables.").Default("1m").Duration()
+	userns        = app.Flag("userns", "Translate ownership into the user namespace of calling processes, for mounts shared with containers.").Default("false").Bool()
+	uidOffset     = app.Flag("uid-offset", "Add this to the uid owning every file, e.g. for containers with shifted ids.").Default("0").Uint32()
+	gidOffset     = app.Flag("gid-offset", "Add this to the gid owning every file, e.g. for containers with shifted ids.").Default("0").Uint32()
+	filterCaller  = app.Flag("filter-by-caller", "Hide secrets from directory listings and lookups of callers who can't read them.").Default("false").Bool()
+	configFile    = app.Flag("config", "JSON configuration file, e.g. for aliases and templates.").PlaceHolder("FILE").String()
+	mountsFile    = app.Flag("mounts", "JSON file defining several filesystems to serve, instead of the url and mountpoint arguments. Reloaded on SIGHUP.").PlaceHolder("FILE").String()
+	adminSocket   = app.Flag("admin-socket", "Serve the admin API on a Unix domain socket at this path.").PlaceHolder("PATH").String()
+	adminUids     = app.Flag("admin-uid", "Allow this uid to use the admin API, besides root and the user running keywhiz-fs. Repeatable.").PlaceHolder("UID").Uint32List()
+	serverURL     = app.Arg("url", "server url").URL()
+	mountpoint    = app.Arg("mountpoint", "mountpoint").String()
 	logger        *klog.Logger
 )
 
@@ -58,49 +83,46 @@ func main() {
 	app.Version(fmt.Sprintf("rev %s-%s on \"%s\"", buildRevision, buildTime, buildMachine))
 	kingpin.MustParse(app.Parse(os.Args[1:]))
 
+	if *mountsFile != "" {
+		if *serverURL != nil || *mountpoint != "" {
+			app.Fatalf("--mounts replaces the url and mountpoint arguments")
+		}
+	} else if *serverURL == nil || *mountpoint == "" {
+		app.Fatalf("url and mountpoint arguments are required, unless given --mounts")
+	} else if *keyFile == "" || *caFile == "" {
+		app.Fatalf("--key and --ca are required, unless given --mounts")
+	}
+
 	logConfig := klog.Config{Debug: *debug, Mountpoint: *mountpoint, Syslog: *syslog}
 	logger = klog.New("kwfs_main", logConfig)
 	defer logger.Close()
 
-	if *certFile == "" {
-		logger.Debugf("Certificate file not specified, assuming certificate also in %s", *keyFile)
-		certFile = keyFile
-	}
-
 	metricsHandle := setupMetrics(metricsURL, metricsPrefix, *mountpoint)
 
 	if !*disableMlock {
 		lockMemory()
 	}
 
-	// TODO: move time limit settings to config file?
-	// TODO: or at least make it consistent? some are set here, some are set above with app.Flag()
-	freshThreshold := *cacheTimeout
-	backendDeadline := 5 * time.Second
-	maxWait := *timeout + backendDeadline
-	delayDeletion := 1 * time.Hour
-	timeouts := Timeouts{freshThreshold, backendDeadline, maxWait, delayDeletion}
-
-	client := NewClient(*certFile, *keyFile, *caFile, *serverURL, *timeout, logConfig, metricsHandle)
-
-	ownership := NewOwnership(*asuser, *asgroup)
-	kwfs, root, err := NewKeywhizFs(&client, ownership, timeouts, metricsHandle, logConfig)
-	if err != nil {
-		log.Fatalf("KeywhizFs init fail: %v\n", err)
+	if *mountsFile != "" {
+		supervise(*mountsFile, metricsHandle)
+		logger.Infof("Exiting")
+		return
 	}
-	kwfs.Cache.Warmup()
 
-	mountOptions := &fuse.MountOptions{
-		AllowOther: true,
-		Name:       kwfs.String(),
-		Options:    []string{"default_permissions"},
+	def := MountConfig{
+		URL:        (*serverURL).String(),
+		Cert:       *certFile,
+		Key:        *keyFile,
+		CA:         *caFile,
+		Mountpoint: *mountpoint,
+		User:       *asuser,
+		Group:      *asgroup,
+		Config:     *configFile,
+		Trace:      *traceFile,
 	}
-
-	// Empty Options struct avoids setting a global uid/gid override.
-	conn := nodefs.NewFileSystemConnector(root, &nodefs.Options{})
-	server, err := fuse.NewServer(conn.RawFS(), *mountpoint, mountOptions)
+	mount, err := startMount(def, metricsHandle)
 	if err != nil {
-		log.Fatalf("Mount fail: %v\n", err)
+		log.Fatalf("Mount of %s failed: %v\n", *mountpoint, err)
 	}
 
 	// Catch SIGINT and exit cleanly.
@@ -110,17 +132,80 @@ func main() {
 		for {
 			sig := <-c
 			logger.Warnf("Got signal %s, unmounting", sig)
-			err := server.Unmount()
+			err := mount.Unmount()
 			if err != nil {
 				logger.Warnf("Error while unmounting: %v", err)
 			}
 		}
 	}()
 
-	server.Serve()
+	if admin := startAdmin(func() map[string]*KeywhizFs {
+		return map[string]*KeywhizFs{mount.Config.Mountpoint: mount.Fs}
+	}); admin != nil {
+		defer admin.Close()
+	}
+
+	<-mount.Done()
 	logger.Infof("Exiting")
 }
 
+// supervise serves the mounts defined in mountsFile until interrupted, reloading them on SIGHUP.
+func supervise(mountsFile string, metricsHandle *sqmetrics.SquareMetrics) {
+	defs, err := LoadMountsConfig(mountsFile)
+	if err != nil {
+		log.Fatalf("Mounts load fail: %v\n", err)
+	}
+
+	supervisor := NewSupervisor(metricsHandle, klog.Config{Debug: *debug, Syslog: *syslog})
+	if err := supervisor.Apply(defs); err != nil {
+		logger.Errorf("Error while mounting: %v", err)
+	}
+	if admin := startAdmin(supervisor.Filesystems); admin != nil {
+		defer admin.Close()
+	}
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, unix.SIGTERM, unix.SIGHUP)
+	for sig := range c {
+		if sig != unix.SIGHUP {
+			logger.Warnf("Got signal %s, unmounting", sig)
+			break
+		}
+		logger.Infof("Got signal %s, reloading %s", sig, mountsFile)
+		defs, err := LoadMountsConfig(mountsFile)
+		if err != nil {
+			logger.Errorf("Mounts load fail, keeping current mounts: %v", err)
+			continue
+		}
+		if err := supervisor.Apply(defs); err != nil {
+			logger.Errorf("Error while reloading mounts: %v", err)
+		}
+	}
+
+	if err := supervisor.Close(); err != nil {
+		logger.Warnf("Error while unmounting: %v", err)
+	}
+}
+
+// startAdmin serves the admin API for filesystems in the background, if given --admin-socket.
+func startAdmin(filesystems func() map[string]*KeywhizFs) *AdminServer {
+	if *adminSocket == "" {
+		return nil
+	}
+	allowed := append([]uint32{0, uint32(os.Geteuid())}, *adminUids...)
+	admin, err := NewAdminServer(*adminSocket, allowed, filesystems, klog.Config{Debug: *debug, Syslog: *syslog})
+	if err != nil {
+		log.Fatalf("Admin socket fail: %v\n", err)
+	}
+	logger.Infof("Serving admin API on %s", *adminSocket)
+	go func() {
+		if err := admin.Serve(); err != nil {
+			logger.Errorf("Error serving admin API: %v", err)
+		}
+	}()
+	return admin
+}
+
 // Setup metrics
 func setupMetrics(metricsURL *string, metricsPrefix *string, mountpoint string) *sqmetrics.SquareMetrics {
 	if *metricsURL != "" {
@@ -135,13 +220,51 @@ func setupMetrics(metricsURL *string, metricsPrefix *string, mountpoint string)
 	if *metricsPrefix != "" {
 		prefix = *metricsPrefix
 	} else {
-		// By default, prefix metrics with escaped mount path. Replace slashes with - for easier aggregation
-		prefix = fmt.Sprintf("keywhizfs.%s", strings.Replace(strings.Replace(mountpoint, "-", "--", -1), "/", "-", -1))
+		// By default, prefix metrics with escaped mount path. Those of a supervisor label each mount.
+		prefix = "keywhizfs"
+		if mountpoint != "" {
+			prefix = fmt.Sprintf("keywhizfs.%s", metricsLabel(mountpoint))
+		}
 	}
 
 	return sqmetrics.NewMetrics(*metricsURL, prefix, http.DefaultClient, (30 * time.Second), metrics.DefaultRegistry, &log.Logger{})
 }
 
+// setupTrace wraps backend so that calls are recorded to traceFile, returned to be closed once done.
+func setupTrace(backend SecretBackend, traceFile, traceKeyFile string, logConfig klog.Config, metricsHandle *sqmetrics.SquareMetrics) (*RecordingBackend, io.Closer, error) {
+	codec := NewRedactingCodec()
+	if traceKeyFile != "" {
+		data, err := ioutil.ReadFile(traceKeyFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil {
+			return nil, nil, fmt.Errorf("trace key should be hex-encoded: %v", err)
+		}
+		codec, err = NewEncryptingCodec(key)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	file, err := os.OpenFile(traceFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+	logger.Infof("Recording backend calls to %s", traceFile)
+	return NewRecordingBackend(backend, file, codec, logConfig, metricsHandle), file, nil
+}
+
+// parseModeFlag parses octal permission bits given with a flag.
+func parseModeFlag(flag, value string) (uint32, error) {
+	mode, err := strconv.ParseUint(value, 8 /* base */, 16 /* bits */)
+	if err != nil || mode&^0777 != 0 {
+		return 0, fmt.Errorf("invalid --%s %q, should be octal permission bits", flag, value)
+	}
+	return uint32(mode), nil
+}
+
 // Locks memory, preventing memory from being written to disk as swap
 func lockMemory() {
 	err := unix.Mlockall(unix.MCL_FUTURE | unix.MCL_CURRENT)
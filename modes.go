@@ -0,0 +1,135 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strconv"
+	"unicode"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// ModeRule sets the mode of secrets whose name matches a glob pattern, instead of the mode set
+// on the server.
+type ModeRule struct {
+	Pattern string `json:"pattern"`
+	Mode    string `json:"mode"`
+}
+
+// ModeRules are applied in order, the first matching rule winning.
+type ModeRules []ModeRule
+
+// UnmarshalJSON parses and validates a list of mode rules.
+func (r *ModeRules) UnmarshalJSON(data []byte) error {
+	var rules []ModeRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		if _, err := path.Match(rule.Pattern, ""); err != nil || rule.Pattern == "" {
+			return fmt.Errorf("mode rule has invalid pattern %q", rule.Pattern)
+		}
+		if mode, err := strconv.ParseUint(rule.Mode, 8 /* base */, 16 /* bits */); err != nil || mode&^0777 != 0 {
+			return fmt.Errorf("mode rule for %q has invalid mode %q", rule.Pattern, rule.Mode)
+		}
+	}
+	*r = rules
+	return nil
+}
+
+// ModePolicy restricts the permissions secrets are served with. The zero policy serves the modes
+// set on the server, without setuid, setgid or sticky bits.
+type ModePolicy struct {
+	// Mask is the permission bits allowed in modes set on the server. Zero allows all of them.
+	Mask uint32
+	// Max is the most permissive mode of any secret, applied after rules. Zero is unlimited.
+	Max uint32
+	// Rules override the mode of matching secrets.
+	Rules ModeRules
+}
+
+// Apply returns the permission bits a secret is served with, and whether the mode set on the
+// server violates the policy.
+func (p ModePolicy) Apply(s *Secret) (mode uint32, violation bool) {
+	requested := s.RequestedMode()
+	mode = requested & 0777
+	if p.Mask != 0 {
+		mode &= p.Mask
+	}
+	for _, rule := range p.Rules {
+		if ok, _ := path.Match(rule.Pattern, s.Name); ok {
+			ruleMode, _ := strconv.ParseUint(rule.Mode, 8 /* base */, 16 /* bits */)
+			mode = uint32(ruleMode)
+			break
+		}
+	}
+	if p.Max != 0 {
+		mode &= p.Max
+	}
+	violation = requested&^0777 != 0 ||
+		(p.Mask != 0 && requested&0777&^p.Mask != 0) ||
+		(p.Max != 0 && requested&0777&^p.Max != 0)
+	return mode, violation
+}
+
+// secretMode returns the permission bits of a secret under the mode policy, logging and counting
+// violations once per secret and requested mode.
+func (kwfs KeywhizFs) secretMode(s *Secret) uint32 {
+	mode, violation := kwfs.Modes.Apply(s)
+	if !violation || kwfs.modeViolations == nil {
+		return mode
+	}
+	requested := s.RequestedMode()
+	if previous, loaded := kwfs.modeViolations.Swap(s.Name, requested); loaded && previous == requested {
+		return mode
+	}
+	kwfs.Warnf("Secret %s has mode %04o, violating the mode policy, serving it with %04o", s.Name, requested, mode)
+	if kwfs.Metrics != nil {
+		metrics.GetOrRegisterCounter("runtime.secrets.mode_violations", kwfs.Metrics.Registry).Inc(1)
+	}
+	return mode
+}
+
+// secretJSON returns the JSON of a secret from the server, adding the mode it is served with
+// (effectiveMode) and the mode set on the server (requestedMode). The server's JSON is otherwise
+// unchanged.
+func (kwfs KeywhizFs) secretJSON(name string) ([]byte, error) {
+	data, err := kwfs.rawSecret(name)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := ParseSecret(data)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+
+	// Insert the modes before the closing brace of the object.
+	body := bytes.TrimRightFunc(data, unicode.IsSpace)
+	body = bytes.TrimRightFunc(body[:len(body)-1], unicode.IsSpace)
+	separator := ","
+	if len(fields) == 0 {
+		separator = ""
+	}
+	modes := fmt.Sprintf(`%s"effectiveMode":"%04o","requestedMode":"%04o"}`, separator, kwfs.secretMode(secret), secret.RequestedMode())
+	return append(body[:len(body):len(body)], modes...), nil
+}
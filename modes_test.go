@@ -0,0 +1,139 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestModePolicyApply(t *testing.T) {
+	assert := assert.New(t)
+
+	rules := ModeRules{{"*.key", "0400"}, {"*", "0444"}}
+	cases := []struct {
+		policy    ModePolicy
+		name      string
+		mode      string
+		expected  uint32
+		violation bool
+	}{
+		{ModePolicy{}, "foo", "0440", 0440, false},
+		{ModePolicy{}, "foo", "0777", 0777, false},
+		{ModePolicy{}, "foo", "4755", 0755, true},
+		{ModePolicy{}, "foo", "1444", 0444, true},
+		{ModePolicy{}, "foo", "0100644", 0644, true},
+		{ModePolicy{Mask: 0755}, "foo", "0666", 0644, true},
+		{ModePolicy{Mask: 0755}, "foo", "0644", 0644, false},
+		{ModePolicy{Mask: 0777}, "foo", "0666", 0666, false},
+		{ModePolicy{Mask: 0777}, "foo", "2775", 0775, true},
+		{ModePolicy{Max: 0440}, "foo", "0644", 0440, true},
+		{ModePolicy{Max: 0440}, "foo", "0400", 0400, false},
+		{ModePolicy{Rules: rules}, "a.key", "0644", 0400, false},
+		{ModePolicy{Rules: rules}, "a.crt", "0600", 0444, false},
+		{ModePolicy{Rules: rules, Max: 0440}, "a.crt", "0600", 0440, true},
+		{ModePolicy{}, "foo", "invalid", 0440, false},
+	}
+	for _, c := range cases {
+		mode, violation := c.policy.Apply(&Secret{Name: c.name, Mode: c.mode})
+		assert.Equal(c.expected, mode, "%+v for %s %s", c.policy, c.name, c.mode)
+		assert.Equal(c.violation, violation, "%+v for %s %s", c.policy, c.name, c.mode)
+	}
+}
+
+func TestParseModeRules(t *testing.T) {
+	assert := assert.New(t)
+
+	config, err := ParseConfig([]byte(`{"mode_rules": [{"pattern": "*.key", "mode": "0400"}, {"pattern": "*", "mode": "444"}]}`))
+	assert.NoError(err)
+	assert.Equal(ModeRules{{"*.key", "0400"}, {"*", "444"}}, config.ModeRules)
+}
+
+func TestParseModeFlag(t *testing.T) {
+	assert := assert.New(t)
+
+	mode, err := parseModeFlag("mode-max", "0440")
+	assert.NoError(err)
+	assert.EqualValues(0440, mode)
+
+	for _, value := range []string{"", "rw", "0999", "01777"} {
+		_, err := parseModeFlag("mode-max", value)
+		assert.Error(err, value)
+	}
+}
+
+func TestFsModePolicy(t *testing.T) {
+	assert := assert.New(t)
+
+	backend := NewMapBackend(
+		Secret{Name: "setuid", Content: content("a"), Mode: "4755"},
+		Secret{Name: "readable", Content: content("b"), Mode: "0440"})
+	metricsHandle := setupMetrics(metricsURL, metricsPrefix, *mountpoint)
+	kwfs, _, err := NewKeywhizFs(nil, backend, Ownership{Uid: 1000, Gid: 1000}, timeouts, metricsHandle, logConfig)
+	assert.NoError(err)
+	kwfs.Modes = ModePolicy{Mask: 0755, Max: 0444}
+	violations := metrics.GetOrRegisterCounter("runtime.secrets.mode_violations", metricsHandle.Registry)
+	before := violations.Count()
+
+	attr, status := kwfs.GetAttr("setuid", &fuse.Context{})
+	assert.Equal(fuse.OK, status)
+	assert.Equal(uint32(0444|unix.S_IFREG), attr.Mode)
+	attr, status = kwfs.GetAttr("readable", &fuse.Context{})
+	assert.Equal(fuse.OK, status)
+	assert.Equal(uint32(0440|unix.S_IFREG), attr.Mode)
+
+	// Violations are counted once per secret and mode, however often the secret is served.
+	kwfs.GetAttr("setuid", &fuse.Context{})
+
+	// Directories derived from a secret follow the mode it is served with.
+	attr, status = kwfs.GetAttr(".versions/setuid", &fuse.Context{})
+	assert.Equal(fuse.OK, status)
+	assert.Equal(uint32(0555|unix.S_IFDIR), attr.Mode)
+
+	assert.EqualValues(1, violations.Count()-before)
+}
+
+func TestFsSecretJSONModes(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"name": "setuid", "secret": "YQ==", "secretLength": 1, "mode": "4755"}` + "\n"))
+	}))
+	server.TLS = testCerts(testCaFile)
+	server.StartTLS()
+	defer server.Close()
+
+	serverURL, _ := url.Parse(server.URL)
+	metricsHandle := setupMetrics(metricsURL, metricsPrefix, *mountpoint)
+	client := NewClient(clientFile, clientFile, testCaFile, serverURL, time.Second, logConfig, metricsHandle)
+	kwfs, _, err := NewKeywhizFs(&client, &client, Ownership{Uid: 1000, Gid: 1000}, timeouts, metricsHandle, logConfig)
+	assert.NoError(err)
+	kwfs.Modes = ModePolicy{Mask: 0755, Max: 0444}
+
+	file, status := kwfs.Open(".json/secret/setuid", 0, &fuse.Context{})
+	assert.Equal(fuse.OK, status)
+	buf := make([]byte, 4000)
+	res, _ := file.Read(buf, 0)
+	data, _ := res.Bytes(buf)
+	assert.Equal(`{"name": "setuid", "secret": "YQ==", "secretLength": 1, "mode": "4755","effectiveMode":"0444","requestedMode":"4755"}`, string(data))
+}
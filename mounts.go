@@ -0,0 +1,524 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/rcrowley/go-metrics"
+	"github.com/square/go-sq-metrics"
+	klog "github.com/square/keywhiz-fs/log"
+)
+
+// MountConfig defines a filesystem: the server and credentials of its client, where it is mounted,
+// and the default owner of its files. Other settings are given by flags, for all mounts.
+type MountConfig struct {
+	URL        string `json:"url"`
+	Cert       string `json:"cert"`
+	Key        string `json:"key"`
+	CA         string `json:"ca"`
+	Mountpoint string `json:"mountpoint"`
+	User       string `json:"asuser"`
+	Group      string `json:"group"`
+	// Config is the configuration file of the mount, e.g. for aliases and templates.
+	Config string `json:"config"`
+	// Trace is the file recording the calls of the mount to its backend.
+	Trace string `json:"trace"`
+}
+
+// validate checks a mount definition is complete, and that its mountpoint can label its metrics.
+func (def MountConfig) validate() error {
+	switch {
+	case def.Mountpoint == "" || !filepath.IsAbs(def.Mountpoint):
+		return fmt.Errorf("mountpoint %q should be an absolute path", def.Mountpoint)
+	case def.Key == "" || def.CA == "":
+		return fmt.Errorf("mount of %s needs a key and CA", def.Mountpoint)
+	}
+	u, err := url.Parse(def.URL)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("mount of %s has invalid server url %q", def.Mountpoint, def.URL)
+	}
+	return nil
+}
+
+// LoadMountsConfig reads and validates a JSON file of mount definitions.
+func LoadMountsConfig(path string) ([]MountConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseMountsConfig(data)
+}
+
+// ParseMountsConfig deserializes and validates mount definitions, of the form {"mounts": [...]}.
+func ParseMountsConfig(data []byte) ([]MountConfig, error) {
+	var config struct {
+		Mounts []MountConfig `json:"mounts"`
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("Fail to deserialize JSON mounts: %v", err)
+	}
+	labels := make(map[string]string)
+	for i, def := range config.Mounts {
+		if err := def.validate(); err != nil {
+			return nil, err
+		}
+		def.Mountpoint = filepath.Clean(def.Mountpoint)
+		label := mountMetricsLabel(def.Mountpoint)
+		if other, ok := labels[label]; ok {
+			return nil, fmt.Errorf("mountpoints %s and %s are the same, or have the same metrics", other, def.Mountpoint)
+		}
+		labels[label] = def.Mountpoint
+		config.Mounts[i] = def
+	}
+	return config.Mounts, nil
+}
+
+// metricsLabel escapes a mountpoint for use in metric names. Slashes are replaced by '-' for easier
+// aggregation.
+func metricsLabel(mountpoint string) string {
+	return strings.Replace(strings.Replace(mountpoint, "-", "--", -1), "/", "-", -1)
+}
+
+// mountMetricsLabel escapes a mountpoint to label the metrics of a mount served by a supervisor.
+// Dots are replaced too, so that the label of a mount never prefixes that of another.
+func mountMetricsLabel(mountpoint string) string {
+	return strings.Replace(metricsLabel(mountpoint), ".", "_", -1)
+}
+
+// Mount is a filesystem being served.
+type Mount struct {
+	Config MountConfig
+	Fs     *KeywhizFs
+
+	server *fuse.Server
+	client Client
+	trace  io.Closer
+	served chan struct{}
+}
+
+// startMount mounts the filesystem def defines and serves it in the background, until unmounted.
+// Metrics are reported to metricsHandle.
+func startMount(def MountConfig, metricsHandle *sqmetrics.SquareMetrics) (*Mount, error) {
+	logConfig := klog.Config{Debug: *debug, Mountpoint: def.Mountpoint, Syslog: *syslog}
+	modeMask, err := parseModeFlag("mode-mask", *modeMask)
+	if err != nil {
+		return nil, err
+	}
+	modeMax, err := parseModeFlag("mode-max", *modeMax)
+	if err != nil {
+		return nil, err
+	}
+
+	certFile := def.Cert
+	if certFile == "" {
+		logger.Debugf("Certificate file not specified, assuming certificate also in %s", def.Key)
+		certFile = def.Key
+	}
+	owner, group := def.User, def.Group
+	if owner == "" {
+		owner = *asuser
+	}
+	if group == "" {
+		group = *asgroup
+	}
+
+	config := &Config{}
+	if def.Config != "" {
+		config, err = LoadConfig(def.Config)
+		if err != nil {
+			return nil, fmt.Errorf("config load fail: %v", err)
+		}
+	}
+	serverURL, err := url.Parse(def.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	// TODO: move time limit settings to config file?
+	// TODO: or at least make it consistent? some are set here, some are set above with app.Flag()
+	freshThreshold := *cacheTimeout
+	backendDeadline := 5 * time.Second
+	maxWait := *timeout + backendDeadline
+	timeouts := Timeouts{freshThreshold, backendDeadline, maxWait, *deletionDelay}
+
+	// NewClient panics on invalid credentials, which shouldn't stop other mounts.
+	if _, err := (httpClientParams{certFile, def.Key, def.CA, *timeout}).buildClient(); err != nil {
+		return nil, fmt.Errorf("client init fail: %v", err)
+	}
+	m := &Mount{Config: def, served: make(chan struct{})}
+	m.client = NewClient(certFile, def.Key, def.CA, serverURL, *timeout, logConfig, metricsHandle)
+
+	var backend SecretBackend = &m.client
+	if def.Trace != "" {
+		recorder, file, err := setupTrace(backend, def.Trace, *traceKeyFile, logConfig, metricsHandle)
+		if err != nil {
+			m.client.Close()
+			return nil, fmt.Errorf("trace setup fail: %v", err)
+		}
+		backend = recorder
+		m.trace = file
+	}
+
+	// Each mount has its own identity cache, so mounts don't share lookups or their failure counts.
+	ids := NewSystemIdentityCache(*identityTTL)
+	ownership, unresolvedUser, unresolvedGroup := NewOwnership(owner, group, config.Ownership, ids)
+	kwfs, root, err := NewKeywhizFs(&m.client, backend, ownership, timeouts, metricsHandle, logConfig)
+	if err != nil {
+		m.close()
+		return nil, fmt.Errorf("KeywhizFs init fail: %v", err)
+	}
+	kwfs.Aliases = config.Aliases
+	kwfs.Templates = config.Templates
+	kwfs.EnvGroups = config.EnvGroups
+	kwfs.Owners = config.Ownership
+	kwfs.Identities = ids
+	kwfs.noteUnresolved(unresolvedUser, unresolvedGroup, "of files by default", ownership.Uid, ownership.Gid)
+	kwfs.IDs = NewIDTranslation(*userns, *uidOffset, *gidOffset)
+	kwfs.FilterByCaller = *filterCaller
+	kwfs.Modes = ModePolicy{Mask: modeMask, Max: modeMax, Rules: config.ModeRules}
+	kwfs.Expiry = ExpiryPolicy{Warning: *expiryWarning, Refuse: *refuseExpired}
+	kwfs.Cache.SetStalePolicy(StalePolicy{MaxStale: *maxStale, Revalidate: *staleReval, NotFound: *staleError == "enoent"})
+	kwfs.Cache.SetNegativeCache(NegativeCachePolicy{TTL: *negativeTTL, Strict: *strictList})
+	kwfs.Cache.SetLimits(CacheLimits{MaxBytes: uint64(*cacheMaxBytes), MaxEntries: *cacheMaxCount})
+	kwfs.Cache.Warmup()
+	m.Fs = kwfs
+
+	mountOptions := &fuse.MountOptions{
+		AllowOther: true,
+		Name:       kwfs.String(),
+		Options:    []string{"default_permissions"},
+	}
+
+	// Empty Options struct avoids setting a global uid/gid override.
+	conn := nodefs.NewFileSystemConnector(root, &nodefs.Options{})
+	m.server, err = fuse.NewServer(conn.RawFS(), def.Mountpoint, mountOptions)
+	if err != nil {
+		m.close()
+		return nil, fmt.Errorf("mount fail: %v", err)
+	}
+
+	go func() {
+		m.server.Serve()
+		m.close()
+		close(m.served)
+	}()
+
+	// Periodically report secrets close to or past their expiry, the memory used by the cache, and
+	// owners which couldn't be resolved.
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				kwfs.reportExpiry()
+				kwfs.reportCache()
+				kwfs.reportOwnership()
+			case <-m.served:
+				return
+			}
+		}
+	}()
+
+	return m, nil
+}
+
+// Unmount unmounts the filesystem, and waits until it is no longer served.
+func (m *Mount) Unmount() error {
+	if err := m.server.Unmount(); err != nil {
+		return err
+	}
+	<-m.served
+	return nil
+}
+
+// Done returns a channel closed once the filesystem is no longer served, whether unmounted by
+// Unmount or externally.
+func (m *Mount) Done() <-chan struct{} {
+	return m.served
+}
+
+// Filesystem returns the filesystem served.
+func (m *Mount) Filesystem() *KeywhizFs {
+	return m.Fs
+}
+
+// close releases the client and trace of a mount no longer served.
+func (m *Mount) close() {
+	m.client.Close()
+	if m.trace != nil {
+		m.trace.Close()
+	}
+}
+
+// mounted is a filesystem served by a supervisor.
+type mounted interface {
+	Unmount() error
+	Done() <-chan struct{}
+	Filesystem() *KeywhizFs
+}
+
+// supervisedMount is a filesystem served by a supervisor, with its definition and metrics.
+type supervisedMount struct {
+	config   MountConfig
+	mount    mounted
+	registry *mountRegistry
+}
+
+// Supervisor serves several filesystems from one process, each with its own client, cache and
+// metrics. Mounts can be added and removed while the others are served.
+type Supervisor struct {
+	*klog.Logger
+	metrics *sqmetrics.SquareMetrics // Metrics of the process, including those of each mount.
+	start   func(MountConfig, *sqmetrics.SquareMetrics) (mounted, error)
+
+	lock   sync.Mutex
+	mounts map[string]*supervisedMount // By mountpoint.
+}
+
+// NewSupervisor initializes a Supervisor without mounts. The metrics of each mount are registered
+// in the registry of metricsHandle, prefixed with a label of their mountpoint.
+func NewSupervisor(metricsHandle *sqmetrics.SquareMetrics, logConfig klog.Config) *Supervisor {
+	return &Supervisor{
+		Logger:  klog.New("kwfs_supervisor", logConfig),
+		metrics: metricsHandle,
+		start: func(def MountConfig, metricsHandle *sqmetrics.SquareMetrics) (mounted, error) {
+			return startMount(def, metricsHandle)
+		},
+		mounts: make(map[string]*supervisedMount),
+	}
+}
+
+// Add mounts a new filesystem.
+func (s *Supervisor) Add(def MountConfig) error {
+	if err := def.validate(); err != nil {
+		return err
+	}
+	def.Mountpoint = filepath.Clean(def.Mountpoint)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.add(def)
+}
+
+// Remove unmounts the filesystem at mountpoint.
+func (s *Supervisor) Remove(mountpoint string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.remove(filepath.Clean(mountpoint))
+}
+
+// Apply mounts, unmounts and remounts filesystems so that those served are defs. Mounts whose
+// definition didn't change are left alone. Errors are returned once all definitions are applied.
+func (s *Supervisor) Apply(defs []MountConfig) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	wanted := make(map[string]MountConfig, len(defs))
+	for _, def := range defs {
+		wanted[def.Mountpoint] = def
+	}
+	var errs []string
+	for mountpoint, sm := range s.mounts {
+		if def, ok := wanted[mountpoint]; !ok || def != sm.config {
+			if err := s.remove(mountpoint); err != nil {
+				errs = append(errs, err.Error())
+			}
+		}
+	}
+	for _, def := range defs {
+		if _, ok := s.mounts[def.Mountpoint]; !ok {
+			if err := s.add(def); err != nil {
+				errs = append(errs, err.Error())
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Mounts returns the definitions of the filesystems served, by mountpoint.
+func (s *Supervisor) Mounts() []MountConfig {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	defs := make([]MountConfig, 0, len(s.mounts))
+	for _, sm := range s.mounts {
+		defs = append(defs, sm.config)
+	}
+	sort.Slice(defs, func(i, j int) bool { return defs[i].Mountpoint < defs[j].Mountpoint })
+	return defs
+}
+
+// Filesystems returns the filesystems served, by mountpoint.
+func (s *Supervisor) Filesystems() map[string]*KeywhizFs {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	filesystems := make(map[string]*KeywhizFs, len(s.mounts))
+	for mountpoint, sm := range s.mounts {
+		filesystems[mountpoint] = sm.mount.Filesystem()
+	}
+	return filesystems
+}
+
+// Close unmounts all filesystems.
+func (s *Supervisor) Close() error {
+	return s.Apply(nil)
+}
+
+// add mounts a filesystem. The lock must be held.
+func (s *Supervisor) add(def MountConfig) error {
+	if _, ok := s.mounts[def.Mountpoint]; ok {
+		return fmt.Errorf("%s is already mounted", def.Mountpoint)
+	}
+	label := mountMetricsLabel(def.Mountpoint)
+	for mountpoint := range s.mounts {
+		if mountMetricsLabel(mountpoint) == label {
+			return fmt.Errorf("%s has the same metrics as %s", def.Mountpoint, mountpoint)
+		}
+	}
+
+	registry := newMountRegistry(s.metrics.Registry, label+".")
+	// Only the handle of the process publishes metrics and collects those of the runtime.
+	metricsHandle := &sqmetrics.SquareMetrics{Registry: registry}
+	m, err := s.start(def, metricsHandle)
+	if err != nil {
+		registry.close()
+		return fmt.Errorf("mount of %s failed: %v", def.Mountpoint, err)
+	}
+	sm := &supervisedMount{def, m, registry}
+	s.mounts[def.Mountpoint] = sm
+	go s.watch(sm)
+	s.Infof("Mounted %s", def.Mountpoint)
+	return nil
+}
+
+// remove unmounts a filesystem. The lock must be held.
+func (s *Supervisor) remove(mountpoint string) error {
+	sm, ok := s.mounts[mountpoint]
+	if !ok {
+		return fmt.Errorf("%s is not mounted", mountpoint)
+	}
+	if err := sm.mount.Unmount(); err != nil {
+		return fmt.Errorf("unmount of %s failed: %v", mountpoint, err)
+	}
+	delete(s.mounts, mountpoint)
+	sm.registry.close()
+	s.Infof("Unmounted %s", mountpoint)
+	return nil
+}
+
+// watch forgets a mount once it is no longer served, as when unmounted externally.
+func (s *Supervisor) watch(sm *supervisedMount) {
+	<-sm.mount.Done()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.mounts[sm.config.Mountpoint] == sm {
+		s.Warnf("%s was unmounted", sm.config.Mountpoint)
+		delete(s.mounts, sm.config.Mountpoint)
+	}
+	sm.registry.close()
+}
+
+// mountRegistry holds the metrics of a mount in the registry of the process, with names prefixed
+// by a label of the mount. Once closed, its metrics are unregistered, and new ones are discarded.
+type mountRegistry struct {
+	parent  metrics.Registry
+	prefix  string
+	discard metrics.Registry
+
+	lock   sync.Mutex
+	closed bool
+}
+
+func newMountRegistry(parent metrics.Registry, prefix string) *mountRegistry {
+	return &mountRegistry{parent: parent, prefix: prefix, discard: metrics.NewRegistry()}
+}
+
+// registry returns the registry metrics are held in, and the prefix of their names.
+func (r *mountRegistry) registry() (metrics.Registry, string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.closed {
+		return r.discard, ""
+	}
+	return r.parent, r.prefix
+}
+
+// Each calls f for each metric of the mount, by its unprefixed name.
+func (r *mountRegistry) Each(f func(string, interface{})) {
+	registry, prefix := r.registry()
+	registry.Each(func(name string, metric interface{}) {
+		if strings.HasPrefix(name, prefix) {
+			f(name[len(prefix):], metric)
+		}
+	})
+}
+
+func (r *mountRegistry) Get(name string) interface{} {
+	registry, prefix := r.registry()
+	return registry.Get(prefix + name)
+}
+
+func (r *mountRegistry) GetOrRegister(name string, metric interface{}) interface{} {
+	registry, prefix := r.registry()
+	return registry.GetOrRegister(prefix+name, metric)
+}
+
+func (r *mountRegistry) Register(name string, metric interface{}) error {
+	registry, prefix := r.registry()
+	return registry.Register(prefix+name, metric)
+}
+
+func (r *mountRegistry) RunHealthchecks() {
+	registry, _ := r.registry()
+	registry.RunHealthchecks()
+}
+
+func (r *mountRegistry) Unregister(name string) {
+	registry, prefix := r.registry()
+	registry.Unregister(prefix + name)
+}
+
+// UnregisterAll unregisters the metrics of the mount.
+func (r *mountRegistry) UnregisterAll() {
+	var names []string
+	r.Each(func(name string, _ interface{}) {
+		names = append(names, name)
+	})
+	for _, name := range names {
+		r.Unregister(name)
+	}
+}
+
+// close unregisters the metrics of the mount, and discards those registered afterwards.
+func (r *mountRegistry) close() {
+	r.UnregisterAll()
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.closed = true
+}
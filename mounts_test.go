@@ -0,0 +1,186 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/square/go-sq-metrics"
+	klog "github.com/square/keywhiz-fs/log"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeMount is a mount served until unmounted, by Unmount or externally.
+type fakeMount struct {
+	served chan struct{}
+}
+
+func (m *fakeMount) Unmount() error {
+	close(m.served)
+	return nil
+}
+
+func (m *fakeMount) Done() <-chan struct{} {
+	return m.served
+}
+
+func (m *fakeMount) Filesystem() *KeywhizFs {
+	return nil
+}
+
+func TestParseMountsConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	defs, err := ParseMountsConfig([]byte(`{"mounts": [
+		{"url": "https://a.example.com:4444", "key": "a.pem", "ca": "ca.pem", "mountpoint": "/secrets/a/"},
+		{"url": "https://b.example.com:4444", "cert": "b.crt", "key": "b.key", "ca": "ca.pem", "mountpoint": "/secrets/b", "asuser": "b", "group": "b"}
+	]}`))
+	assert.NoError(err)
+	if assert.Len(defs, 2) {
+		assert.Equal("/secrets/a", defs[0].Mountpoint)
+		assert.Equal(MountConfig{
+			URL:        "https://b.example.com:4444",
+			Cert:       "b.crt",
+			Key:        "b.key",
+			CA:         "ca.pem",
+			Mountpoint: "/secrets/b",
+			User:       "b",
+			Group:      "b",
+		}, defs[1])
+	}
+
+	invalid := []string{
+		`{"mounts": [`,
+		`{"mounts": [{"url": "https://a", "key": "a.pem", "ca": "ca.pem"}]}`,
+		`{"mounts": [{"url": "https://a", "key": "a.pem", "ca": "ca.pem", "mountpoint": "secrets"}]}`,
+		`{"mounts": [{"url": "https://a", "ca": "ca.pem", "mountpoint": "/secrets"}]}`,
+		`{"mounts": [{"url": "https://a", "key": "a.pem", "mountpoint": "/secrets"}]}`,
+		`{"mounts": [{"url": "a", "key": "a.pem", "ca": "ca.pem", "mountpoint": "/secrets"}]}`,
+		`{"mounts": [
+			{"url": "https://a", "key": "a.pem", "ca": "ca.pem", "mountpoint": "/secrets"},
+			{"url": "https://b", "key": "b.pem", "ca": "ca.pem", "mountpoint": "/secrets/"}
+		]}`,
+		`{"mounts": [
+			{"url": "https://a", "key": "a.pem", "ca": "ca.pem", "mountpoint": "/secrets/a.b"},
+			{"url": "https://b", "key": "b.pem", "ca": "ca.pem", "mountpoint": "/secrets/a_b"}
+		]}`,
+	}
+	for _, data := range invalid {
+		_, err := ParseMountsConfig([]byte(data))
+		assert.Error(err, data)
+	}
+}
+
+func TestSupervisorApply(t *testing.T) {
+	assert := assert.New(t)
+
+	registry := metrics.NewRegistry()
+	supervisor := NewSupervisor(&sqmetrics.SquareMetrics{Registry: registry}, klog.Config{})
+	started := make(map[string]*fakeMount)
+	supervisor.start = func(def MountConfig, metricsHandle *sqmetrics.SquareMetrics) (mounted, error) {
+		if def.URL == "https://broken" {
+			return nil, errors.New("broken")
+		}
+		metrics.GetOrRegisterCounter("runtime.server.fails", metricsHandle.Registry).Inc(1)
+		m := &fakeMount{make(chan struct{})}
+		started[def.Mountpoint] = m
+		return m, nil
+	}
+
+	a := MountConfig{URL: "https://a", Key: "a.pem", CA: "ca.pem", Mountpoint: "/secrets/a"}
+	b := MountConfig{URL: "https://b", Key: "b.pem", CA: "ca.pem", Mountpoint: "/secrets/b"}
+	assert.NoError(supervisor.Apply([]MountConfig{b, a}))
+	assert.Equal([]MountConfig{a, b}, supervisor.Mounts())
+	assert.NotNil(registry.Get("-secrets-a.runtime.server.fails"))
+	assert.NotNil(registry.Get("-secrets-b.runtime.server.fails"))
+
+	// Unchanged mounts are left alone, changed ones remounted.
+	mountA := started[a.Mountpoint]
+	b2 := b
+	b2.User = "b"
+	assert.NoError(supervisor.Apply([]MountConfig{a, b2}))
+	assert.True(started[a.Mountpoint] == mountA)
+	assert.Equal([]MountConfig{a, b2}, supervisor.Mounts())
+
+	// Failing mounts don't prevent others.
+	c := MountConfig{URL: "https://broken", Key: "c.pem", CA: "ca.pem", Mountpoint: "/secrets/c"}
+	assert.Error(supervisor.Apply([]MountConfig{a, c}))
+	assert.Equal([]MountConfig{a}, supervisor.Mounts())
+	assert.Nil(registry.Get("-secrets-b.runtime.server.fails"))
+	assert.Nil(registry.Get("-secrets-c.runtime.server.fails"))
+
+	assert.Error(supervisor.Add(a))
+	assert.NoError(supervisor.Add(b))
+	assert.NoError(supervisor.Remove(b.Mountpoint + "/"))
+	assert.Error(supervisor.Remove(b.Mountpoint))
+
+	// Mounts unmounted externally are forgotten.
+	started[a.Mountpoint].Unmount()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(supervisor.Mounts()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Empty(supervisor.Mounts())
+
+	assert.NoError(supervisor.Close())
+}
+
+func TestSupervisorInvalidModeFlag(t *testing.T) {
+	assert := assert.New(t)
+
+	defer func(mask, max string) { *modeMask, *modeMax = mask, max }(*modeMask, *modeMax)
+	*modeMask, *modeMax = "0777", "0999"
+
+	// Only the mount fails, rather than the whole process.
+	supervisor := NewSupervisor(&sqmetrics.SquareMetrics{Registry: metrics.NewRegistry()}, klog.Config{})
+	err := supervisor.Add(MountConfig{URL: "https://a", Key: "a.pem", CA: "ca.pem", Mountpoint: "/secrets/a"})
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "--mode-max")
+	}
+	assert.Empty(supervisor.Mounts())
+	assert.NoError(supervisor.Close())
+}
+
+func TestMountRegistry(t *testing.T) {
+	assert := assert.New(t)
+
+	parent := metrics.NewRegistry()
+	metrics.GetOrRegisterCounter("runtime.server.fails", parent).Inc(1)
+	r := newMountRegistry(parent, "-secrets.")
+	metrics.GetOrRegisterCounter("runtime.server.fails", r).Inc(2)
+	metrics.GetOrRegisterGauge("runtime.cache.resident_bytes", r).Update(3)
+
+	assert.EqualValues(1, parent.Get("runtime.server.fails").(metrics.Counter).Count())
+	assert.EqualValues(2, parent.Get("-secrets.runtime.server.fails").(metrics.Counter).Count())
+	assert.EqualValues(2, r.Get("runtime.server.fails").(metrics.Counter).Count())
+
+	var names []string
+	r.Each(func(name string, _ interface{}) {
+		names = append(names, name)
+	})
+	sort.Strings(names)
+	assert.Equal([]string{"runtime.cache.resident_bytes", "runtime.server.fails"}, names)
+
+	// Closing unregisters the metrics of the mount only, and discards later ones.
+	r.close()
+	assert.NotNil(parent.Get("runtime.server.fails"))
+	assert.Nil(parent.Get("-secrets.runtime.server.fails"))
+	metrics.GetOrRegisterCounter("runtime.server.fails", r).Inc(1)
+	assert.Nil(parent.Get("-secrets.runtime.server.fails"))
+}
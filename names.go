@@ -0,0 +1,71 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxSecretNameLength is the longest secret name, the limit on file names of most filesystems.
+const maxSecretNameLength = 255
+
+// InvalidSecretName is returned when a name can't be that of a secret.
+type InvalidSecretName struct {
+	Name   string
+	Reason string
+}
+
+func (e InvalidSecretName) Error() string {
+	return fmt.Sprintf("invalid secret name %q: %s", e.Name, e.Reason)
+}
+
+// ValidateSecretName checks that a name can be that of a secret, and is safe to use as a file name
+// and in a URL path: it must be valid UTF-8 and a single path element, neither '.' nor '..', without
+// control characters.
+func ValidateSecretName(name string) error {
+	invalid := func(reason string) error {
+		return InvalidSecretName{name, reason}
+	}
+	switch {
+	case name == "":
+		return invalid("empty")
+	case len(name) > maxSecretNameLength:
+		return invalid("too long")
+	case name == "." || name == "..":
+		return invalid("path traversal")
+	case !utf8.ValidString(name):
+		return invalid("not UTF-8")
+	case strings.ContainsAny(name, "/\\"):
+		return invalid("contains a path separator")
+	case strings.IndexFunc(name, unicode.IsControl) >= 0:
+		return invalid("contains a control character")
+	}
+	return nil
+}
+
+// secretURL returns the URL of a secret on the server at base. The name is escaped, so it is a
+// single element under the secret endpoint; it must be valid.
+func secretURL(base url.URL, name string) *url.URL {
+	u := base
+	u.Path = strings.TrimSuffix(base.Path, "/") + "/secret/" + name
+	u.RawPath = strings.TrimSuffix(base.EscapedPath(), "/") + "/secret/" + url.PathEscape(name)
+	u.RawQuery = ""
+	u.Fragment = ""
+	return &u
+}
@@ -0,0 +1,135 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateSecretName(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, name := range []string{"foo", "General_Password..0be68f903f8b7d86", "with space", "100%", "a?b#c", ".hidden", "..foo", "ünïcödé"} {
+		assert.NoError(ValidateSecretName(name), name)
+	}
+	for _, name := range []string{"", ".", "..", "a/b", "../etc/passwd", `a\b`, "a\x00b", "a\nb", "\x7f", "\xff", strings.Repeat("a", 256)} {
+		err := ValidateSecretName(name)
+		assert.IsType(InvalidSecretName{}, err, name)
+	}
+}
+
+func TestSecretURL(t *testing.T) {
+	assert := assert.New(t)
+
+	base, _ := url.Parse("https://keywhiz.example.com:4444/api/?ignored=1#fragment")
+	for name, expected := range map[string]string{
+		"foo":        "https://keywhiz.example.com:4444/api/secret/foo",
+		"with space": "https://keywhiz.example.com:4444/api/secret/with%20space",
+		"100%":       "https://keywhiz.example.com:4444/api/secret/100%25",
+		"a?b#c":      "https://keywhiz.example.com:4444/api/secret/a%3Fb%23c",
+		"..foo":      "https://keywhiz.example.com:4444/api/secret/..foo",
+	} {
+		assert.Equal(expected, secretURL(*base, name).String(), name)
+	}
+
+	base, _ = url.Parse("https://localhost")
+	assert.Equal("https://localhost/secret/foo", secretURL(*base, "foo").String())
+}
+
+func FuzzSecretURL(f *testing.F) {
+	for _, name := range []string{"foo", "..", "a/../b", "a%2F..%2Fb", "a?b", "a#b", "a b", "%", "\x00", ".․"} {
+		f.Add("/api", name)
+	}
+	f.Fuzz(func(t *testing.T, basePath, name string) {
+		if ValidateSecretName(name) != nil {
+			return
+		}
+		base, err := url.Parse("https://localhost")
+		if err != nil {
+			t.Fatal(err)
+		}
+		base.Path = basePath
+		sent, err := url.Parse(base.String())
+		if err != nil {
+			return
+		}
+
+		// Parse the URL as the server would, and check it reaches the secret endpoint.
+		requested, err := url.Parse(secretURL(*base, name).String())
+		if err != nil {
+			t.Fatalf("unparseable URL for %q: %v", name, err)
+		}
+		prefix := strings.TrimSuffix(sent.Path, "/") + "/secret/"
+		if requested.Path != prefix+name {
+			t.Fatalf("URL for %q has path %q", name, requested.Path)
+		}
+		if requested.RawQuery != "" || requested.Fragment != "" {
+			t.Fatalf("URL for %q has query %q and fragment %q", name, requested.RawQuery, requested.Fragment)
+		}
+		if cleaned := path.Clean("/" + requested.Path); path.Dir(cleaned) != path.Clean("/"+prefix) {
+			t.Fatalf("URL for %q cleans to %q, outside %q", name, cleaned, prefix)
+		}
+	})
+}
+
+func TestClientEscapesSecretNames(t *testing.T) {
+	assert := assert.New(t)
+
+	requested := make(chan string, 1)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested <- r.URL.Path
+		w.WriteHeader(404)
+	}))
+	server.TLS = testCerts(testCaFile)
+	server.StartTLS()
+	defer server.Close()
+
+	serverURL, _ := url.Parse(server.URL)
+	metricsHandle := setupMetrics(metricsURL, metricsPrefix, *mountpoint)
+	client := NewClient(clientFile, clientFile, testCaFile, serverURL, time.Second, logConfig, metricsHandle)
+
+	_, err := client.RawSecret("a b?c#d%e")
+	assert.Equal(SecretDeleted{}, err)
+	assert.Equal("/secret/a b?c#d%e", <-requested)
+
+	_, err = client.RawSecret("../secrets")
+	assert.IsType(InvalidSecretName{}, err)
+	assert.Empty(requested, "invalid names should not be requested")
+}
+
+func TestFsRejectsInvalidSecretNames(t *testing.T) {
+	assert := assert.New(t)
+
+	backend := &CountingBackend{SecretBackend: NewMapBackend()}
+	kwfs, _, err := NewKeywhizFs(nil, backend, Ownership{Uid: 1000, Gid: 1000}, timeouts, nil, logConfig)
+	assert.NoError(err)
+
+	for _, name := range []string{"a\nb", ".json/secret/..", ".json/secret/a\x00"} {
+		_, status := kwfs.GetAttr(name, &fuse.Context{})
+		assert.Equal(fuse.ENOENT, status, name)
+		_, status = kwfs.Open(name, 0, &fuse.Context{})
+		assert.Equal(fuse.ENOENT, status, name)
+	}
+	assert.Zero(backend.Calls("a\nb"))
+}
@@ -15,16 +15,15 @@
 package main
 
 import (
-	"bufio"
-	"errors"
-	"log"
-	"os"
-	"os/user"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
 	"strconv"
-	"strings"
-)
+	"sync"
 
-var groupFile = "/etc/group"
+	"github.com/rcrowley/go-metrics"
+)
 
 // Ownership indicates the default ownership of filesystem entries.
 type Ownership struct {
@@ -32,61 +31,185 @@ type Ownership struct {
 	Gid uint32
 }
 
-// NewOwnership initializes default file ownership struct.
-func NewOwnership(username, groupname string) Ownership {
-	return Ownership{
-		Uid: lookupUid(username),
-		Gid: lookupGid(groupname),
+// NewOwnership initializes default file ownership struct, resolving names with ids. Like the owners
+// of secrets, a user or group which can't be resolved is returned, and replaced by the fallback uid
+// or gid of the rules.
+func NewOwnership(username, groupname string, rules OwnershipRules, ids *IdentityCache) (o Ownership, unresolvedUser, unresolvedGroup string) {
+	var ok bool
+	if o.Uid, ok = rules.resolve(username, ids.User); !ok {
+		o.Uid, unresolvedUser = rules.fallbackUid(), username
+	}
+	if o.Gid, ok = rules.resolve(groupname, ids.Group); !ok {
+		o.Gid, unresolvedGroup = rules.fallbackGid(), groupname
 	}
+	return
+}
+
+// nobodyID is the uid and gid of nobody, which owns secrets whose owner can't be resolved unless
+// configured otherwise.
+const nobodyID = 65534
+
+// OwnershipRule sets the owner and/or group of secrets whose name matches a glob pattern.
+type OwnershipRule struct {
+	Pattern string `json:"pattern"`
+	Owner   string `json:"owner"`
+	Group   string `json:"group"`
+}
+
+// OwnershipRules map the owners and groups of secrets on the server to local users and groups.
+type OwnershipRules struct {
+	// Users maps owners on the server to local usernames.
+	Users map[string]string `json:"users"`
+	// Groups maps groups on the server to local groupnames.
+	Groups map[string]string `json:"groups"`
+	// Rules set the owner and group of matching secrets, the first matching rule winning.
+	Rules []OwnershipRule `json:"rules"`
+	// NumericIDs accepts owners and groups which are numeric ids rather than names.
+	NumericIDs bool `json:"numeric_ids"`
+	// FallbackUid and FallbackGid own secrets whose owner or group can't be resolved. They
+	// default to nobody.
+	FallbackUid *uint32 `json:"fallback_uid"`
+	FallbackGid *uint32 `json:"fallback_gid"`
 }
 
-// lookupUid resolves a username to a numeric id. Current euid is returned on failure.
-func lookupUid(username string) uint32 {
-	u, err := user.Lookup(username)
-	if err != nil {
-		log.Printf("Error resolving uid for %v: %v\n", username, err)
-		return uint32(os.Geteuid())
+// UnmarshalJSON parses and validates ownership rules.
+func (r *OwnershipRules) UnmarshalJSON(data []byte) error {
+	type ownershipRules OwnershipRules
+	var rules ownershipRules
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return err
+	}
+	for _, rule := range rules.Rules {
+		if _, err := path.Match(rule.Pattern, ""); err != nil || rule.Pattern == "" {
+			return fmt.Errorf("ownership rule has invalid pattern %q", rule.Pattern)
+		}
+		if rule.Owner == "" && rule.Group == "" {
+			return fmt.Errorf("ownership rule for %q sets neither owner nor group", rule.Pattern)
+		}
+	}
+	for from, to := range rules.Users {
+		if from == "" || to == "" {
+			return fmt.Errorf("user mapping %q to %q is empty", from, to)
+		}
+	}
+	for from, to := range rules.Groups {
+		if from == "" || to == "" {
+			return fmt.Errorf("group mapping %q to %q is empty", from, to)
+		}
 	}
+	*r = OwnershipRules(rules)
+	return nil
+}
 
-	uid, err := strconv.ParseUint(u.Uid, 10 /* base */, 32 /* bits */)
-	if err != nil {
-		log.Printf("Error resolving uid for %v: %v\n", username, err)
-		return uint32(os.Geteuid())
+// Resolve returns the uid and gid owning a secret, given the default ownership of secrets without
+// an owner or group, resolving names with ids. An owner or group which can't be resolved is
+// returned, and owned by the fallback uid or gid.
+func (r OwnershipRules) Resolve(s *Secret, defaults Ownership, ids *IdentityCache) (uid, gid uint32, unresolvedUser, unresolvedGroup string) {
+	owner, group := s.Owner, s.Group
+	if mapped, ok := r.Users[owner]; ok {
+		owner = mapped
+	}
+	if mapped, ok := r.Groups[group]; ok {
+		group = mapped
+	}
+	for _, rule := range r.Rules {
+		if ok, _ := path.Match(rule.Pattern, s.Name); ok {
+			if rule.Owner != "" {
+				owner = rule.Owner
+			}
+			if rule.Group != "" {
+				group = rule.Group
+			}
+			break
+		}
 	}
 
-	return uint32(uid)
+	uid, gid = defaults.Uid, defaults.Gid
+	if owner != "" {
+		var ok bool
+		if uid, ok = r.resolve(owner, ids.User); !ok {
+			uid, unresolvedUser = r.fallbackUid(), owner
+		}
+	}
+	if group != "" {
+		var ok bool
+		if gid, ok = r.resolve(group, ids.Group); !ok {
+			gid, unresolvedGroup = r.fallbackGid(), group
+		}
+	}
+	return uid, gid, unresolvedUser, unresolvedGroup
 }
 
-// lookupGid resolves a groupname to a numeric id. Current egid is returned on failure.
-func lookupGid(groupname string) uint32 {
-	file, err := os.Open(groupFile)
-	if err != nil {
-		log.Printf("Error resolving gid for %v: %v\n", groupname, err)
-		return uint32(os.Getegid())
+// fallbackUid returns the uid owning files whose owner can't be resolved.
+func (r OwnershipRules) fallbackUid() uint32 {
+	if r.FallbackUid != nil {
+		return *r.FallbackUid
 	}
-	defer file.Close()
+	return nobodyID
+}
 
-	gid, err := lookupGidInFile(groupname, file)
-	if err != nil {
-		log.Printf("Error resolving gid for %v: %v\n", groupname, err)
-		return uint32(os.Getegid())
+// fallbackGid returns the gid owning files whose group can't be resolved.
+func (r OwnershipRules) fallbackGid() uint32 {
+	if r.FallbackGid != nil {
+		return *r.FallbackGid
 	}
+	return nobodyID
+}
 
-	return gid
+// resolve looks up a user or group name, or parses it as an id if numeric ids are accepted.
+func (r OwnershipRules) resolve(name string, lookup func(string) (uint32, error)) (uint32, bool) {
+	if r.NumericIDs {
+		if id, err := strconv.ParseUint(name, 10 /* base */, 32 /* bits */); err == nil {
+			return uint32(id), true
+		}
+	}
+	id, err := lookup(name)
+	return id, err == nil
 }
 
-func lookupGidInFile(groupname string, file *os.File) (uint32, error) {
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		entry := strings.Split(scanner.Text(), ":")
-		if entry[0] == groupname && len(entry) >= 3 {
-			gid, err := strconv.ParseUint(entry[2], 10 /* base */, 32 /* bits */)
-			if err != nil {
-				return 0, err
-			}
-			return uint32(gid), nil
+// secretOwnership returns the uid and gid owning a secret under the ownership rules, logging
+// owners and groups which can't be resolved the first time they are seen.
+func (kwfs KeywhizFs) secretOwnership(s *Secret) (uid, gid uint32) {
+	uid, gid, user, group := kwfs.Owners.Resolve(s, kwfs.Ownership, kwfs.Identities)
+	kwfs.noteUnresolved(user, group, "of secret "+s.Name, uid, gid)
+	return uid, gid
+}
+
+// noteUnresolved records an owner and group which couldn't be resolved, if not empty, logging
+// them the first time they are seen along with the files they were meant to own.
+func (kwfs KeywhizFs) noteUnresolved(user, group, files string, uid, gid uint32) {
+	if user != "" && kwfs.unresolvedUsers != nil {
+		if _, loaded := kwfs.unresolvedUsers.LoadOrStore(user, true); !loaded {
+			kwfs.Warnf("Unable to resolve owner %s %s, using uid %d", user, files, uid)
 		}
 	}
+	if group != "" && kwfs.unresolvedGroups != nil {
+		if _, loaded := kwfs.unresolvedGroups.LoadOrStore(group, true); !loaded {
+			kwfs.Warnf("Unable to resolve group %s %s, using gid %d", group, files, gid)
+		}
+	}
+}
 
-	return 0, errors.New("no such group")
+// reportOwnership updates gauges of the owners and groups of secrets which couldn't be resolved,
+// and of failed user and group lookups.
+func (kwfs KeywhizFs) reportOwnership() {
+	if kwfs.Metrics == nil {
+		return
+	}
+	metrics.GetOrRegisterGauge("runtime.secrets.unresolved_users", kwfs.Metrics.Registry).Update(int64(len(syncMapKeys(kwfs.unresolvedUsers))))
+	metrics.GetOrRegisterGauge("runtime.secrets.unresolved_groups", kwfs.Metrics.Registry).Update(int64(len(syncMapKeys(kwfs.unresolvedGroups))))
+	metrics.GetOrRegisterGauge("runtime.identity.lookup_failures", kwfs.Metrics.Registry).Update(int64(kwfs.Identities.Failures()))
+}
+
+// syncMapKeys returns the sorted string keys of m, which may be nil.
+func syncMapKeys(m *sync.Map) []string {
+	var keys []string
+	if m != nil {
+		m.Range(func(key, _ interface{}) bool {
+			keys = append(keys, key.(string))
+			return true
+		})
+	}
+	sort.Strings(keys)
+	return keys
 }
@@ -15,55 +15,140 @@
 package main
 
 import (
-	"io/ioutil"
+	"encoding/json"
 	"os"
 	"os/user"
 	"testing"
+	"time"
 
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/rcrowley/go-metrics"
+	"github.com/square/go-sq-metrics"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestOwnershipCurrentUser(t *testing.T) {
 	current, err := user.Current()
 	panicOnError(err)
-	ownership := NewOwnership(current.Username, "nobody")
-	assert.NotNil(t, ownership, "should never return nil")
+	ownership, unresolvedUser, unresolvedGroup := NewOwnership(current.Username, "root", OwnershipRules{}, NewSystemIdentityCache(time.Minute))
 	assert.EqualValues(t, ownership.Uid, os.Geteuid())
+	assert.EqualValues(t, 0, ownership.Gid)
+	assert.Empty(t, unresolvedUser)
+	assert.Empty(t, unresolvedGroup)
 }
 
 func TestOwnershipInvalidUser(t *testing.T) {
-	ownership := NewOwnership("invalid", "invalid")
-	assert.NotNil(t, ownership, "should never return nil")
+	assert := assert.New(t)
+
+	// Fails closed, like the owners of secrets.
+	ownership, unresolvedUser, unresolvedGroup := NewOwnership("no-such-user", "no-such-group", OwnershipRules{}, NewSystemIdentityCache(time.Minute))
+	assert.Equal(Ownership{nobodyID, nobodyID}, ownership)
+	assert.Equal("no-such-user", unresolvedUser)
+	assert.Equal("no-such-group", unresolvedGroup)
+
+	fallbackUid, fallbackGid := uint32(1), uint32(2)
+	ownership, _, _ = NewOwnership("no-such-user", "no-such-group", OwnershipRules{FallbackUid: &fallbackUid, FallbackGid: &fallbackGid}, NewSystemIdentityCache(time.Minute))
+	assert.Equal(Ownership{1, 2}, ownership)
 }
 
-func TestGroupFileMissing(t *testing.T) {
-	groupFile = "non-existent-file"
-	defer func() { groupFile = "/etc/group" }()
+func TestOwnershipRulesResolve(t *testing.T) {
+	assert := assert.New(t)
 
-	// Should fall back to current egid
-	gid := lookupGid("test0")
-	assert.EqualValues(t, gid, os.Getegid())
+	defaults := Ownership{Uid: 1000, Gid: 1000}
+	fallback := uint32(4242)
+	rules := OwnershipRules{
+		Users:  map[string]string{"admin": "root"},
+		Groups: map[string]string{"admins": "root"},
+		Rules: []OwnershipRule{
+			{Pattern: "*.key", Owner: "root"},
+			{Pattern: "shared_*", Group: "root"},
+		},
+	}
+	numeric := OwnershipRules{NumericIDs: true}
+	closed := OwnershipRules{FallbackUid: &fallback, FallbackGid: &fallback}
+
+	cases := []struct {
+		rules           OwnershipRules
+		secret          Secret
+		uid, gid        uint32
+		unresolvedUser  string
+		unresolvedGroup string
+	}{
+		{OwnershipRules{}, Secret{Name: "a"}, 1000, 1000, "", ""},
+		{OwnershipRules{}, Secret{Name: "a", Owner: "root", Group: "root"}, 0, 0, "", ""},
+		{OwnershipRules{}, Secret{Name: "a", Owner: "no-such-user", Group: "no-such-group"}, nobodyID, nobodyID, "no-such-user", "no-such-group"},
+		{closed, Secret{Name: "a", Owner: "no-such-user", Group: "no-such-group"}, fallback, fallback, "no-such-user", "no-such-group"},
+		{rules, Secret{Name: "a", Owner: "admin", Group: "admins"}, 0, 0, "", ""},
+		{rules, Secret{Name: "a.key", Owner: "no-such-user"}, 0, 1000, "", ""},
+		{rules, Secret{Name: "shared_a", Group: "no-such-group"}, 1000, 0, "", ""},
+		{OwnershipRules{}, Secret{Name: "a", Owner: "1234", Group: "1235"}, nobodyID, nobodyID, "1234", "1235"},
+		{numeric, Secret{Name: "a", Owner: "1234", Group: "1235"}, 1234, 1235, "", ""},
+		{numeric, Secret{Name: "a", Owner: "root", Group: "root"}, 0, 0, "", ""},
+	}
+	ids := NewSystemIdentityCache(time.Minute)
+	for _, c := range cases {
+		uid, gid, user, group := c.rules.Resolve(&c.secret, defaults, ids)
+		assert.Equal(c.uid, uid, "uid of %+v", c.secret)
+		assert.Equal(c.gid, gid, "gid of %+v", c.secret)
+		assert.Equal(c.unresolvedUser, user, "unresolved user of %+v", c.secret)
+		assert.Equal(c.unresolvedGroup, group, "unresolved group of %+v", c.secret)
+	}
 }
 
-func TestGroupFileParsingValid(t *testing.T) {
-	file, err := ioutil.TempFile("", "keywhiz-fs-test")
-	panicOnError(err)
-	defer os.Remove(file.Name())
+func TestParseOwnershipRules(t *testing.T) {
+	assert := assert.New(t)
+
+	config, err := ParseConfig([]byte(`{"ownership": {"users": {"admin": "root"}, "rules": [{"pattern": "*.key", "group": "root"}], "numeric_ids": true, "fallback_uid": 0}}`))
+	assert.NoError(err)
+	assert.Equal(map[string]string{"admin": "root"}, config.Ownership.Users)
+	assert.Equal([]OwnershipRule{{Pattern: "*.key", Group: "root"}}, config.Ownership.Rules)
+	assert.True(config.Ownership.NumericIDs)
+	if assert.NotNil(config.Ownership.FallbackUid) {
+		assert.EqualValues(0, *config.Ownership.FallbackUid)
+	}
+	assert.Nil(config.Ownership.FallbackGid)
+}
+
+func TestFsUnresolvedOwners(t *testing.T) {
+	assert := assert.New(t)
+
+	backend := NewMapBackend(
+		Secret{Name: "a", Content: content("a"), Owner: "no-such-user"},
+		Secret{Name: "b", Content: content("b"), Owner: "no-such-user", Group: "no-such-group"},
+		Secret{Name: "c", Content: content("c"), Owner: "root"})
+	registry := metrics.NewRegistry()
+	kwfs, _, err := NewKeywhizFs(nil, backend, Ownership{Uid: 1000, Gid: 1000}, timeouts, &sqmetrics.SquareMetrics{Registry: registry}, logConfig)
+	assert.NoError(err)
 
-	file.WriteString("test0:x:1234:test0,test1\n")
-	file.WriteString("test1:x:1235:test0,test1\n")
-	file.WriteString("test2:x:1236:test0,test1\n")
-	file.Sync()
+	for _, name := range []string{"a", "b", "c"} {
+		_, status := kwfs.GetAttr(name, &fuse.Context{})
+		assert.Equal(fuse.OK, status, name)
+	}
+	attr, _ := kwfs.GetAttr("b", &fuse.Context{})
+	assert.EqualValues(nobodyID, attr.Uid)
+	assert.EqualValues(nobodyID, attr.Gid)
 
-	groupFile = file.Name()
-	defer func() { groupFile = "/etc/group" }()
+	var status StatusInfo
+	assert.NoError(json.Unmarshal(kwfs.statusJSON(), &status))
+	assert.Equal([]string{"no-such-user"}, status.UnresolvedUsers)
+	assert.Equal([]string{"no-such-group"}, status.UnresolvedGroups)
 
-	gid := lookupGid("test0")
-	assert.EqualValues(t, 1234, gid)
+	kwfs.reportOwnership()
+	assert.EqualValues(1, metrics.GetOrRegisterGauge("runtime.secrets.unresolved_users", registry).Value())
+	assert.EqualValues(1, metrics.GetOrRegisterGauge("runtime.secrets.unresolved_groups", registry).Value())
 
-	gid = lookupGid("test1")
-	assert.EqualValues(t, 1235, gid)
+	// The default owner and group are counted alike.
+	kwfs.noteUnresolved("keywhiz", "", "of files by default", nobodyID, 1000)
+	kwfs.reportOwnership()
+	assert.EqualValues(2, metrics.GetOrRegisterGauge("runtime.secrets.unresolved_users", registry).Value())
+	assert.EqualValues(1, metrics.GetOrRegisterGauge("runtime.secrets.unresolved_groups", registry).Value())
+	assert.NotZero(metrics.GetOrRegisterGauge("runtime.identity.lookup_failures", registry).Value())
 
-	gid = lookupGid("test2")
-	assert.EqualValues(t, 1236, gid)
+	// Each filesystem has its own identity cache, counting only its own failed lookups.
+	otherRegistry := metrics.NewRegistry()
+	other, _, err := NewKeywhizFs(nil, backend, Ownership{Uid: 1000, Gid: 1000}, timeouts, &sqmetrics.SquareMetrics{Registry: otherRegistry}, logConfig)
+	assert.NoError(err)
+	assert.False(other.Identities == kwfs.Identities)
+	other.reportOwnership()
+	assert.EqualValues(0, metrics.GetOrRegisterGauge("runtime.identity.lookup_failures", otherRegistry).Value())
 }
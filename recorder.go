@@ -0,0 +1,400 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/square/go-sq-metrics"
+	klog "github.com/square/keywhiz-fs/log"
+)
+
+const (
+	traceOpSecret     = "secret"
+	traceOpSecretList = "secret_list"
+
+	traceResultOk      = "ok"
+	traceResultDeleted = "deleted"
+	traceResultError   = "error"
+	traceResultDropped = "dropped"
+)
+
+// errTraceExhausted is returned by a ReplayBackend when more calls are made than were recorded.
+var errTraceExhausted = errors.New("trace exhausted")
+
+// errEventDropped is returned by a ReplayBackend for a call the RecordingBackend failed to record.
+var errEventDropped = errors.New("call was not recorded")
+
+// TraceEvent is a single backend call captured by a RecordingBackend.
+type TraceEvent struct {
+	Op      string        `json:"op"`
+	Name    string        `json:"name,omitempty"`
+	Offset  time.Duration `json:"offset"`
+	Latency time.Duration `json:"latency"`
+	Result  string        `json:"result"`
+	Error   string        `json:"error,omitempty"`
+	Secret  *Secret       `json:"secret,omitempty"`
+	Secrets []Secret      `json:"secrets,omitempty"`
+}
+
+// TraceCodec transforms secret content on its way into and out of a trace file.
+type TraceCodec interface {
+	Encode(content) (content, error)
+	Decode(content) (content, error)
+}
+
+// redactingCodec replaces content with a placeholder of the same length, so that a replay still
+// sees non-empty content with a matching Length.
+type redactingCodec struct{}
+
+func (redactingCodec) Encode(c content) (content, error) {
+	return content(bytes.Repeat([]byte("x"), len(c))), nil
+}
+
+func (redactingCodec) Decode(c content) (content, error) {
+	return c, nil
+}
+
+// NewRedactingCodec returns a TraceCodec which discards secret content.
+func NewRedactingCodec() TraceCodec {
+	return redactingCodec{}
+}
+
+// aeadCodec seals content with AES-GCM. The nonce is prepended to the ciphertext.
+type aeadCodec struct {
+	aead cipher.AEAD
+}
+
+// NewEncryptingCodec returns a TraceCodec which encrypts secret content with the given AES key.
+func NewEncryptingCodec(key []byte) (TraceCodec, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return aeadCodec{aead}, nil
+}
+
+func (c aeadCodec) Encode(plaintext content) (content, error) {
+	if len(plaintext) == 0 {
+		return plaintext, nil
+	}
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return c.aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func (c aeadCodec) Decode(sealed content) (content, error) {
+	if len(sealed) == 0 {
+		return sealed, nil
+	}
+	size := c.aead.NonceSize()
+	if len(sealed) < size {
+		return nil, errors.New("sealed content too short")
+	}
+	return c.aead.Open(nil, sealed[:size], sealed[size:], nil)
+}
+
+// RecordingBackend wraps a SecretBackend and writes every call, with its result and latency, to a
+// trace. Secret content is passed through a TraceCodec before being written.
+//
+// A call which can't be recorded is logged, counted, and replaced in the trace by a marker event,
+// which a ReplayBackend serves as an error rather than skipping the call.
+type RecordingBackend struct {
+	*klog.Logger
+	backend SecretBackend
+	codec   TraceCodec
+	start   time.Time
+	lock    sync.Mutex
+	w       io.Writer
+	partial bool // The last write was partial.
+	dropped metrics.Counter
+}
+
+// NewRecordingBackend initializes a RecordingBackend writing JSON lines to w. Calls which can't be
+// recorded are counted in the registry of metricsHandle, if any.
+func NewRecordingBackend(backend SecretBackend, w io.Writer, codec TraceCodec, logConfig klog.Config, metricsHandle *sqmetrics.SquareMetrics) *RecordingBackend {
+	dropped := metrics.NewCounter()
+	if metricsHandle != nil {
+		dropped = metrics.GetOrRegisterCounter("runtime.trace.dropped", metricsHandle.Registry)
+	}
+	return &RecordingBackend{
+		Logger:  klog.New("kwfs_trace", logConfig),
+		backend: backend,
+		codec:   codec,
+		start:   time.Now(),
+		w:       w,
+		dropped: dropped,
+	}
+}
+
+// Secret calls the wrapped backend and records the result.
+func (r *RecordingBackend) Secret(name string) (*Secret, error) {
+	start := time.Now()
+	secret, err := r.backend.Secret(name)
+	event := TraceEvent{
+		Op:      traceOpSecret,
+		Name:    name,
+		Offset:  start.Sub(r.start),
+		Latency: time.Since(start),
+	}
+	switch err.(type) {
+	case nil:
+		event.Result = traceResultOk
+		encoded, encodeErr := r.encodeSecret(*secret)
+		if encodeErr != nil {
+			r.drop(event, encodeErr)
+			return secret, err
+		}
+		event.Secret = &encoded
+	case SecretDeleted:
+		event.Result = traceResultDeleted
+	default:
+		event.Result = traceResultError
+		event.Error = err.Error()
+	}
+	r.write(event)
+	return secret, err
+}
+
+// SecretList calls the wrapped backend and records the result.
+func (r *RecordingBackend) SecretList() ([]Secret, bool) {
+	start := time.Now()
+	secrets, ok := r.backend.SecretList()
+	event := TraceEvent{
+		Op:      traceOpSecretList,
+		Offset:  start.Sub(r.start),
+		Latency: time.Since(start),
+		Result:  traceResultOk,
+	}
+	if ok {
+		event.Secrets = make([]Secret, 0, len(secrets))
+		for _, s := range secrets {
+			encoded, err := r.encodeSecret(s)
+			if err != nil {
+				r.drop(event, err)
+				return secrets, ok
+			}
+			event.Secrets = append(event.Secrets, encoded)
+		}
+	} else {
+		event.Result = traceResultError
+	}
+	r.write(event)
+	return secrets, ok
+}
+
+func (r *RecordingBackend) encodeSecret(s Secret) (Secret, error) {
+	encoded, err := r.codec.Encode(s.Content)
+	if err != nil {
+		return s, err
+	}
+	s.Content = encoded
+	return s, nil
+}
+
+// write appends an event to the trace, or a marker if that fails. Failures never affect the mount.
+func (r *RecordingBackend) write(event TraceEvent) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	n, err := r.encode(event, r.partial)
+	if err != nil {
+		r.partial = r.partial || n > 0
+		r.dropLocked(event, err)
+		return
+	}
+	r.partial = false
+}
+
+// encode writes a single event as one line with a single Write, returning how much was written.
+// A line following a partial write starts with a newline, so that only the partial line is corrupt.
+func (r *RecordingBackend) encode(event TraceEvent, newline bool) (int, error) {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return 0, err
+	}
+	if newline {
+		line = append([]byte{'\n'}, line...)
+	}
+	return r.w.Write(append(line, '\n'))
+}
+
+// drop records a marker in place of an event which couldn't be recorded.
+func (r *RecordingBackend) drop(event TraceEvent, err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.dropLocked(event, err)
+}
+
+func (r *RecordingBackend) dropLocked(event TraceEvent, err error) {
+	r.Warnf("Unable to record %s call %q, replays of the trace will fail it: %v", event.Op, event.Name, err)
+	r.dropped.Inc(1)
+	marker := TraceEvent{
+		Op:      event.Op,
+		Name:    event.Name,
+		Offset:  event.Offset,
+		Latency: event.Latency,
+		Result:  traceResultDropped,
+		Error:   err.Error(),
+	}
+	n, err := r.encode(marker, r.partial)
+	if err != nil {
+		r.Errorf("Unable to record marker for %s call %q: %v", event.Op, event.Name, err)
+	}
+	r.partial = err != nil && (r.partial || n > 0)
+}
+
+// ReplayBackend serves the calls of a recorded trace back in order, with their original latency.
+// Secret calls are matched by name; SecretList calls are served in recorded order.
+type ReplayBackend struct {
+	events  []TraceEvent
+	secrets map[string][]TraceEvent
+	lists   []TraceEvent
+	lock    sync.Mutex
+	sleep   func(time.Duration)
+}
+
+// NewReplayBackend reads a trace written by a RecordingBackend. A corrupt line is only accepted
+// when followed by the marker of the call it failed to record.
+func NewReplayBackend(r io.Reader, codec TraceCodec) (*ReplayBackend, error) {
+	replay := &ReplayBackend{secrets: make(map[string][]TraceEvent), sleep: time.Sleep}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	var corrupt error
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var event TraceEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			if corrupt != nil {
+				return nil, corrupt
+			}
+			corrupt = fmt.Errorf("Fail to deserialize trace event: %v", err)
+			continue
+		}
+		if corrupt != nil && event.Result != traceResultDropped {
+			return nil, corrupt
+		}
+		corrupt = nil
+		if event.Secret != nil {
+			decoded, err := codec.Decode(event.Secret.Content)
+			if err != nil {
+				return nil, fmt.Errorf("Fail to decode trace content for %v: %v", event.Name, err)
+			}
+			event.Secret.Content = decoded
+		}
+		for i := range event.Secrets {
+			decoded, err := codec.Decode(event.Secrets[i].Content)
+			if err != nil {
+				return nil, fmt.Errorf("Fail to decode trace content for %v: %v", event.Secrets[i].Name, err)
+			}
+			event.Secrets[i].Content = decoded
+		}
+
+		replay.events = append(replay.events, event)
+		switch event.Op {
+		case traceOpSecret:
+			replay.secrets[event.Name] = append(replay.secrets[event.Name], event)
+		case traceOpSecretList:
+			replay.lists = append(replay.lists, event)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if corrupt != nil {
+		return nil, corrupt
+	}
+	return replay, nil
+}
+
+// Events returns every recorded event in trace order.
+func (r *ReplayBackend) Events() []TraceEvent {
+	return r.events
+}
+
+// Run calls fn for every recorded event at its original offset from the start of the trace. It is
+// used to drive a Cache or KeywhizFs with the same call pattern that was recorded.
+func (r *ReplayBackend) Run(fn func(TraceEvent)) {
+	start := time.Now()
+	for _, event := range r.events {
+		if wait := event.Offset - time.Since(start); wait > 0 {
+			r.sleep(wait)
+		}
+		fn(event)
+	}
+}
+
+// Secret returns the next recorded result for name.
+func (r *ReplayBackend) Secret(name string) (*Secret, error) {
+	r.lock.Lock()
+	queue := r.secrets[name]
+	if len(queue) == 0 {
+		r.lock.Unlock()
+		return nil, errTraceExhausted
+	}
+	event := queue[0]
+	r.secrets[name] = queue[1:]
+	r.lock.Unlock()
+
+	r.sleep(event.Latency)
+	switch event.Result {
+	case traceResultOk:
+		secret := *event.Secret
+		return &secret, nil
+	case traceResultDeleted:
+		return nil, SecretDeleted{}
+	case traceResultDropped:
+		return nil, errEventDropped
+	default:
+		return nil, errors.New(event.Error)
+	}
+}
+
+// SecretList returns the next recorded secret listing. A listing which wasn't recorded fails.
+func (r *ReplayBackend) SecretList() ([]Secret, bool) {
+	r.lock.Lock()
+	if len(r.lists) == 0 {
+		r.lock.Unlock()
+		return nil, false
+	}
+	event := r.lists[0]
+	r.lists = r.lists[1:]
+	r.lock.Unlock()
+
+	r.sleep(event.Latency)
+	if event.Result != traceResultOk {
+		return nil, false
+	}
+	return append([]Secret(nil), event.Secrets...), true
+}
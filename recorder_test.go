@@ -0,0 +1,251 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/square/keywhiz-fs/log"
+	"github.com/stretchr/testify/assert"
+)
+
+// ScriptedBackend returns its responses in order, after an optional delay.
+type ScriptedBackend struct {
+	lock    sync.Mutex
+	delay   time.Duration
+	secrets []secretResult
+	lists   [][]Secret
+}
+
+func (b *ScriptedBackend) Secret(name string) (*Secret, error) {
+	time.Sleep(b.delay)
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if len(b.secrets) == 0 {
+		return nil, errors.New("script exhausted")
+	}
+	result := b.secrets[0]
+	b.secrets = b.secrets[1:]
+	return result.secret, result.err
+}
+
+func (b *ScriptedBackend) SecretList() ([]Secret, bool) {
+	time.Sleep(b.delay)
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if len(b.lists) == 0 {
+		return nil, false
+	}
+	list := b.lists[0]
+	b.lists = b.lists[1:]
+	return list, true
+}
+
+func TestRecordingBackendRedactsContent(t *testing.T) {
+	assert := assert.New(t)
+
+	secretFixture, _ := ParseSecret(fixture("secret.json"))
+	backend := &ScriptedBackend{
+		delay: 20 * time.Millisecond,
+		secrets: []secretResult{
+			{secretFixture, nil},
+			{nil, SecretDeleted{}},
+			{nil, errors.New("boom")},
+		},
+		lists: [][]Secret{{*secretFixture}},
+	}
+
+	var trace bytes.Buffer
+	recorder := NewRecordingBackend(backend, &trace, NewRedactingCodec(), logConfig, nil)
+	recorder.Secret(secretFixture.Name)
+	recorder.Secret(secretFixture.Name)
+	recorder.Secret(secretFixture.Name)
+	recorder.SecretList()
+	recorder.SecretList()
+
+	assert.NotContains(trace.String(), "YXNkZGFz", "trace should not contain secret content")
+
+	replay, err := NewReplayBackend(&trace, NewRedactingCodec())
+	assert.NoError(err)
+	assert.Len(replay.Events(), 5)
+
+	start := time.Now()
+	secret, err := replay.Secret(secretFixture.Name)
+	assert.NoError(err)
+	assert.True(time.Since(start) >= 20*time.Millisecond, "replay should keep original latency")
+	assert.Equal(secretFixture.Name, secret.Name)
+	assert.Equal(secretFixture.Length, secret.Length)
+	assert.EqualValues("xxxxxx", secret.Content)
+
+	_, err = replay.Secret(secretFixture.Name)
+	_, deleted := err.(SecretDeleted)
+	assert.True(deleted)
+
+	_, err = replay.Secret(secretFixture.Name)
+	assert.EqualError(err, "boom")
+
+	_, err = replay.Secret(secretFixture.Name)
+	assert.Equal(errTraceExhausted, err)
+
+	list, ok := replay.SecretList()
+	assert.True(ok)
+	assert.Len(list, 1)
+
+	_, ok = replay.SecretList()
+	assert.False(ok)
+}
+
+func TestRecordingBackendEncryptsContent(t *testing.T) {
+	assert := assert.New(t)
+
+	secretFixture, _ := ParseSecret(fixture("secret.json"))
+	backend := &ScriptedBackend{secrets: []secretResult{{secretFixture, nil}}}
+
+	codec, err := NewEncryptingCodec(bytes.Repeat([]byte{7}, 32))
+	assert.NoError(err)
+
+	var trace bytes.Buffer
+	recorder := NewRecordingBackend(backend, &trace, codec, logConfig, nil)
+	recorder.Secret(secretFixture.Name)
+	assert.NotContains(trace.String(), "YXNkZGFz", "trace should not contain secret content")
+
+	replay, err := NewReplayBackend(bytes.NewReader(trace.Bytes()), codec)
+	assert.NoError(err)
+	secret, err := replay.Secret(secretFixture.Name)
+	assert.NoError(err)
+	assert.Equal(secretFixture.Content, secret.Content)
+
+	// A trace can't be read back with the wrong key
+	wrongCodec, _ := NewEncryptingCodec(bytes.Repeat([]byte{8}, 32))
+	_, err = NewReplayBackend(bytes.NewReader(trace.Bytes()), wrongCodec)
+	assert.Error(err)
+}
+
+// failingCodec fails to encode any content.
+type failingCodec struct{ redactingCodec }
+
+func (failingCodec) Encode(c content) (content, error) {
+	return nil, errors.New("encode failed")
+}
+
+// failingWriter fails its first writes, and then writes only half of the next partial ones.
+type failingWriter struct {
+	bytes.Buffer
+	fails   int
+	partial int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if w.fails > 0 {
+		w.fails--
+		return 0, errors.New("write failed")
+	}
+	if w.partial > 0 {
+		w.partial--
+		n, _ := w.Buffer.Write(p[:len(p)/2])
+		return n, errors.New("short write")
+	}
+	return w.Buffer.Write(p)
+}
+
+func TestRecordingBackendMarksDroppedEvents(t *testing.T) {
+	assert := assert.New(t)
+
+	secretFixture, _ := ParseSecret(fixture("secret.json"))
+	backend := &ScriptedBackend{
+		secrets: []secretResult{{secretFixture, nil}, {nil, SecretDeleted{}}, {nil, errors.New("boom")}},
+		lists:   [][]Secret{{*secretFixture}},
+	}
+
+	// Content which can't be encoded is still served, and a marker is recorded in its place.
+	var trace failingWriter
+	recorder := NewRecordingBackend(backend, &trace, failingCodec{}, logConfig, nil)
+	secret, err := recorder.Secret(secretFixture.Name)
+	assert.NoError(err)
+	assert.Equal(secretFixture.Name, secret.Name)
+	_, ok := recorder.SecretList()
+	assert.True(ok)
+
+	// An event which can't be written is replaced by a marker too.
+	trace.fails = 1
+	_, err = recorder.Secret(secretFixture.Name)
+	assert.IsType(SecretDeleted{}, err)
+
+	// After a partial write, the marker starts on a new line and the corrupt line is skipped.
+	trace.partial = 1
+	_, err = recorder.Secret(secretFixture.Name)
+	assert.EqualError(err, "boom")
+	assert.EqualValues(4, recorder.dropped.Count())
+
+	replay, err := NewReplayBackend(bytes.NewReader(trace.Bytes()), NewRedactingCodec())
+	assert.NoError(err)
+	assert.Len(replay.Events(), 4)
+	_, err = replay.Secret(secretFixture.Name)
+	assert.Equal(errEventDropped, err)
+	_, err = replay.Secret(secretFixture.Name)
+	assert.Equal(errEventDropped, err)
+	_, err = replay.Secret(secretFixture.Name)
+	assert.Equal(errEventDropped, err)
+	_, ok = replay.SecretList()
+	assert.False(ok)
+
+	// Other corrupt lines are still rejected.
+	_, err = NewReplayBackend(bytes.NewBufferString("{\"op\":\n{\"op\":\"secret_list\",\"result\":\"error\"}\n"), NewRedactingCodec())
+	assert.Error(err)
+}
+
+func TestReplayBackendDrivesCacheAndFs(t *testing.T) {
+	assert := assert.New(t)
+
+	secretFixture, _ := ParseSecret(fixture("secret.json"))
+	backend := &ScriptedBackend{
+		secrets: []secretResult{
+			{secretFixture, nil},
+			{nil, SecretDeleted{}},
+		},
+	}
+
+	var trace bytes.Buffer
+	recorder := NewRecordingBackend(backend, &trace, NewRedactingCodec(), logConfig, nil)
+	timeouts := Timeouts{0, 10 * time.Millisecond, 20 * time.Millisecond, 1 * time.Hour}
+	recordedCache := NewCache(recorder, timeouts, logConfig, nil)
+	recordedCache.Secret(secretFixture.Name)
+	time.Sleep(5 * time.Millisecond)
+	recordedCache.Secret(secretFixture.Name)
+
+	replay, err := NewReplayBackend(&trace, NewRedactingCodec())
+	assert.NoError(err)
+
+	fakeClock := time.Now()
+	cache := NewCache(replay, timeouts, logConfig, func() time.Time { return fakeClock })
+	kwfs := &KeywhizFs{Logger: log.New("kwfs_test", logConfig), Cache: cache, Timeout: time.Second, Identities: NewSystemIdentityCache(time.Minute)}
+
+	var statuses []fuse.Status
+	replay.Run(func(event TraceEvent) {
+		_, status := kwfs.GetAttr(event.Name, fuseContext)
+		statuses = append(statuses, status)
+	})
+	// The deletion is delayed, so both lookups succeed just as they did when recording.
+	assert.Equal([]fuse.Status{fuse.OK, fuse.OK}, statuses)
+
+	fakeClock = fakeClock.Add(2 * time.Hour)
+	_, status := kwfs.GetAttr(secretFixture.Name, fuseContext)
+	assert.Equal(fuse.ENOENT, status)
+}
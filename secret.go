@@ -15,22 +15,30 @@
 package main
 
 import (
+	"bytes"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"strconv"
-	"strings"
 	"time"
 
 	"golang.org/x/sys/unix"
 )
 
-// ParseSecret deserializes raw JSON into a Secret struct.
+// ParseSecret deserializes raw JSON into a Secret struct. The length of a secret with content is
+// that of its content, whatever the server reported.
 func ParseSecret(data []byte) (s *Secret, err error) {
 	if err = json.Unmarshal(data, &s); err != nil {
 		return nil, fmt.Errorf("Fail to deserialize JSON Secret: %v", err)
 	}
+	if s == nil {
+		return nil, fmt.Errorf("Fail to deserialize JSON Secret: got null")
+	}
+	if s.Content != nil {
+		s.Length = uint64(len(s.Content))
+	}
 	return
 }
 
@@ -54,10 +62,46 @@ type Secret struct {
 	Mode        string
 	Owner       string
 	Group       string
+	Description string
+	// Expiry is in seconds since the epoch, or zero if the secret doesn't expire.
+	Expiry int64
+
+	// buf is a reference to the secureBuffer holding Content, for secrets returned by the client
+	// and the cache. It is nil for content on the heap.
+	buf *secureBuffer
 }
 
-// ModeValue function helps by converting a textual mode to the expected value for fuse.
-func (s Secret) ModeValue() uint32 {
+// Release drops the reference the secret holds to its content, if any. Secrets returned by the
+// cache with content must be released once read, and their content not read afterwards.
+func (s *Secret) Release() {
+	if s != nil {
+		s.buf.Release()
+		s.buf = nil
+	}
+}
+
+// metadata returns a copy of the secret without its content. The length is that of the content,
+// if there was any.
+func (s Secret) metadata() Secret {
+	if s.Content != nil {
+		s.Length = uint64(len(s.Content))
+	}
+	s.Content = nil
+	s.buf = nil
+	return s
+}
+
+// ExpiresAt returns when the secret expires, if it does.
+func (s Secret) ExpiresAt() (time.Time, bool) {
+	if s.Expiry <= 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(s.Expiry, 0).UTC(), true
+}
+
+// RequestedMode returns the mode set on the server, including any bits other than permissions.
+// Secrets without a valid mode have mode 0440.
+func (s Secret) RequestedMode() uint32 {
 	mode := s.Mode
 	if mode == "" {
 		mode = "0440"
@@ -67,28 +111,84 @@ func (s Secret) ModeValue() uint32 {
 		log.Printf("Unable to convert secret mode (%v) to octal, using '0440': %v\n", mode, err)
 		modeValue = 0440
 	}
-	return uint32(modeValue | unix.S_IFREG)
+	return uint32(modeValue)
+}
+
+// ModeValue function helps by converting a textual mode to the expected value for fuse. Only
+// permission bits are kept: secrets are always regular files, never setuid or setgid.
+func (s Secret) ModeValue() uint32 {
+	return s.RequestedMode()&0777 | unix.S_IFREG
 }
 
 // content is a helper type used to convert base64-encoded data from the server.
 type content []byte
 
 func (c *content) UnmarshalJSON(data []byte) error {
-	var s string
-	if err := json.Unmarshal(data, &s); err != nil {
-		return fmt.Errorf("secret should be a string, got '%s' (%v)", data, err)
+	if string(data) == "null" {
+		return nil
 	}
-
-	// Go's base64 requires padding to be present so we add it if necessary.
-	if m := len(s) % 4; m != 0 {
-		s += strings.Repeat("=", 4-m)
+	// Strings without escapes are decoded in place, so the encoded content isn't copied to the
+	// heap; it is zeroed along with the response holding it. Other strings are unescaped into a
+	// scratch slice, zeroed once decoded.
+	if len(data) < 2 || data[0] != '"' || data[len(data)-1] != '"' {
+		return errors.New("secret should be a string")
+	}
+	encoded := data[1 : len(data)-1]
+	if bytes.IndexByte(encoded, '\\') >= 0 {
+		var err error
+		if encoded, err = unescapeBase64(encoded); err != nil {
+			return err
+		}
+		defer zero(encoded)
 	}
 
-	decoded, err := base64.StdEncoding.DecodeString(s)
+	// Padding is optional.
+	encoded = bytes.TrimRight(encoded, "=")
+	decoded := make([]byte, base64.RawStdEncoding.DecodedLen(len(encoded)))
+	n, err := base64.RawStdEncoding.Decode(decoded, encoded)
 	if err != nil {
-		return fmt.Errorf("secret not valid base64, got '%+v' (%v)", s, err)
+		zero(decoded)
+		return fmt.Errorf("secret not valid base64 (%v)", err)
 	}
 
-	*c = decoded
+	*c = decoded[:n]
 	return nil
 }
+
+// unescapeBase64 unescapes the body of a JSON string holding base64 content into a new slice.
+// Only escapes of ASCII characters are accepted, as no others can be part of base64 content.
+func unescapeBase64(escaped []byte) ([]byte, error) {
+	unescaped := make([]byte, 0, len(escaped))
+	for i := 0; i < len(escaped); i++ {
+		if escaped[i] != '\\' {
+			unescaped = append(unescaped, escaped[i])
+			continue
+		}
+		switch {
+		case i+1 < len(escaped) && escaped[i+1] == '/':
+			unescaped = append(unescaped, '/')
+			i++
+		case i+5 < len(escaped) && escaped[i+1] == 'u' && bytes.HasPrefix(escaped[i+2:], []byte("00")):
+			// Parsed by hand, so that the escaped character isn't copied into a string.
+			r := 0
+			for _, h := range escaped[i+4 : i+6] {
+				d := bytes.IndexByte([]byte("0123456789abcdef"), h|0x20)
+				if d < 0 {
+					zero(unescaped)
+					return nil, errors.New("secret should be a base64 string")
+				}
+				r = r<<4 | d
+			}
+			if r >= 0x80 {
+				zero(unescaped)
+				return nil, errors.New("secret should be a base64 string")
+			}
+			unescaped = append(unescaped, byte(r))
+			i += 5
+		default:
+			zero(unescaped)
+			return nil, errors.New("secret should be a base64 string")
+		}
+	}
+	return unescaped, nil
+}
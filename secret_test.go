@@ -15,6 +15,10 @@
 package main
 
 import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
 	"testing"
 	"time"
 
@@ -39,6 +43,22 @@ func TestDeserializeSecret(t *testing.T) {
 	assert.Equal(s.CreatedAt.Unix(), expectedCreatedAt.Unix())
 }
 
+func TestDeserializeSecretWithExpiry(t *testing.T) {
+	assert := assert.New(t)
+
+	s, err := ParseSecret(fixture("secretWithExpiry.json"))
+	assert.NoError(err)
+	assert.Equal("API token for the billing service", s.Description)
+	expiry, ok := s.ExpiresAt()
+	assert.True(ok)
+	assert.Equal(time.Date(2030, time.January, 1, 0, 0, 0, 0, time.UTC), expiry)
+
+	s, err = ParseSecret(fixture("secret.json"))
+	assert.NoError(err)
+	_, ok = s.ExpiresAt()
+	assert.False(ok)
+}
+
 func TestDeserializeSecretWithoutBase64Padding(t *testing.T) {
 	assert := assert.New(t)
 
@@ -48,6 +68,22 @@ func TestDeserializeSecretWithoutBase64Padding(t *testing.T) {
 	assert.EqualValues("12345", s.Content)
 }
 
+func TestDeserializeContent(t *testing.T) {
+	assert := assert.New(t)
+
+	var c content
+	assert.NoError(c.UnmarshalJSON([]byte(`"\/\u002f8="`)))
+	assert.Equal(content{0xff, 0xff}, c)
+
+	// Errors don't include the content.
+	for _, data := range []string{`5`, `"c2VjcmV0!"`, `"c2VjcmV0\u00e9"`, `"c2VjcmV0\n"`} {
+		err := c.UnmarshalJSON([]byte(data))
+		if assert.Error(err, data) {
+			assert.NotContains(err.Error(), "c2VjcmV0", data)
+		}
+	}
+}
+
 func TestDeserializeSecretList(t *testing.T) {
 	assert := assert.New(t)
 
@@ -74,3 +110,142 @@ func TestSecretModeValue(t *testing.T) {
 		assert.Equal(c.mode|unix.S_IFREG, c.secret.ModeValue())
 	}
 }
+
+func TestSecretModeValueOnlyKeepsPermissions(t *testing.T) {
+	assert := assert.New(t)
+
+	for mode, expected := range map[string]uint32{"4755": 0755, "2440": 0440, "0100644": 0644, "0170777": 0777} {
+		assert.Equal(expected|unix.S_IFREG, Secret{Mode: mode}.ModeValue(), mode)
+	}
+}
+
+func TestDeserializeSecretFixesLength(t *testing.T) {
+	assert := assert.New(t)
+
+	s, err := ParseSecret([]byte(`{"name": "foo", "secret": "YXNkZGFz", "secretLength": 1000}`))
+	assert.NoError(err)
+	assert.EqualValues(6, s.Length)
+
+	_, err = ParseSecret([]byte("null"))
+	assert.Error(err)
+}
+
+// addFixtures seeds a fuzz target with the JSON fixtures.
+func addFixtures(f *testing.F) {
+	files, err := filepath.Glob("fixtures/*.json")
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+}
+
+// normalizeSecret clears what doesn't survive a round-trip through JSON identically.
+func normalizeSecret(t *testing.T, s *Secret) {
+	created, err := s.CreatedAt.MarshalJSON()
+	if err != nil {
+		t.Skip("creation date can't be serialized")
+	}
+	if err := s.CreatedAt.UnmarshalJSON(created); err != nil {
+		t.Fatal(err)
+	}
+	s.CreatedAt = s.CreatedAt.UTC()
+}
+
+func FuzzParseSecret(f *testing.F) {
+	addFixtures(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		s, err := ParseSecret(data)
+		if err != nil {
+			return
+		}
+		if s.Content != nil && s.Length != uint64(len(s.Content)) {
+			t.Fatalf("length %d of content with %d bytes", s.Length, len(s.Content))
+		}
+
+		serialized, err := json.Marshal(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed, err := ParseSecret(serialized)
+		if err != nil {
+			t.Fatalf("reparsing %s: %v", serialized, err)
+		}
+		normalizeSecret(t, s)
+		normalizeSecret(t, parsed)
+		if !reflect.DeepEqual(s, parsed) {
+			t.Fatalf("round-trip changed %+v to %+v", s, parsed)
+		}
+	})
+}
+
+func FuzzParseSecretList(f *testing.F) {
+	addFixtures(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		secrets, err := ParseSecretList(data)
+		if err != nil {
+			return
+		}
+
+		serialized, err := json.Marshal(secrets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed, err := ParseSecretList(serialized)
+		if err != nil {
+			t.Fatalf("reparsing %s: %v", serialized, err)
+		}
+		if len(parsed) != len(secrets) {
+			t.Fatalf("round-trip changed %d secrets to %d", len(secrets), len(parsed))
+		}
+		for i := range secrets {
+			normalizeSecret(t, &secrets[i])
+			normalizeSecret(t, &parsed[i])
+		}
+		if !reflect.DeepEqual(secrets, parsed) {
+			t.Fatalf("round-trip changed %+v to %+v", secrets, parsed)
+		}
+	})
+}
+
+func FuzzContent(f *testing.F) {
+	for _, seed := range []string{`"YXNkZGFz"`, `"MTIzNDU"`, `""`, `"Y"`, `"YQ="`, `null`, `5`, `"%%%"`} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var c content
+		if err := c.UnmarshalJSON(data); err != nil {
+			return
+		}
+
+		// Serialized content is padded base64, which decodes to the same bytes.
+		serialized, err := json.Marshal([]byte(c))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var parsed content
+		if err := parsed.UnmarshalJSON(serialized); err != nil {
+			t.Fatalf("reparsing %s: %v", serialized, err)
+		}
+		if !reflect.DeepEqual(c, parsed) {
+			t.Fatalf("round-trip changed %q to %q", c, parsed)
+		}
+	})
+}
+
+func FuzzSecretModeValue(f *testing.F) {
+	for _, seed := range []string{"0440", "0400", "", "4755", "07777", "0170000", "-1", "0x1ff", "99999999"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, mode string) {
+		value := Secret{Mode: mode}.ModeValue()
+		if value&^0777 != unix.S_IFREG {
+			t.Fatalf("mode %q gives %o", mode, value)
+		}
+	})
+}
@@ -15,16 +15,37 @@
 package main
 
 import (
+	"container/list"
 	"sync"
 	"time"
+
+	"github.com/rcrowley/go-metrics"
 )
 
+// CacheLimits bounds the secret content held in memory. Zero values are unlimited.
+type CacheLimits struct {
+	// MaxBytes limits the total size of cached content.
+	MaxBytes uint64
+	// MaxEntries limits the number of secrets with cached content.
+	MaxEntries int
+}
+
+// within reports whether the given amount of content is within the limits.
+func (l CacheLimits) within(bytes uint64, entries int) bool {
+	return (l.MaxBytes == 0 || bytes <= l.MaxBytes) && (l.MaxEntries == 0 || entries <= l.MaxEntries)
+}
+
 // SecretMap is a thread-safe map for storing key -> secret mapping.
 type SecretMap struct {
-	m        map[string]SecretTime
-	lock     sync.Mutex
-	timeouts Timeouts
-	now      func() time.Time
+	m         map[string]SecretTime
+	lock      sync.Mutex
+	timeouts  Timeouts
+	now       func() time.Time
+	limits    CacheLimits
+	evictions metrics.Counter
+	// lru holds the keys of entries with content, most recently used first.
+	lru   *list.List
+	bytes uint64
 }
 
 // SecretTime contains a Secret record along with a timestamp when it was inserted.
@@ -32,16 +53,26 @@ type SecretMap struct {
 // a new one. This implies, we risk purging the secret from the cache if we don't
 // set a time to live. If the ttl value is 0, we keep the secret until it gets deleted
 // and its ttl changes.
+//
+// The content of secrets in the map is held in a secureBuffer, released when the entry is replaced
+// or removed. Secrets returned by Get hold their own reference to the buffer, so content being read
+// is only zeroed once the reader releases it.
+//
+// When the map has limits, the content of the least recently used entries is evicted, keeping
+// their metadata. Evicted entries are still held for DeletionDelay once they leave the listing.
 type SecretTime struct {
 	Secret  Secret
 	Time    time.Time
 	ttl     time.Time
 	deleted bool
+	buf     *secureBuffer
+	elem    *list.Element
+	evicted bool
 }
 
 // NewSecretMap initializes a new SecretMap.
 func NewSecretMap(timeouts Timeouts, now func() time.Time) *SecretMap {
-	return &SecretMap{make(map[string]SecretTime), sync.Mutex{}, timeouts, now}
+	return &SecretMap{m: make(map[string]SecretTime), timeouts: timeouts, now: now, evictions: metrics.NewCounter(), lru: list.New()}
 }
 
 func (m *SecretMap) getNow() time.Time {
@@ -55,20 +86,40 @@ func isExpired(s SecretTime, now time.Time) bool {
 	return !s.ttl.IsZero() && s.ttl.Before(now)
 }
 
-// Get retrieves a values from the map and indicates if the lookup was ok.
+// Get retrieves a values from the map and indicates if the lookup was ok. A secret with content
+// must be released by the caller.
 func (m *SecretMap) Get(key string) (s SecretTime, ok bool) {
+	return m.get(key, true)
+}
+
+// Peek retrieves a value like Get, without counting as a use of its content.
+func (m *SecretMap) Peek(key string) (s SecretTime, ok bool) {
+	return m.get(key, false)
+}
+
+func (m *SecretMap) get(key string, use bool) (s SecretTime, ok bool) {
 	m.lock.Lock()
 	defer m.lock.Unlock()
 
 	s, ok = m.m[key]
 	if ok && isExpired(s, m.getNow()) {
+		m.release(s)
 		delete(m.m, key)
 		return SecretTime{deleted: true}, false
 	}
+	if ok && len(s.Secret.Content) > 0 {
+		if use {
+			m.lru.MoveToFront(s.elem)
+		}
+		s.Secret.buf = s.buf.Retain()
+	}
+	s.buf = nil
+	s.elem = nil
 	return
 }
 
-// Put places a value in the map with a key, possibly overwriting an existing entry.
+// Put places a value in the map with a key, possibly overwriting an existing entry. Content already
+// in a secureBuffer is shared, other content is copied into one.
 func (m *SecretMap) Put(key string, value Secret, updated time.Time) {
 	m.lock.Lock()
 	defer m.lock.Unlock()
@@ -76,7 +127,46 @@ func (m *SecretMap) Put(key string, value Secret, updated time.Time) {
 	if updated.Equal(time.Time{}) {
 		updated = m.getNow()
 	}
-	m.m[key] = SecretTime{value, updated, time.Time{}, false}
+	buf := value.buf.Retain()
+	if buf == nil {
+		buf = newSecureBuffer(value.Content)
+	}
+	if buf != nil {
+		value.Content = buf.Bytes()
+	}
+	value.buf = nil
+	m.release(m.m[key])
+	m.m[key] = SecretTime{value, updated, time.Time{}, false, buf, m.link(key, value), false}
+	m.evict(key)
+}
+
+// Keep copies an entry with content from another map, sharing its buffer. It returns false if the
+// other map has no content for key. Replacing the other map with this one keeps the recency of
+// the entry.
+func (m *SecretMap) Keep(from *SecretMap, key string) bool {
+	from.lock.Lock()
+	s, ok := from.m[key]
+	if !ok || len(s.Secret.Content) == 0 || isExpired(s, from.getNow()) {
+		from.lock.Unlock()
+		return false
+	}
+	s.buf.Retain()
+	from.lock.Unlock()
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.release(m.m[key])
+	m.m[key] = SecretTime{s.Secret, s.Time, time.Time{}, false, s.buf, m.link(key, s.Secret), false}
+	m.evict(key)
+	return true
+}
+
+// Remove drops an entry right away, zeroing its content.
+func (m *SecretMap) Remove(key string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.release(m.m[key])
+	delete(m.m, key)
 }
 
 // Schedules an entry for deletion.
@@ -118,8 +208,8 @@ func (m *SecretMap) Replace(m2 *SecretMap) {
 	// Delete existing entries
 	expire := m.getNow().Add(m.timeouts.DeletionDelay)
 	for k, v := range m.m {
-		// Only hold on to secrets which actually have data.
-		if len(v.Secret.Content) == 0 {
+		// Only hold on to secrets which actually have data, or had it before being evicted.
+		if len(v.Secret.Content) == 0 && !v.evicted {
 			delete(m.m, k)
 		} else if v.ttl.IsZero() {
 			v.ttl = expire
@@ -127,13 +217,133 @@ func (m *SecretMap) Replace(m2 *SecretMap) {
 		}
 	}
 
-	// Replace values with data from m2
+	// Replace values with data from m2, which hands over its references. Content from m2 takes the
+	// place in the LRU list of the content it replaces, so kept entries keep their recency.
 	for k, v := range m2.m {
+		old := m.m[k]
+		if v.elem != nil {
+			m2.lru.Remove(v.elem)
+			if old.elem != nil {
+				v.elem = m.lru.InsertBefore(k, old.elem)
+			} else {
+				v.elem = m.lru.PushFront(k)
+			}
+			m.bytes += uint64(len(v.Secret.Content))
+		}
+		m.release(old)
 		m.m[k] = v
 	}
+	m2.m = make(map[string]SecretTime)
+	m2.bytes = 0
+	m.evict("")
+}
+
+// Clear removes all entries, zeroing their content.
+func (m *SecretMap) Clear() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, v := range m.m {
+		v.buf.Release()
+	}
+	m.m = make(map[string]SecretTime)
+	m.lru.Init()
+	m.bytes = 0
+}
+
+// SetLimits sets the limits of the map, evicting content if it's over them.
+func (m *SecretMap) SetLimits(limits CacheLimits) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.limits = limits
+	m.evict("")
+}
+
+// Resident returns the total size and number of entries with content.
+func (m *SecretMap) Resident() (bytes uint64, entries int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.bytes, m.lru.Len()
+}
+
+// Evictions returns how many times content has been evicted from the map.
+func (m *SecretMap) Evictions() uint64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return uint64(m.evictions.Count())
+}
+
+// SetEvictionCounter sets the counter incremented when content is evicted, so evictions can be
+// reported as a metric.
+func (m *SecretMap) SetEvictionCounter(counter metrics.Counter) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	counter.Inc(m.evictions.Count())
+	m.evictions = counter
+}
+
+// link adds the content of an entry to the front of the LRU list, returning its element. Entries
+// without content aren't in the list. The lock must be held.
+func (m *SecretMap) link(key string, value Secret) *list.Element {
+	if len(value.Content) == 0 {
+		return nil
+	}
+	m.bytes += uint64(len(value.Content))
+	return m.lru.PushFront(key)
+}
+
+// release removes the content of an entry from the LRU list and releases its buffer. The lock
+// must be held.
+func (m *SecretMap) release(v SecretTime) {
+	if v.elem != nil {
+		m.lru.Remove(v.elem)
+		m.bytes -= uint64(len(v.Secret.Content))
+	}
+	v.buf.Release()
+}
+
+// evict drops the content of the least recently used entries until the map is within its limits.
+// The entry for keep, just stored, is never evicted. The lock must be held.
+func (m *SecretMap) evict(keep string) {
+	for e := m.lru.Back(); e != nil && !m.limits.within(m.bytes, m.lru.Len()); {
+		prev := e.Prev()
+		if k := e.Value.(string); k != keep {
+			v := m.m[k]
+			m.release(v)
+			v.buf = nil
+			v.elem = nil
+			v.Secret.Content = nil
+			v.evicted = true
+			m.m[k] = v
+			m.evictions.Inc(1)
+		}
+		e = prev
+	}
+}
+
+// Entries returns the stored entries, including their timestamps, in no particular order. Entries
+// have no content; resident reports whether the map holds it.
+func (m *SecretMap) Entries() []SecretTime {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	entries := make([]SecretTime, 0, len(m.m))
+	now := m.getNow()
+	for _, value := range m.m {
+		if !isExpired(value, now) {
+			value.Secret = value.Secret.metadata()
+			value.elem = nil
+			entries = append(entries, value)
+		}
+	}
+	return entries
+}
+
+// resident reports whether the map held content for an entry.
+func (s SecretTime) resident() bool {
+	return s.buf != nil
 }
 
-// Values returns a slice of stored secrets in no particular order.
+// Values returns a slice of stored secrets in no particular order, without their content.
 func (m *SecretMap) Values() []Secret {
 	m.lock.Lock()
 	defer m.lock.Unlock()
@@ -143,9 +353,10 @@ func (m *SecretMap) Values() []Secret {
 	now := m.getNow()
 	for key, value := range m.m {
 		if isExpired(value, now) {
+			m.release(value)
 			delete(m.m, key)
 		} else {
-			values[i] = value.Secret
+			values[i] = value.Secret.metadata()
 			i++
 		}
 	}
@@ -18,6 +18,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/rcrowley/go-metrics"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -41,10 +42,11 @@ func TestSecretMapOperations(t *testing.T) {
 
 	values := secretMap.Values()
 	assert.Len(values, 1)
-	assert.Equal(*s, values[0])
+	assert.Equal(s.metadata(), values[0])
 
 	lookup, ok = secretMap.Get("foo")
 	assert.True(ok)
+	lookup.Secret.Release()
 	assert.Equal(*s, lookup.Secret)
 
 	secretMap.Put("foo", Secret{}, time.Time{})
@@ -59,7 +61,7 @@ func TestSecretMapOperations(t *testing.T) {
 	// Secret should still exist for a short amount of time
 	values = secretMap.Values()
 	assert.Len(values, 1)
-	assert.Equal(*s, values[0])
+	assert.Equal(s.metadata(), values[0])
 	// Advance current time by more than an hour, secret should now be gone
 	fake_now = fake_now.Add(2 * time.Hour)
 	values = secretMap.Values()
@@ -81,3 +83,105 @@ func TestSecretMapTimestamp(t *testing.T) {
 	assert.True(ok)
 	assert.True(val.Time.After(earlierTime))
 }
+
+func TestSecretMapEvictsLeastRecentlyUsed(t *testing.T) {
+	assert := assert.New(t)
+
+	secretMap := NewSecretMap(timeouts, nil)
+	secretMap.SetLimits(CacheLimits{MaxEntries: 2})
+	secretMap.Put("a", Secret{Name: "a", Content: content("aaaa"), Length: 4}, time.Time{})
+	secretMap.Put("b", Secret{Name: "b", Content: content("bb"), Length: 2}, time.Time{})
+	a, _ := secretMap.Get("a")
+	secretMap.Put("c", Secret{Name: "c", Content: content("c"), Length: 1}, time.Time{})
+
+	// b was used least recently, so its content is evicted and zeroed, keeping its metadata.
+	b, ok := secretMap.Get("b")
+	assert.True(ok)
+	assert.Empty(b.Secret.Content)
+	assert.EqualValues(2, b.Secret.Length)
+	assert.EqualValues("aaaa", a.Secret.Content)
+	bytes, entries := secretMap.Resident()
+	assert.EqualValues(5, bytes)
+	assert.Equal(2, entries)
+	assert.EqualValues(1, secretMap.Evictions())
+
+	// The entry just stored is kept even if it exceeds the limits alone.
+	secretMap.SetLimits(CacheLimits{MaxBytes: 3})
+	secretMap.Put("d", Secret{Name: "d", Content: content("dddd")}, time.Time{})
+	bytes, entries = secretMap.Resident()
+	assert.EqualValues(4, bytes)
+	assert.Equal(1, entries)
+	assert.EqualValues("aaaa", a.Secret.Content, "evicted content should be kept until released")
+	a.Secret.Release()
+	assert.EqualValues(make([]byte, 4), a.Secret.Content)
+
+	// Refreshing the listing keeps the limits and recency of kept entries.
+	secretMap.SetLimits(CacheLimits{MaxEntries: 1})
+	secretMap.Put("e", Secret{Name: "e", Content: content("e")}, time.Time{})
+	newMap := NewSecretMap(timeouts, nil)
+	newMap.Put("a", Secret{Name: "a", Length: 4}, time.Time{})
+	assert.True(newMap.Keep(secretMap, "e"))
+	secretMap.Replace(newMap)
+	_, entries = secretMap.Resident()
+	assert.Equal(1, entries)
+	e, _ := secretMap.Get("e")
+	assert.EqualValues("e", e.Secret.Content)
+	assert.Len(secretMap.Values(), 5, "evicted entries missing from the listing are held like resident ones")
+}
+
+func TestSecretMapReplaceKeepsRecency(t *testing.T) {
+	assert := assert.New(t)
+
+	secretMap := NewSecretMap(timeouts, nil)
+	secretMap.SetLimits(CacheLimits{MaxEntries: 2})
+	secretMap.Put("a", Secret{Name: "a", Content: content("a")}, time.Time{})
+	secretMap.Put("b", Secret{Name: "b", Content: content("b")}, time.Time{})
+	a, _ := secretMap.Get("a")
+	a.Secret.Release()
+
+	// Entries are kept in another order than their recency.
+	newMap := NewSecretMap(timeouts, nil)
+	assert.True(newMap.Keep(secretMap, "a"))
+	assert.True(newMap.Keep(secretMap, "b"))
+	secretMap.Replace(newMap)
+	bytes, entries := newMap.Resident()
+	assert.Zero(bytes)
+	assert.Zero(entries)
+
+	secretMap.Put("c", Secret{Name: "c", Content: content("c")}, time.Time{})
+	b, _ := secretMap.Peek("b")
+	assert.Empty(b.Secret.Content, "b was used least recently")
+	a, _ = secretMap.Peek("a")
+	assert.EqualValues("a", a.Secret.Content)
+	a.Secret.Release()
+	bytes, entries = secretMap.Resident()
+	assert.EqualValues(2, bytes)
+	assert.Equal(2, entries)
+}
+
+func TestSecretMapHoldsEvictedEntriesForDeletionDelay(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now()
+	secretMap := NewSecretMap(timeouts, func() time.Time { return now })
+	counter := metrics.NewCounter()
+	secretMap.SetEvictionCounter(counter)
+	secretMap.SetLimits(CacheLimits{MaxEntries: 1})
+	secretMap.Put("a", Secret{Name: "a", Content: content("a"), Length: 1}, time.Time{})
+	secretMap.Put("b", Secret{Name: "b", Content: content("b"), Length: 1}, time.Time{})
+	assert.EqualValues(1, counter.Count())
+	assert.EqualValues(1, secretMap.Evictions())
+
+	// a is evicted, then dropped from the listing: it's kept until DeletionDelay elapses.
+	secretMap.Replace(NewSecretMap(timeouts, nil))
+	a, ok := secretMap.Get("a")
+	assert.True(ok)
+	assert.EqualValues(1, a.Secret.Length)
+	assert.Empty(a.Secret.Content)
+
+	now = now.Add(timeouts.DeletionDelay + time.Second)
+	_, ok = secretMap.Get("a")
+	assert.False(ok)
+	_, ok = secretMap.Get("b")
+	assert.False(ok)
+}
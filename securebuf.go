@@ -0,0 +1,229 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"golang.org/x/sys/unix"
+)
+
+// secureBufferGrace is how long the memory of a released buffer stays mapped, zeroed, before it
+// is unmapped. Readers hold references, but a FUSE reply served from a file's buffer may still be
+// written out after the file is released.
+const secureBufferGrace = time.Minute
+
+var mlockWarning sync.Once
+
+// noCopy makes `go vet` report copies of the structs embedding it.
+type noCopy struct{}
+
+func (*noCopy) Lock()   {}
+func (*noCopy) Unlock() {}
+
+// secureBuffer holds secret content outside the Go heap. The memory is locked so it isn't swapped
+// out, excluded from core dumps, read-only, and surrounded by inaccessible guard pages. Content is
+// placed at the end of its pages, so reading past it faults.
+//
+// Buffers are reference counted and must only be passed by pointer. Bytes aliases the buffer
+// rather than copying it; the content is zeroed when the last reference is released. The nil
+// buffer is empty.
+type secureBuffer struct {
+	noCopy noCopy
+	mem    []byte // The whole mapping, including guard pages. Nil for buffers on the heap.
+	data   []byte
+	refs   int32
+}
+
+// newSecureBuffer copies content into a new buffer with a single reference. It returns nil for
+// empty content. If memory can't be mapped, the buffer is allocated on the heap, where it is still
+// zeroed on release.
+func newSecureBuffer(content []byte) *secureBuffer {
+	if len(content) == 0 {
+		return nil
+	}
+	b := &secureBuffer{refs: 1}
+	page := os.Getpagesize()
+	size := (len(content) + page - 1) / page * page
+	mem, err := unix.Mmap(-1, 0, size+2*page, unix.PROT_NONE, unix.MAP_PRIVATE|unix.MAP_ANON)
+	if err == nil {
+		if err = unix.Mprotect(mem[page:page+size], unix.PROT_READ|unix.PROT_WRITE); err != nil {
+			unix.Munmap(mem)
+		}
+	}
+	if err != nil {
+		log.Printf("Unable to map memory for secret content, using the heap: %v\n", err)
+		b.data = append([]byte(nil), content...)
+		return b
+	}
+
+	inner := mem[page : page+size]
+	if err := unix.Mlock(inner); err != nil {
+		mlockWarning.Do(func() {
+			log.Printf("Unable to lock memory for secret content, it may be swapped: %v\n", err)
+		})
+	}
+	excludeFromCoreDump(inner)
+	b.mem = mem
+	b.data = inner[size-len(content):]
+	copy(b.data, content)
+	unix.Mprotect(inner, unix.PROT_READ)
+	return b
+}
+
+// Bytes returns the content of the buffer. The slice is only valid until the last reference is
+// released, and must not be modified.
+func (b *secureBuffer) Bytes() []byte {
+	if b == nil {
+		return nil
+	}
+	return b.data
+}
+
+// Len returns the length of the content.
+func (b *secureBuffer) Len() int {
+	return len(b.Bytes())
+}
+
+// Retain adds a reference to the buffer.
+func (b *secureBuffer) Retain() *secureBuffer {
+	if b != nil && atomic.AddInt32(&b.refs, 1) <= 1 {
+		panic("secureBuffer retained after release")
+	}
+	return b
+}
+
+// Release drops a reference to the buffer. Releasing the last reference zeroes the content.
+func (b *secureBuffer) Release() {
+	if b == nil || atomic.AddInt32(&b.refs, -1) != 0 {
+		return
+	}
+	if b.mem == nil {
+		zero(b.data)
+		return
+	}
+
+	page := os.Getpagesize()
+	inner := b.mem[page : len(b.mem)-page]
+	unix.Mprotect(inner, unix.PROT_READ|unix.PROT_WRITE)
+	zero(b.data)
+	unix.Mprotect(inner, unix.PROT_READ)
+	mem := b.mem
+	time.AfterFunc(secureBufferGrace, func() { unix.Munmap(mem) })
+}
+
+func zero(data []byte) {
+	for i := range data {
+		data[i] = 0
+	}
+}
+
+// secureFile is a read-only file serving a copy of secret content from a secureBuffer, which is
+// zeroed when the file is released.
+type secureFile struct {
+	nodefs.File
+	buf *secureBuffer
+}
+
+// newSecureFile copies data into a new secureFile. Unlike nodefs.NewDataFile, the file's copy
+// doesn't outlive it.
+func newSecureFile(data []byte) nodefs.File {
+	return &secureFile{File: nodefs.NewDefaultFile(), buf: newSecureBuffer(data)}
+}
+
+func (f *secureFile) String() string {
+	return fmt.Sprintf("secureFile(%d bytes)", f.buf.Len())
+}
+
+func (f *secureFile) GetAttr(out *fuse.Attr) fuse.Status {
+	out.Mode = fuse.S_IFREG | 0444
+	out.Size = uint64(f.buf.Len())
+	return fuse.OK
+}
+
+func (f *secureFile) Read(dest []byte, off int64) (fuse.ReadResult, fuse.Status) {
+	data := f.buf.Bytes()
+	if off >= int64(len(data)) {
+		return fuse.ReadResultData(nil), fuse.OK
+	}
+	end := off + int64(len(dest))
+	if end > int64(len(data)) {
+		end = int64(len(data))
+	}
+	return fuse.ReadResultData(data[off:end]), fuse.OK
+}
+
+func (f *secureFile) Release() {
+	f.buf.Release()
+}
+
+// secureBuilder accumulates content derived from secrets, such as a rendered template, before it
+// is moved into a secureBuffer. Unlike a bytes.Buffer, it zeroes the memory it outgrows, so that
+// no copy of the content is left behind on the heap once it is reset.
+type secureBuilder struct {
+	data []byte
+}
+
+// grow extends the content by n bytes, returning them to be filled in by the caller.
+func (b *secureBuilder) grow(n int) []byte {
+	if len(b.data)+n > cap(b.data) {
+		grown := make([]byte, len(b.data), 2*cap(b.data)+n)
+		copy(grown, b.data)
+		zero(b.data)
+		b.data = grown
+	}
+	b.data = b.data[:len(b.data)+n]
+	return b.data[len(b.data)-n:]
+}
+
+func (b *secureBuilder) Write(p []byte) (int, error) {
+	copy(b.grow(len(p)), p)
+	return len(p), nil
+}
+
+func (b *secureBuilder) WriteString(s string) (int, error) {
+	copy(b.grow(len(s)), s)
+	return len(s), nil
+}
+
+func (b *secureBuilder) WriteByte(c byte) error {
+	b.grow(1)[0] = c
+	return nil
+}
+
+// Bytes returns the content written so far. The slice is only valid until the builder is reset.
+func (b *secureBuilder) Bytes() []byte {
+	return b.data
+}
+
+// Buffer moves the content into a new secureBuffer, resetting the builder.
+func (b *secureBuilder) Buffer() *secureBuffer {
+	buf := newSecureBuffer(b.data)
+	b.Reset()
+	return buf
+}
+
+// Reset zeroes the content and empties the builder.
+func (b *secureBuilder) Reset() {
+	zero(b.data)
+	b.data = b.data[:0]
+}
@@ -0,0 +1,206 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	runtimedebug "runtime/debug"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/stretchr/testify/assert"
+)
+
+// sink keeps loads in tests from being optimized away.
+var sink byte
+
+// faults reports whether f triggers a memory fault.
+func faults(f func()) (faulted bool) {
+	defer runtimedebug.SetPanicOnFault(runtimedebug.SetPanicOnFault(true))
+	defer func() {
+		_, faulted = recover().(interface{ Addr() uintptr })
+	}()
+	f()
+	return false
+}
+
+func TestSecureBuffer(t *testing.T) {
+	assert := assert.New(t)
+
+	source := []byte("hunter2")
+	buf := newSecureBuffer(source)
+	assert.Equal(source, buf.Bytes())
+	assert.Equal(7, buf.Len())
+	source[0] = 'H'
+	assert.Equal([]byte("hunter2"), buf.Bytes(), "the buffer should hold its own copy")
+
+	data := buf.Bytes()
+	assert.True(faults(func() { data[0] = 'H' }), "content should be read-only")
+	assert.True(faults(func() { sink = *(*byte)(unsafe.Add(unsafe.Pointer(&data[0]), len(data))) }), "reads past the content should hit a guard page")
+	assert.False(faults(func() { sink = data[len(data)-1] }))
+
+	buf.Retain()
+	buf.Release()
+	assert.Equal([]byte("hunter2"), data, "content should survive until the last release")
+	buf.Release()
+	assert.Equal(make([]byte, 7), data, "content should be zeroed on the last release")
+	assert.Panics(func() { buf.Retain() })
+
+	assert.Nil(newSecureBuffer(nil))
+	var empty *secureBuffer
+	assert.Nil(empty.Bytes())
+	empty.Release()
+}
+
+func TestSecureFile(t *testing.T) {
+	assert := assert.New(t)
+
+	file := newSecureFile([]byte("hunter2"))
+	var attr fuse.Attr
+	assert.Equal(fuse.OK, file.GetAttr(&attr))
+	assert.EqualValues(7, attr.Size)
+
+	buf := make([]byte, 4)
+	res, status := file.Read(buf, 3)
+	assert.Equal(fuse.OK, status)
+	data, _ := res.Bytes(buf)
+	assert.Equal([]byte("ter2"), data)
+	res, _ = file.Read(buf, 10)
+	data, _ = res.Bytes(buf)
+	assert.Empty(data)
+
+	res, _ = file.Read(make([]byte, 7), 0)
+	data, _ = res.Bytes(nil)
+	file.Release()
+	assert.Equal(make([]byte, 7), data, "content should be zeroed when the file is released")
+}
+
+func TestSecureBuilder(t *testing.T) {
+	assert := assert.New(t)
+
+	var b secureBuilder
+	b.WriteString("hunter")
+	outgrown := b.Bytes()
+	b.Write([]byte("2, and more content"))
+	b.WriteByte('!')
+	assert.Equal(make([]byte, 6), outgrown, "memory should be zeroed when the builder grows")
+
+	content := b.Bytes()
+	buf := b.Buffer()
+	defer buf.Release()
+	assert.Equal("hunter2, and more content!", string(buf.Bytes()))
+	assert.Equal(make([]byte, len(content)), content, "the builder's copy should be zeroed")
+	assert.Empty(b.Bytes())
+}
+
+func TestSecretMapZeroesContent(t *testing.T) {
+	assert := assert.New(t)
+
+	secretMap := NewSecretMap(timeouts, nil)
+	secretMap.Put("foo", Secret{Name: "foo", Content: content("hunter2")}, time.Time{})
+	old, _ := secretMap.Get("foo")
+	secretMap.Put("foo", Secret{Name: "foo", Content: content("hunter3")}, time.Time{})
+	assert.EqualValues("hunter2", old.Secret.Content, "replaced content should be kept until released")
+	old.Secret.Release()
+	assert.EqualValues(make([]byte, 7), old.Secret.Content, "replaced content should be zeroed")
+
+	// Entries kept across a refresh share their buffer until the old map lets go of it.
+	newMap := NewSecretMap(timeouts, nil)
+	assert.True(newMap.Keep(secretMap, "foo"))
+	assert.False(newMap.Keep(secretMap, "bar"))
+	kept, _ := newMap.Get("foo")
+	kept.Secret.Release()
+	secretMap.Replace(newMap)
+	assert.EqualValues("hunter3", kept.Secret.Content)
+
+	secretMap.Clear()
+	assert.Equal(0, secretMap.Len())
+	assert.EqualValues(make([]byte, 7), kept.Secret.Content, "cleared content should be zeroed")
+}
+
+func TestCacheClearZeroesContent(t *testing.T) {
+	assert := assert.New(t)
+
+	backend := NewMapBackend(Secret{Name: "foo", Content: content("hunter2")})
+	cache := NewCache(backend, timeouts, logConfig, nil)
+	secret, ok := cache.Secret("foo")
+	assert.True(ok)
+	cached, _ := cache.secretMap.Get("foo")
+	versions := cache.history.Versions("foo")
+	if !assert.Len(versions, 1) {
+		return
+	}
+	version, ok := cache.Version("foo", versions[0].ID)
+	assert.True(ok)
+
+	cache.Clear()
+	assert.EqualValues("hunter2", secret.Content, "the backend's copy is returned on a miss")
+	assert.EqualValues("hunter2", cached.Secret.Content, "content should be kept until released")
+	cached.Secret.Release()
+	version.Release()
+	assert.True(bytes.Equal(make([]byte, 7), cached.Secret.Content))
+	assert.True(bytes.Equal(make([]byte, 7), version.Content))
+}
+
+func TestReadersNeverSeeZeroedContent(t *testing.T) {
+	assert := assert.New(t)
+
+	backend := NewMapBackend(Secret{Name: "foo", Content: content("hunter2")})
+	timeouts := Timeouts{0, 0, time.Second, time.Hour}
+	cache := NewCache(backend, timeouts, logConfig, nil)
+	cache.Add(Secret{Name: "foo", Content: content("hunter2")})
+
+	// Content is replaced while readers copy it, both from the map and through the cache, which
+	// refreshes it in the background.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 2000; i++ {
+			cache.secretMap.Put("foo", Secret{Name: "foo", Content: content("hunter2")}, time.Time{})
+		}
+	}()
+
+	var zeroed int32
+	var wg sync.WaitGroup
+	read := func(get func() (*Secret, bool)) {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if secret, ok := get(); ok {
+				data := append([]byte(nil), secret.Content...)
+				secret.Release()
+				if !bytes.Equal([]byte("hunter2"), data) {
+					atomic.AddInt32(&zeroed, 1)
+				}
+			}
+		}
+	}
+	wg.Add(2)
+	go read(func() (*Secret, bool) {
+		s, ok := cache.secretMap.Get("foo")
+		return &s.Secret, ok
+	})
+	go read(func() (*Secret, bool) { return cache.Secret("foo") })
+	wg.Wait()
+	assert.Zero(atomic.LoadInt32(&zeroed), "readers should never see zeroed content")
+}
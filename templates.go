@@ -0,0 +1,224 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// TemplateConfig defines a file rendered from secrets with a Go text/template body.
+type TemplateConfig struct {
+	// Name is the name of the rendered file in the base directory.
+	Name     string `json:"name"`
+	Template string `json:"template"`
+	// Owner, Group and Mode have the same meaning and defaults as for secrets.
+	Owner string `json:"owner"`
+	Group string `json:"group"`
+	Mode  string `json:"mode"`
+}
+
+// Template is a parsed template definition.
+type Template struct {
+	TemplateConfig
+	tmpl *template.Template
+}
+
+// Templates maps file names to templates. In JSON, templates are given as a list of
+// TemplateConfig.
+type Templates map[string]*Template
+
+// secretLookup retrieves a secret by name, e.g. Cache.Secret. Secrets are released once read.
+type secretLookup func(name string) (*Secret, bool)
+
+// templateStubs declares the functions available to templates. They are replaced with functions
+// bound to a secretLookup on every render.
+var templateStubs = template.FuncMap{
+	"secret": func(string) (string, error) { return "", nil },
+	"field":  func(string, string) (string, error) { return "", nil },
+}
+
+// NewTemplates parses template definitions.
+func NewTemplates(configs []TemplateConfig) (Templates, error) {
+	templates := make(Templates, len(configs))
+	for _, c := range configs {
+		if c.Name == "" || strings.Contains(c.Name, "/") || strings.HasPrefix(c.Name, ".") {
+			return nil, fmt.Errorf("template name %q should be a file name not beginning with '.'", c.Name)
+		}
+		if _, ok := templates[c.Name]; ok {
+			return nil, fmt.Errorf("template %q is defined more than once", c.Name)
+		}
+		if c.Mode != "" {
+			if _, err := strconv.ParseUint(c.Mode, 8 /* base */, 16 /* bits */); err != nil {
+				return nil, fmt.Errorf("template %q has invalid mode %q", c.Name, c.Mode)
+			}
+		}
+		tmpl, err := template.New(c.Name).Funcs(templateStubs).Option("missingkey=error").Parse(c.Template)
+		if err != nil {
+			return nil, fmt.Errorf("template %q: %v", c.Name, err)
+		}
+		templates[c.Name] = &Template{c, tmpl}
+	}
+	return templates, nil
+}
+
+// UnmarshalJSON parses a list of template definitions.
+func (t *Templates) UnmarshalJSON(data []byte) error {
+	var configs []TemplateConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return err
+	}
+	templates, err := NewTemplates(configs)
+	if err != nil {
+		return err
+	}
+	*t = templates
+	return nil
+}
+
+// Render executes the template with secrets from lookup. Rendering fails if any referenced secret
+// is missing, so that partial output is never served. The returned Secret describes the rendered
+// file, and holds its content in a secureBuffer which must be released. Its creation date is the
+// latest of the referenced secrets.
+func (t *Template) Render(lookup secretLookup) (*Secret, error) {
+	output := &templateOutput{}
+	defer output.release()
+	var created time.Time
+	get := func(name string) (*Secret, error) {
+		secret, ok := lookup(name)
+		if !ok || len(secret.Content) == 0 {
+			secret.Release()
+			return nil, fmt.Errorf("secret %q is not available", name)
+		}
+		output.secrets = append(output.secrets, secret)
+		if secret.CreatedAt.After(created) {
+			created = secret.CreatedAt
+		}
+		return secret, nil
+	}
+
+	tmpl, err := t.tmpl.Clone()
+	if err != nil {
+		return nil, err
+	}
+	tmpl.Funcs(template.FuncMap{
+		"secret": func(name string) (string, error) {
+			secret, err := get(name)
+			if err != nil {
+				return "", err
+			}
+			return output.placeholder(name, secret.Content), nil
+		},
+		"field": func(name, path string) (string, error) {
+			secret, err := get(name)
+			if err != nil {
+				return "", err
+			}
+			root, ok := parseFields(secret.Content)
+			if !ok {
+				return "", fmt.Errorf("secret %q is not structured", name)
+			}
+			output.fields = append(output.fields, root)
+			node, ok := root.Lookup(path)
+			if !ok || node.IsDir() {
+				return "", fmt.Errorf("secret %q has no field %q", name, path)
+			}
+			return output.placeholder(name, node.value), nil
+		},
+	})
+
+	if err := tmpl.Execute(output, nil); err != nil {
+		return nil, err
+	}
+	for i, used := range output.used {
+		if !used {
+			return nil, fmt.Errorf("secret %q can only be inserted, not passed to other functions", output.names[i])
+		}
+	}
+	buf := output.out.Buffer()
+	return &Secret{
+		Name:      t.Name,
+		Content:   buf.Bytes(),
+		Length:    uint64(buf.Len()),
+		CreatedAt: created,
+		Mode:      t.Mode,
+		Owner:     t.Owner,
+		Group:     t.Group,
+		buf:       buf,
+	}, nil
+}
+
+// templatePlaceholder starts the placeholders which stand for values in the output of templates.
+const templatePlaceholder = "\x00secret:"
+
+// templateOutput receives the output of a template. Template functions return placeholders rather
+// than the content of secrets, which is copied into the output as placeholders are written, so
+// that it never goes through the template engine or strings on the heap.
+type templateOutput struct {
+	out     secureBuilder
+	values  [][]byte
+	names   []string
+	used    []bool
+	secrets []*Secret
+	fields  []*fieldNode
+}
+
+// placeholder returns the placeholder for a value from the named secret.
+func (o *templateOutput) placeholder(name string, value []byte) string {
+	o.values = append(o.values, value)
+	o.names = append(o.names, name)
+	o.used = append(o.used, false)
+	return templatePlaceholder + strconv.Itoa(len(o.values)-1) + "\x00"
+}
+
+func (o *templateOutput) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		i := bytes.Index(p, []byte(templatePlaceholder))
+		if i < 0 {
+			o.out.Write(p)
+			break
+		}
+		o.out.Write(p[:i])
+		p = p[i:]
+		if end := bytes.IndexByte(p[1:], 0) + 1; end > len(templatePlaceholder) {
+			if v, err := strconv.Atoi(string(p[len(templatePlaceholder):end])); err == nil && v >= 0 && v < len(o.values) {
+				o.out.Write(o.values[v])
+				o.used[v] = true
+				p = p[end+1:]
+				continue
+			}
+		}
+		o.out.WriteByte(p[0])
+		p = p[1:]
+	}
+	return n, nil
+}
+
+// release zeroes the output and releases the secrets it was rendered from.
+func (o *templateOutput) release() {
+	o.out.Reset()
+	for _, root := range o.fields {
+		root.Release()
+	}
+	for _, secret := range o.secrets {
+		secret.Release()
+	}
+}
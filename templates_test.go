@@ -0,0 +1,119 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTemplateRender(t *testing.T) {
+	assert := assert.New(t)
+
+	older := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	newer := older.Add(time.Hour)
+	backend := NewMapBackend(
+		Secret{Name: "user", Content: content("admin"), CreatedAt: older},
+		Secret{Name: "db.json", Content: content(`{"password": "hunter2"}`), CreatedAt: newer})
+	lookup := func(name string) (*Secret, bool) {
+		secret, err := backend.Secret(name)
+		return secret, err == nil
+	}
+
+	templates, err := NewTemplates([]TemplateConfig{
+		{Name: "db.conf", Template: `{{ secret "user" }}:{{ field "db.json" "password" }}`, Mode: "0400", Owner: "nobody"},
+		{Name: "broken", Template: `{{ secret "user" }}:{{ secret "missing" }}`},
+		{Name: "not-a-field", Template: `{{ field "user" "password" }}`},
+		{Name: "repeated", Template: `{{ secret "user" }} {{ secret "user" | printf "%s" }}`},
+		{Name: "transformed", Template: `{{ secret "user" | printf "%q" }}`},
+	})
+	assert.NoError(err)
+
+	secret, err := templates["db.conf"].Render(lookup)
+	assert.NoError(err)
+	assert.Equal("admin:hunter2", string(secret.Content))
+	assert.Equal("db.conf", secret.Name)
+	assert.EqualValues(len(secret.Content), secret.Length)
+	assert.Equal(newer, secret.CreatedAt, "rendered files are as recent as their newest secret")
+	assert.Equal("0400", secret.Mode)
+	assert.Equal("nobody", secret.Owner)
+	secret.Release()
+
+	// Templates reflect changes to the secrets they reference.
+	backend.Put(Secret{Name: "user", Content: content("root"), CreatedAt: newer.Add(time.Hour)})
+	secret, err = templates["db.conf"].Render(lookup)
+	assert.NoError(err)
+	assert.Equal("root:hunter2", string(secret.Content))
+	assert.Equal(newer.Add(time.Hour), secret.CreatedAt)
+	secret.Release()
+
+	secret, err = templates["broken"].Render(lookup)
+	assert.Error(err)
+	assert.Nil(secret, "no partial output should be produced")
+
+	_, err = templates["not-a-field"].Render(lookup)
+	assert.Error(err)
+
+	// Values are inserted outside the template engine, so they can be printed but not transformed.
+	secret, err = templates["repeated"].Render(lookup)
+	assert.NoError(err)
+	assert.Equal("root root", string(secret.Content))
+	secret.Release()
+	_, err = templates["transformed"].Render(lookup)
+	assert.Error(err)
+}
+
+func TestFsTemplates(t *testing.T) {
+	assert := assert.New(t)
+	context := &fuse.Context{}
+
+	backend := NewMapBackend(Secret{Name: "Nobody_PgPass", Content: content("asddas"), Length: 6})
+	timeouts := Timeouts{0, 100 * time.Millisecond, 200 * time.Millisecond, time.Hour}
+	kwfs, _, err := NewKeywhizFs(nil, backend, Ownership{Uid: 1000, Gid: 1000}, timeouts, nil, logConfig)
+	assert.NoError(err)
+	config, err := LoadConfig("fixtures/config.json")
+	assert.NoError(err)
+	kwfs.Templates = config.Templates
+
+	expected := "db.example.com:5432:*:nobody:asddas\n"
+	attr, status := kwfs.GetAttr("pgpass", context)
+	assert.Equal(fuse.OK, status)
+	assert.EqualValues(fuse.S_IFREG|0400, attr.Mode)
+	assert.EqualValues(len(expected), attr.Size)
+	assert.EqualValues(1000, attr.Uid)
+
+	file, status := kwfs.Open("pgpass", 0, context)
+	assert.Equal(fuse.OK, status)
+	buf := make([]byte, 100)
+	res, _ := file.Read(buf, 0)
+	data, _ := res.Bytes(buf)
+	assert.Equal(expected, string(data))
+
+	entries, status := kwfs.OpenDir("", context)
+	assert.Equal(fuse.OK, status)
+	assert.Contains(entries, fuse.DirEntry{Name: "pgpass", Mode: fuse.S_IFREG})
+
+	// A template referencing a missing secret fails closed.
+	backend.Remove("Nobody_PgPass")
+	kwfs.Cache.Clear()
+	_, status = kwfs.GetAttr("pgpass", context)
+	assert.Equal(fuse.EIO, status)
+	file, status = kwfs.Open("pgpass", 0, context)
+	assert.Nil(file)
+	assert.Equal(fuse.EIO, status)
+}
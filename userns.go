@@ -0,0 +1,204 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+var procDir = "/proc"
+
+// maxCachedNamespaces bounds the id maps of user namespaces kept, past which they are all
+// forgotten.
+const maxCachedNamespaces = 1024
+
+// IDRange maps Count consecutive ids from Inside a user namespace to Outside of it.
+type IDRange struct {
+	Inside  uint32
+	Outside uint32
+	Count   uint32
+}
+
+// IDMap maps the ids of a user namespace to those of its parent, as in /proc/<pid>/uid_map.
+type IDMap []IDRange
+
+// ParseIDMap parses the contents of a uid_map or gid_map file.
+func ParseIDMap(data []byte) (IDMap, error) {
+	var m IDMap
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("invalid id map line %q", line)
+		}
+		var values [3]uint32
+		for i, field := range fields {
+			value, err := strconv.ParseUint(field, 10 /* base */, 32 /* bits */)
+			if err != nil {
+				return nil, fmt.Errorf("invalid id map line %q: %v", line, err)
+			}
+			values[i] = uint32(value)
+		}
+		m = append(m, IDRange{values[0], values[1], values[2]})
+	}
+	return m, nil
+}
+
+// ToOutside returns the id outside the namespace of an id inside it, if it is mapped.
+func (m IDMap) ToOutside(id uint32) (uint32, bool) {
+	for _, r := range m {
+		if id >= r.Inside && uint64(id) < uint64(r.Inside)+uint64(r.Count) {
+			return r.Outside + (id - r.Inside), true
+		}
+	}
+	return 0, false
+}
+
+// IDTranslation translates the ownership of files for callers in containers. Ids are those seen by
+// callers: with user namespaces, they are mapped through the uid_map and gid_map of the calling
+// process, and ids it doesn't map are owned by nobody. Offsets are then added, for containers
+// whose ids are those of the host shifted.
+type IDTranslation struct {
+	UidOffset uint32
+	GidOffset uint32
+
+	namespaces *userNamespaces // nil unless translating through user namespaces
+}
+
+// NewIDTranslation initializes an IDTranslation, translating through the user namespaces of
+// callers if userNamespaces is set.
+func NewIDTranslation(userNamespaces bool, uidOffset, gidOffset uint32) IDTranslation {
+	t := IDTranslation{UidOffset: uidOffset, GidOffset: gidOffset}
+	if userNamespaces {
+		t.namespaces = newUserNamespaces()
+	}
+	return t
+}
+
+// Translate rewrites the ownership of attr for the process pid. A zero pid, for calls not made by a
+// process, is not translated through user namespaces.
+func (t IDTranslation) Translate(attr *fuse.Attr, pid uint32) {
+	if t.namespaces != nil && pid != 0 {
+		uids, gids, err := t.namespaces.maps(pid)
+		if err == nil {
+			attr.Uid = mapToOutside(uids, attr.Uid)
+			attr.Gid = mapToOutside(gids, attr.Gid)
+		} else {
+			attr.Uid, attr.Gid = nobodyID, nobodyID
+		}
+	}
+	attr.Uid = addOffset(attr.Uid, t.UidOffset)
+	attr.Gid = addOffset(attr.Gid, t.GidOffset)
+}
+
+// mapToOutside maps id out of a user namespace, to nobody if it isn't mapped. A nil map is that
+// of our own namespace.
+func mapToOutside(m IDMap, id uint32) uint32 {
+	if m == nil {
+		return id
+	}
+	if outside, ok := m.ToOutside(id); ok {
+		return outside
+	}
+	return nobodyID
+}
+
+// addOffset adds offset to id, or returns nobody if that overflows.
+func addOffset(id, offset uint32) uint32 {
+	if uint64(id)+uint64(offset) > math.MaxUint32 {
+		return nobodyID
+	}
+	return id + offset
+}
+
+// userNamespaces caches the id maps of the user namespaces of callers, by namespace.
+type userNamespaces struct {
+	own string // Our own user namespace, which needs no translation.
+
+	lock sync.Mutex
+	uids map[string]IDMap
+	gids map[string]IDMap
+}
+
+func newUserNamespaces() *userNamespaces {
+	own, _ := os.Readlink(filepath.Join(procDir, "self", "ns", "user"))
+	return &userNamespaces{
+		own:  own,
+		uids: make(map[string]IDMap),
+		gids: make(map[string]IDMap),
+	}
+}
+
+// maps returns the uid and gid maps of the user namespace of process pid, nil if it shares our own.
+func (n *userNamespaces) maps(pid uint32) (uids, gids IDMap, err error) {
+	dir := filepath.Join(procDir, strconv.FormatUint(uint64(pid), 10))
+	ns, err := os.Readlink(filepath.Join(dir, "ns", "user"))
+	if err != nil {
+		return nil, nil, err
+	}
+	if ns == n.own {
+		return nil, nil, nil
+	}
+
+	n.lock.Lock()
+	uids, ok := n.uids[ns]
+	gids = n.gids[ns]
+	n.lock.Unlock()
+	if ok {
+		return uids, gids, nil
+	}
+
+	if uids, err = readIDMap(filepath.Join(dir, "uid_map")); err != nil {
+		return nil, nil, err
+	}
+	if gids, err = readIDMap(filepath.Join(dir, "gid_map")); err != nil {
+		return nil, nil, err
+	}
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if len(n.uids) >= maxCachedNamespaces {
+		n.uids = make(map[string]IDMap)
+		n.gids = make(map[string]IDMap)
+	}
+	n.uids[ns] = uids
+	n.gids[ns] = gids
+	return uids, gids, nil
+}
+
+// readIDMap reads a uid_map or gid_map file. The map is never nil, unlike that of our own
+// namespace.
+func readIDMap(file string) (IDMap, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	m, err := ParseIDMap(data)
+	if m == nil && err == nil {
+		m = IDMap{}
+	}
+	return m, err
+}
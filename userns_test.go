@@ -0,0 +1,133 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseIDMap(t *testing.T) {
+	assert := assert.New(t)
+
+	m, err := ParseIDMap([]byte("         0     100000      65536\n     65536       1000          1\n"))
+	assert.NoError(err)
+	assert.Equal(IDMap{{0, 100000, 65536}, {65536, 1000, 1}}, m)
+
+	for id, expected := range map[uint32]uint32{0: 100000, 1000: 101000, 65535: 165535, 65536: 1000} {
+		outside, ok := m.ToOutside(id)
+		assert.True(ok, "%d", id)
+		assert.Equal(expected, outside, "%d", id)
+	}
+	_, ok := m.ToOutside(65537)
+	assert.False(ok)
+
+	m, err = ParseIDMap([]byte("0 0 4294967295\n"))
+	assert.NoError(err)
+	outside, ok := m.ToOutside(4294967294)
+	assert.True(ok)
+	assert.EqualValues(4294967294, outside)
+
+	for _, invalid := range []string{"0 0", "0 0 1 1", "a 0 1", "0 0 4294967296"} {
+		_, err := ParseIDMap([]byte(invalid))
+		assert.Error(err, invalid)
+	}
+}
+
+// fakeProc sets up procDir with a process in our own user namespace (1) and one in a container
+// (2), returning a function restoring it.
+func fakeProc() func() {
+	dir, err := ioutil.TempDir("", "keywhiz-fs-test")
+	panicOnError(err)
+	process := func(name, ns, uidMap, gidMap string) {
+		panicOnError(os.MkdirAll(filepath.Join(dir, name, "ns"), 0755))
+		panicOnError(os.Symlink(ns, filepath.Join(dir, name, "ns", "user")))
+		panicOnError(ioutil.WriteFile(filepath.Join(dir, name, "uid_map"), []byte(uidMap), 0644))
+		panicOnError(ioutil.WriteFile(filepath.Join(dir, name, "gid_map"), []byte(gidMap), 0644))
+	}
+	process("self", "user:[1]", "0 0 4294967295\n", "0 0 4294967295\n")
+	process("1", "user:[1]", "0 0 4294967295\n", "0 0 4294967295\n")
+	process("2", "user:[2]", "0 100000 65536\n", "0 200000 65536\n")
+
+	procDir = dir
+	return func() {
+		procDir = "/proc"
+		os.RemoveAll(dir)
+	}
+}
+
+func TestIDTranslation(t *testing.T) {
+	assert := assert.New(t)
+	defer fakeProc()()
+
+	cases := []struct {
+		translation IDTranslation
+		pid         uint32
+		uid, gid    uint32
+	}{
+		{IDTranslation{}, 2, 1000, 1000},
+		{NewIDTranslation(true, 0, 0), 0, 1000, 1000},
+		{NewIDTranslation(true, 0, 0), 1, 1000, 1000},
+		{NewIDTranslation(true, 0, 0), 2, 101000, 201000},
+		{NewIDTranslation(true, 0, 0), 3, nobodyID, nobodyID},
+		{NewIDTranslation(false, 10, 20), 2, 1010, 1020},
+		{NewIDTranslation(true, 10, 20), 2, 101010, 201020},
+		{NewIDTranslation(false, 4294967295, 0), 0, nobodyID, 1000},
+	}
+	for i, c := range cases {
+		attr := &fuse.Attr{Owner: fuse.Owner{Uid: 1000, Gid: 1000}}
+		c.translation.Translate(attr, c.pid)
+		assert.Equal(c.uid, attr.Uid, "case %d", i)
+		assert.Equal(c.gid, attr.Gid, "case %d", i)
+	}
+
+	// Ids the container doesn't map are owned by nobody.
+	attr := &fuse.Attr{Owner: fuse.Owner{Uid: 70000, Gid: 0}}
+	NewIDTranslation(true, 0, 0).Translate(attr, 2)
+	assert.EqualValues(nobodyID, attr.Uid)
+	assert.EqualValues(200000, attr.Gid)
+}
+
+func TestFsTranslatesOwnership(t *testing.T) {
+	assert := assert.New(t)
+	defer fakeProc()()
+
+	backend := NewMapBackend(Secret{Name: "a", Content: content("a")})
+	kwfs, _, err := NewKeywhizFs(nil, backend, Ownership{Uid: 1000, Gid: 1000}, timeouts, nil, logConfig)
+	assert.NoError(err)
+	kwfs.IDs = NewIDTranslation(true, 0, 0)
+
+	container := &fuse.Context{Pid: 2}
+	for _, name := range []string{"", "a", ".json/status"} {
+		attr, status := kwfs.GetAttr(name, container)
+		assert.Equal(fuse.OK, status, name)
+		assert.EqualValues(101000, attr.Uid, name)
+		assert.EqualValues(201000, attr.Gid, name)
+	}
+
+	file, status := kwfs.Open("a", 0, container)
+	assert.Equal(fuse.OK, status)
+	var attr fuse.Attr
+	assert.Equal(fuse.OK, file.GetAttr(&attr))
+	assert.EqualValues(101000, attr.Uid)
+
+	host, _ := kwfs.GetAttr("a", &fuse.Context{Pid: 1})
+	assert.EqualValues(1000, host.Uid)
+}
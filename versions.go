@@ -0,0 +1,293 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// versionSeparator separates the name of a versioned secret from its version, e.g.
+	// General_Password..0be68f903f8b7d86.
+	versionSeparator = ".."
+	// maxVersions bounds how many versions of each secret are remembered by the cache.
+	maxVersions = 10
+)
+
+// SecretVersion is a single version of a secret. Versions listed by the server but never fetched
+// have no content.
+type SecretVersion struct {
+	ID     string
+	Secret Secret
+	Seen   time.Time
+	buf    *secureBuffer
+}
+
+// splitVersion splits a secret name into its base name and version. The version is empty for
+// names which don't carry one.
+func splitVersion(name string) (base, version string) {
+	i := strings.LastIndex(name, versionSeparator)
+	if i <= 0 || i+len(versionSeparator) == len(name) {
+		return name, ""
+	}
+	return name[:i], name[i+len(versionSeparator):]
+}
+
+// versionID identifies a version of a secret. The version encoded in the name is used when there
+// is one, otherwise the ID is derived from the content.
+func versionID(s Secret) string {
+	if _, version := splitVersion(s.Name); version != "" {
+		return version
+	}
+	sum := sha256.Sum256(s.Content)
+	return hex.EncodeToString(sum[:8])
+}
+
+// versionHistory remembers the versions of secrets seen by the cache, keyed by base name.
+type versionHistory struct {
+	lock sync.Mutex
+	m    map[string][]SecretVersion // Oldest first
+}
+
+func newVersionHistory() *versionHistory {
+	return &versionHistory{m: make(map[string][]SecretVersion)}
+}
+
+// Record adds a secret to the history, with its content in a secureBuffer, shared with the secret
+// if it has one. Secrets without content are ignored, and only the most recently seen maxVersions
+// versions of a secret are kept.
+func (h *versionHistory) Record(s Secret, seen time.Time) {
+	if len(s.Content) == 0 {
+		return
+	}
+	base, _ := splitVersion(s.Name)
+	id := versionID(s)
+	buf := s.buf.Retain()
+	if buf == nil {
+		buf = newSecureBuffer(s.Content)
+	}
+	s.Content = buf.Bytes()
+	s.buf = nil
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	versions := make([]SecretVersion, 0, len(h.m[base])+1)
+	for _, v := range h.m[base] {
+		if v.ID != id {
+			versions = append(versions, v)
+		} else {
+			v.buf.Release()
+		}
+	}
+	versions = append(versions, SecretVersion{id, s, seen, buf})
+	if len(versions) > maxVersions {
+		for _, v := range versions[:len(versions)-maxVersions] {
+			v.buf.Release()
+		}
+		versions = versions[len(versions)-maxVersions:]
+	}
+	h.m[base] = versions
+}
+
+// Clear forgets all versions, zeroing their content.
+func (h *versionHistory) Clear() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for _, versions := range h.m {
+		for _, v := range versions {
+			v.buf.Release()
+		}
+	}
+	h.m = make(map[string][]SecretVersion)
+}
+
+// Versions returns the recorded versions of a secret, oldest first, without their content.
+func (h *versionHistory) Versions(base string) []SecretVersion {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	versions := make([]SecretVersion, 0, len(h.m[base]))
+	for _, v := range h.m[base] {
+		versions = append(versions, SecretVersion{v.ID, v.Secret.metadata(), v.Seen, nil})
+	}
+	return versions
+}
+
+// Version returns a recorded version of a secret, which must be released by the caller.
+func (h *versionHistory) Version(base, id string) (*Secret, bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for _, v := range h.m[base] {
+		if v.ID == id {
+			secret := v.Secret
+			secret.buf = v.buf.Retain()
+			return &secret, true
+		}
+	}
+	return nil, false
+}
+
+// Names returns the base names of all secrets with recorded versions.
+func (h *versionHistory) Names() []string {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	names := make([]string, 0, len(h.m))
+	for name := range h.m {
+		names = append(names, name)
+	}
+	return names
+}
+
+// VersionIndex describes the versions of secrets known to the cache. The backend listing is
+// retrieved at most once per index, so a single file system operation sees consistent versions
+// without listing secrets repeatedly.
+type VersionIndex struct {
+	cache  *Cache
+	listed []Secret
+	loaded bool
+}
+
+// VersionIndex returns an index of the versions known to the cache.
+func (c *Cache) VersionIndex() *VersionIndex {
+	return &VersionIndex{cache: c}
+}
+
+// listing returns the backend listing, retrieving it on first use.
+func (x *VersionIndex) listing() []Secret {
+	if !x.loaded {
+		x.listed = x.cache.SecretList()
+		x.loaded = true
+	}
+	return x.listed
+}
+
+// Names returns the base names of all secrets which have versions, either listed by the backend
+// under versioned names or seen by the cache.
+func (x *VersionIndex) Names() []string {
+	seen := make(map[string]bool)
+	var names []string
+	add := func(name string) {
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	for _, s := range x.listing() {
+		if base, version := splitVersion(s.Name); version != "" {
+			add(base)
+		}
+	}
+	for _, name := range x.cache.history.Names() {
+		add(name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Versions returns the known versions of a secret, ordered by creation date. Versions come from
+// the backend listing, for servers which encode versions in secret names, and from the versions
+// previously fetched through the cache. Versions have no content.
+func (x *VersionIndex) Versions(name string) []SecretVersion {
+	byID := make(map[string]SecretVersion)
+	for _, s := range x.listing() {
+		base, version := splitVersion(s.Name)
+		if base == name && version != "" {
+			byID[version] = SecretVersion{ID: version, Secret: s}
+		}
+	}
+	// Fetched versions take precedence, as they were seen with content.
+	for _, v := range x.cache.history.Versions(name) {
+		byID[v.ID] = v
+	}
+
+	versions := make([]SecretVersion, 0, len(byID))
+	for _, v := range byID {
+		versions = append(versions, v)
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		a, b := versions[i], versions[j]
+		if !a.Secret.CreatedAt.Equal(b.Secret.CreatedAt) {
+			return a.Secret.CreatedAt.Before(b.Secret.CreatedAt)
+		}
+		if !a.Seen.Equal(b.Seen) {
+			return a.Seen.Before(b.Seen)
+		}
+		return a.ID < b.ID
+	})
+	return versions
+}
+
+// Version retrieves a single version of a secret, fetching it from the backend if the cache has
+// not seen its content. Only known versions are fetched. The version must be released by the
+// caller.
+func (x *VersionIndex) Version(name, id string) (*Secret, bool) {
+	if secret, ok := x.cache.history.Version(name, id); ok {
+		return secret, true
+	}
+	known := false
+	for _, v := range x.Versions(name) {
+		known = known || v.ID == id
+	}
+	if !known {
+		return nil, false
+	}
+	secret, ok := x.cache.Secret(name + versionSeparator + id)
+	if !ok || len(secret.Content) == 0 {
+		secret.Release()
+		return nil, false
+	}
+	return secret, true
+}
+
+// Current returns the ID of the current version of a secret: the version served under its own
+// name if there is one, and the most recently created version otherwise.
+func (x *VersionIndex) Current(name string) (string, bool) {
+	if secret, ok := x.cache.Secret(name); ok {
+		defer secret.Release()
+		if len(secret.Content) > 0 {
+			return versionID(*secret), true
+		}
+	}
+	versions := x.Versions(name)
+	if len(versions) == 0 {
+		return "", false
+	}
+	return versions[len(versions)-1].ID, true
+}
+
+// VersionedNames returns the base names of all secrets which have versions.
+func (c *Cache) VersionedNames() []string {
+	return c.VersionIndex().Names()
+}
+
+// Versions returns the known versions of a secret, ordered by creation date.
+func (c *Cache) Versions(name string) []SecretVersion {
+	return c.VersionIndex().Versions(name)
+}
+
+// Version retrieves a single known version of a secret, which must be released by the caller.
+func (c *Cache) Version(name, id string) (*Secret, bool) {
+	return c.VersionIndex().Version(name, id)
+}
+
+// CurrentVersion returns the ID of the current version of a secret.
+func (c *Cache) CurrentVersion(name string) (string, bool) {
+	return c.VersionIndex().Current(name)
+}
@@ -0,0 +1,239 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitVersion(t *testing.T) {
+	assert := assert.New(t)
+
+	cases := []struct {
+		name, base, version string
+	}{
+		{"General_Password..0be68f903f8b7d86", "General_Password", "0be68f903f8b7d86"},
+		{"Nobody_PgPass", "Nobody_PgPass", ""},
+		{"trailing..", "trailing..", ""},
+		{"..leading", "..leading", ""},
+		{"a..b..c", "a..b", "c"},
+	}
+	for _, c := range cases {
+		base, version := splitVersion(c.name)
+		assert.Equal(c.base, base, c.name)
+		assert.Equal(c.version, version, c.name)
+	}
+}
+
+func TestVersionHistoryIsBounded(t *testing.T) {
+	assert := assert.New(t)
+
+	h := newVersionHistory()
+	h.Record(Secret{Name: "empty"}, time.Now())
+	assert.Empty(h.Versions("empty"), "secrets without content should not be recorded")
+
+	for i := 0; i < maxVersions+5; i++ {
+		h.Record(Secret{Name: "foo", Content: content(fmt.Sprintf("v%d", i))}, time.Now())
+	}
+	id := func(i int) string {
+		return versionID(Secret{Name: "foo", Content: content(fmt.Sprintf("v%d", i))})
+	}
+	versions := h.Versions("foo")
+	assert.Len(versions, maxVersions)
+	assert.Equal(id(5), versions[0].ID)
+	assert.Equal(id(maxVersions+4), versions[maxVersions-1].ID)
+	assert.Empty(versions[0].Secret.Content, "listed versions should have no content")
+	assert.EqualValues(2, versions[0].Secret.Length)
+
+	// Seeing a version again moves it to the end instead of duplicating it.
+	h.Record(Secret{Name: "foo", Content: content("v5")}, time.Now())
+	versions = h.Versions("foo")
+	assert.Len(versions, maxVersions)
+	assert.Equal(id(5), versions[maxVersions-1].ID)
+	secret, ok := h.Version("foo", id(5))
+	assert.True(ok)
+	assert.Equal(content("v5"), secret.Content)
+	secret.Release()
+}
+
+func TestCacheVersions(t *testing.T) {
+	assert := assert.New(t)
+
+	created := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	backend := NewMapBackend(
+		Secret{Name: "rotated", Content: content("old"), CreatedAt: created},
+		Secret{Name: "plain", Content: content("plain"), CreatedAt: created},
+		Secret{Name: "versioned..aaaa", Content: content("first"), CreatedAt: created},
+		Secret{Name: "versioned..bbbb", Content: content("second"), CreatedAt: created.Add(time.Hour)})
+	counting := &CountingBackend{SecretBackend: backend}
+	cache := NewCache(counting, Timeouts{0, 100 * time.Millisecond, 200 * time.Millisecond, time.Hour}, logConfig, nil)
+
+	// Versions seen by the cache.
+	old, ok := cache.Secret("rotated")
+	assert.True(ok)
+	backend.Put(Secret{Name: "rotated", Content: content("new"), CreatedAt: created.Add(time.Hour)})
+	_, ok = cache.Secret("rotated")
+	assert.True(ok)
+
+	versions := cache.Versions("rotated")
+	if assert.Len(versions, 2) {
+		assert.Equal(versionID(*old), versions[0].ID)
+		assert.Equal(versionID(Secret{Content: content("new")}), versions[1].ID)
+		assert.EqualValues(3, versions[1].Secret.Length)
+	}
+	current, ok := cache.CurrentVersion("rotated")
+	assert.True(ok)
+	assert.Equal(versions[1].ID, current)
+
+	secret, ok := cache.Version("rotated", versions[0].ID)
+	assert.True(ok)
+	assert.Equal(content("old"), secret.Content)
+
+	// Versions listed by the backend are fetched on demand.
+	versions = cache.Versions("versioned")
+	if assert.Len(versions, 2) {
+		assert.Equal("aaaa", versions[0].ID)
+		assert.Equal("bbbb", versions[1].ID)
+		assert.Empty(versions[0].Secret.Content)
+	}
+	secret, ok = cache.Version("versioned", "aaaa")
+	assert.True(ok)
+	assert.Equal(content("first"), secret.Content)
+	current, ok = cache.CurrentVersion("versioned")
+	assert.True(ok)
+	assert.Equal("bbbb", current)
+
+	// Unknown versions aren't requested from the backend.
+	_, ok = cache.Version("versioned", "cccc")
+	assert.False(ok)
+	assert.Equal(0, counting.Calls("versioned..cccc"))
+	_, ok = cache.Version("plain", "aaaa")
+	assert.False(ok)
+	assert.Equal(0, counting.Calls("plain..aaaa"))
+
+	// Secrets without versions aren't listed.
+	assert.Equal([]string{"rotated", "versioned"}, cache.VersionedNames())
+
+	cache.Clear()
+	assert.Empty(cache.Versions("rotated"), "versions seen by the cache should be forgotten")
+	assert.Len(cache.Versions("versioned"), 2)
+}
+
+func TestFsVersions(t *testing.T) {
+	assert := assert.New(t)
+	context := &fuse.Context{}
+
+	backend := NewMapBackend(Secret{Name: "foo", Content: content("old"), Length: 3, Mode: "0400"})
+	counting := &CountingBackend{SecretBackend: backend}
+	timeouts := Timeouts{0, 100 * time.Millisecond, 200 * time.Millisecond, time.Hour}
+	kwfs, _, err := NewKeywhizFs(nil, counting, Ownership{Uid: 1000, Gid: 1000}, timeouts, nil, logConfig)
+	assert.NoError(err)
+
+	_, status := kwfs.GetAttr("foo", context)
+	assert.Equal(fuse.OK, status)
+	oldID := versionID(Secret{Name: "foo", Content: content("old")})
+	backend.Put(Secret{Name: "foo", Content: content("newer"), Length: 5, Mode: "0440"})
+	newID := versionID(Secret{Name: "foo", Content: content("newer")})
+
+	entries, status := kwfs.OpenDir(".versions", context)
+	assert.Equal(fuse.OK, status)
+	assert.Equal([]fuse.DirEntry{{Name: "foo", Mode: fuse.S_IFDIR}}, entries)
+
+	entries, status = kwfs.OpenDir(".versions/foo", context)
+	assert.Equal(fuse.OK, status)
+	assert.Contains(entries, fuse.DirEntry{Name: oldID, Mode: fuse.S_IFREG})
+	assert.Contains(entries, fuse.DirEntry{Name: newID, Mode: fuse.S_IFREG})
+	assert.Contains(entries, fuse.DirEntry{Name: "current", Mode: fuse.S_IFLNK})
+
+	attr, status := kwfs.GetAttr(".versions/foo", context)
+	assert.Equal(fuse.OK, status)
+	assert.EqualValues(fuse.S_IFDIR|0550, attr.Mode, "the directory follows the current version")
+
+	// Secrets are listed at most once per operation.
+	for _, op := range []func(){
+		func() { kwfs.OpenDir(".versions", context) },
+		func() { kwfs.OpenDir(".versions/foo", context) },
+		func() { kwfs.GetAttr(".versions/foo", context) },
+		func() { kwfs.GetAttr(".versions/foo/current", context) },
+	} {
+		lists := counting.Lists()
+		op()
+		assert.True(counting.Lists()-lists <= 1)
+	}
+
+	attr, status = kwfs.GetAttr(".versions/foo/"+oldID, context)
+	assert.Equal(fuse.OK, status)
+	assert.EqualValues(fuse.S_IFREG|0400, attr.Mode, "versions keep their own mode")
+	assert.EqualValues(3, attr.Size)
+
+	target, status := kwfs.Readlink(".versions/foo/current", context)
+	assert.Equal(fuse.OK, status)
+	assert.Equal(newID, target)
+	attr, status = kwfs.GetAttr(".versions/foo/current", context)
+	assert.Equal(fuse.OK, status)
+	assert.True(attr.IsSymlink())
+
+	file, status := kwfs.Open(".versions/foo/"+oldID, 0, context)
+	assert.Equal(fuse.OK, status)
+	buf := make([]byte, 100)
+	res, _ := file.Read(buf, 0)
+	data, _ := res.Bytes(buf)
+	assert.Equal([]byte("old"), data)
+
+	for _, name := range []string{".versions/bar", ".versions/foo/0000", ".versions/foo/current/x", ".versions/foo/" + oldID + "/x"} {
+		_, status = kwfs.GetAttr(name, context)
+		assert.Equal(fuse.ENOENT, status, name)
+	}
+	assert.Equal(0, counting.Calls("foo..0000"), "unknown versions shouldn't be requested")
+	_, status = kwfs.Open(".versions/foo", 0, context)
+	assert.Equal(fuseEISDIR, status)
+	_, status = kwfs.Readlink(".versions/foo/"+oldID, context)
+	assert.Equal(fuse.ENOENT, status)
+}
+
+func TestHarnessVersions(t *testing.T) {
+	assert := assert.New(t)
+
+	backend := NewMapBackend(Secret{Name: "foo", Content: content("old"), Length: 3})
+	h := newFsHarness(t, backend)
+	defer h.Close()
+
+	_, err := h.Read("foo")
+	assert.NoError(err)
+	backend.Put(Secret{Name: "foo", Content: content("newer"), Length: 5})
+	_, err = h.Read("foo")
+	assert.NoError(err)
+
+	names, err := h.List(".versions/foo")
+	assert.NoError(err)
+	assert.Len(names, 3)
+
+	target, err := os.Readlink(h.Path(".versions/foo/current"))
+	assert.NoError(err)
+	assert.Equal(versionID(Secret{Name: "foo", Content: content("newer")}), target)
+
+	data, err := h.Read(".versions/foo/current")
+	assert.NoError(err)
+	assert.Equal([]byte("newer"), data)
+	data, err = h.Read(".versions/foo/" + versionID(Secret{Name: "foo", Content: content("old")}))
+	assert.NoError(err)
+	assert.Equal([]byte("old"), data)
+}